@@ -0,0 +1,144 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveCommand is recorded as the command of files that are packed into an
+// album archive, so switching a file between archiving and converting
+// reprocesses it.
+const (
+	archiveCommand = "archive"
+	archiveExt     = ".tar.zst"
+)
+
+// isArchived reports whether a source file matches one of the --archive
+// patterns. Files directly in the source root have no album and are never
+// archived.
+func (s *syncer) isArchived(relPath string) bool {
+	if filepath.Dir(relPath) == "." {
+		return false
+	}
+	for _, pattern := range s.options.archives {
+		if matched, _ := regexp.MatchString(pattern, relPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveRelPath returns the archive a source file is packed into: one per
+// album directory, named after it.
+func (s *syncer) archiveRelPath(relPath string) string {
+	rel := s.normalizeArtistDir(filepath.Dir(relPath) + archiveExt)
+	return flattenPath(rel, s.options.flatten)
+}
+
+// planArchives makes sure archives (and audiobooks) are rebuilt as a whole:
+// if any file of an album changed, or a file was removed from it since the
+// last run, all files of the album are marked for processing.
+func (s *syncer) planArchives(jobs []syncJob, oldDB *syncDB) {
+	members := make(map[string][]int)
+	sources := make(map[string]bool)
+	for i, job := range jobs {
+		if job.archive && job.skipReason == "" {
+			members[job.relTargetPath] = append(members[job.relTargetPath], i)
+			sources[s.pathKey(job.relPath)] = true
+		}
+	}
+	dirty := make(map[string]bool)
+	for _, e := range oldDB.Entries {
+		if isGroupedCommand(e.Command) && e.hasTarget() && !sources[s.pathKey(e.SourcePath)] {
+			dirty[e.TargetPath] = true
+		}
+	}
+	for target, indexes := range members {
+		for _, i := range indexes {
+			if jobs[i].needsProcessing {
+				dirty[target] = true
+			}
+		}
+		if !dirty[target] {
+			continue
+		}
+		for _, i := range indexes {
+			if !jobs[i].needsProcessing {
+				jobs[i].needsProcessing = true
+				jobs[i].reasonKind, jobs[i].reason = reasonArchiveChanged, "archive changed"
+			}
+		}
+	}
+}
+
+// buildArchive packs the source files of jobs (which all share the same
+// target) into a tar.zst archive. Paths inside the archive are relative to
+// the source directory, so extracting all archives recreates the library.
+func (s *syncer) buildArchive(jobs []*syncJob) error {
+	target := jobs[0].targetFile
+	if err := s.checkTargetPath(target); err != nil {
+		return err
+	}
+	write := func(w io.Writer) error {
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		tw := tar.NewWriter(zw)
+		for _, job := range jobs {
+			if err := addToArchive(tw, job); err != nil {
+				zw.Close()
+				return fmt.Errorf("%s: %w", job.relPath, err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			zw.Close()
+			return err
+		}
+		return zw.Close()
+	}
+
+	if s.targetKey == nil {
+		return s.perms.writeAtomically(target, write)
+	}
+	staged := filepath.Join(s.stagingRoot, fmt.Sprintf("archive-%d%s", os.Getpid(), archiveExt))
+	defer os.Remove(staged)
+	if err := s.perms.writeAtomically(staged, write); err != nil {
+		return err
+	}
+	return s.encryptFile(staged, target)
+}
+
+func addToArchive(tw *tar.Writer, job *syncJob) error {
+	f, err := os.Open(job.sourcePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(job.relPath)
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// isGroupedCommand reports whether command puts several sources into one
+// target: an archive or an audiobook.
+func isGroupedCommand(command string) bool {
+	return command == archiveCommand || isAudiobookCommand(command)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// trailingArticles are the articles moved back to the front of "Beatles, The"
+// style names.
+var trailingArticles = []string{"The", "A", "An", "Die", "Der", "Das", "Le", "La", "Les", "El", "Los", "Las"}
+
+var featPattern = regexp.MustCompile(`(?i)\s+(?:feat\.?|ft\.?|featuring)\s+`)
+
+// loadArtistMap reads a file with one "From = To" mapping per line. Empty
+// lines and lines starting with # are ignored.
+func (s *syncer) loadArtistMap(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		from, to, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected \"From = To\"", path, n)
+		}
+		s.artistMap[strings.ToLower(strings.TrimSpace(from))] = strings.TrimSpace(to)
+	}
+	return scanner.Err()
+}
+
+// normalizeArtist returns the canonical spelling of an artist directory name.
+func (s *syncer) normalizeArtist(name string) string {
+	if to, ok := s.artistMap[strings.ToLower(name)]; ok {
+		return to
+	}
+	if !s.options.normalizeArtistDirs {
+		return name
+	}
+
+	name = featPattern.ReplaceAllString(name, " feat. ")
+	for _, article := range trailingArticles {
+		suffix := ", " + article
+		if len(name) > len(suffix) && strings.EqualFold(name[len(name)-len(suffix):], suffix) {
+			name = article + " " + name[:len(name)-len(suffix)]
+			break
+		}
+	}
+	if to, ok := s.artistMap[strings.ToLower(name)]; ok {
+		return to
+	}
+	return name
+}
+
+// normalizeArtistDir applies normalizeArtist to the first component (the
+// artist directory) of a relative target path.
+func (s *syncer) normalizeArtistDir(rel string) string {
+	if !s.options.normalizeArtistDirs && len(s.artistMap) == 0 {
+		return rel
+	}
+	artist, rest, ok := strings.Cut(rel, string(filepath.Separator))
+	if !ok {
+		return rel
+	}
+	return filepath.Join(s.normalizeArtist(artist), rest)
+}
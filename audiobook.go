@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Audiobooks are directories of per-chapter files that are merged into a
+// single file with chapters in the target, one per directory, like archives
+// are for albums. The command recorded for their files includes the output
+// settings, so changing them rebuilds the books.
+const (
+	audiobookCommandPrefix = "audiobook"
+	ffprobeBinary          = "ffprobe"
+)
+
+// Values of --audiobook-format.
+const (
+	audiobookM4B  = "m4b"
+	audiobookOpus = "opus"
+)
+
+func (s *syncer) audiobookCommand() string {
+	return fmt.Sprintf("%s %s %s", audiobookCommandPrefix, s.options.audiobookFormat, s.options.audiobookBitrate)
+}
+
+func isAudiobookCommand(command string) bool {
+	return strings.HasPrefix(command, audiobookCommandPrefix+" ")
+}
+
+// isAudiobook reports whether an audio file matches one of the --audiobook
+// patterns. Like for archives, files directly in the source root are never
+// merged.
+func (s *syncer) isAudiobook(relPath string) bool {
+	if filepath.Dir(relPath) == "." {
+		return false
+	}
+	for _, pattern := range s.options.audiobooks {
+		if matched, _ := regexp.MatchString(pattern, relPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// audiobookRelPath returns the file a chapter is merged into: one per
+// directory, named after it.
+func (s *syncer) audiobookRelPath(relPath string) string {
+	rel := s.normalizeArtistDir(filepath.Dir(relPath) + "." + s.options.audiobookFormat)
+	return flattenPath(rel, s.options.flatten)
+}
+
+// chapterInfo is what ffprobe tells about a chapter file.
+type chapterInfo struct {
+	Format struct {
+		Duration string            `json:"duration"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+}
+
+// probeChapter returns the duration of a chapter file and its title, taken
+// from the title tag or else the file name.
+func (s *syncer) probeChapter(path string) (time.Duration, string, error) {
+	output, err := exec.CommandContext(s.runCtx, ffprobeBinary, "-v", "error",
+		"-show_entries", "format=duration:format_tags=title", "-of", "json", path).Output()
+	if err != nil {
+		return 0, "", fmt.Errorf("ffprobe: %w", err)
+	}
+	var info chapterInfo
+	if err := json.Unmarshal(output, &info); err != nil {
+		return 0, "", fmt.Errorf("ffprobe: %w", err)
+	}
+	seconds, err := strconv.ParseFloat(info.Format.Duration, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("no duration for %s", path)
+	}
+	title := ""
+	for key, value := range info.Format.Tags {
+		if strings.EqualFold(key, "title") {
+			title = value
+		}
+	}
+	if title == "" {
+		title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return time.Duration(seconds * float64(time.Second)), title, nil
+}
+
+// escapeFFMetadata escapes a value for an ffmetadata file.
+func escapeFFMetadata(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune("=;#\\\n", r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// buildAudiobook merges the source files of jobs (which all share the same
+// target, in the order they were found) into one file with a chapter per
+// source file.
+func (s *syncer) buildAudiobook(jobs []*syncJob) error {
+	target := jobs[0].targetFile
+	if err := s.checkTargetPath(target); err != nil {
+		return err
+	}
+	work, err := os.MkdirTemp("", "smsbook-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+
+	var list, meta strings.Builder
+	list.WriteString("ffconcat version 1.0\n")
+	meta.WriteString(";FFMETADATA1\n")
+	fmt.Fprintf(&meta, "title=%s\n", escapeFFMetadata(filepath.Base(filepath.Dir(jobs[0].relPath))))
+	var start time.Duration
+	for _, job := range jobs {
+		duration, title, err := s.probeChapter(job.sourcePath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", job.relPath, err)
+		}
+		fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(job.sourcePath, "'", `'\''`))
+		fmt.Fprintf(&meta, "[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n",
+			start.Milliseconds(), (start + duration).Milliseconds(), escapeFFMetadata(title))
+		start += duration
+	}
+	listPath := filepath.Join(work, "chapters.txt")
+	metaPath := filepath.Join(work, "metadata.txt")
+	if err := os.WriteFile(listPath, []byte(list.String()), 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(metaPath, []byte(meta.String()), 0644); err != nil {
+		return err
+	}
+
+	codec := "aac"
+	if s.options.audiobookFormat == audiobookOpus {
+		codec = "libopus"
+	}
+	out := s.tempPath(target)
+	if s.targetKey != nil {
+		out = filepath.Join(work, "book."+s.options.audiobookFormat)
+	} else if err := s.perms.makeDirs(filepath.Dir(target)); err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(s.runCtx, ffmpegBinary, "-nostdin", "-v", "error",
+		"-f", "concat", "-safe", "0", "-i", listPath, "-i", metaPath,
+		"-map", "0:a", "-map_metadata", "1", "-map_chapters", "1",
+		"-c:a", codec, "-b:a", s.options.audiobookBitrate, out)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(out)
+		if s.interrupted() {
+			return errInterrupted
+		}
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	if s.targetKey != nil {
+		return s.encryptFile(out, target)
+	}
+	return s.renameInto(out, target)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// AudioInfo describes the audio of a source file as reported by ffprobe. It
+// is recorded in the DB, so later runs don't have to probe unchanged files
+// again.
+type AudioInfo struct {
+	Codec string `json:"codec"`
+	// BitRate is in bits per second, 0 if unknown.
+	BitRate    int64         `json:"bitRate,omitempty"`
+	SampleRate int           `json:"sampleRate,omitempty"`
+	Channels   int           `json:"channels,omitempty"`
+	Duration   time.Duration `json:"duration,omitempty"`
+}
+
+// ffprobeOutput is the part of ffprobe's JSON output we use.
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecName  string `json:"codec_name"`
+		BitRate    string `json:"bit_rate"`
+		SampleRate string `json:"sample_rate"`
+		Channels   int    `json:"channels"`
+	} `json:"streams"`
+	Format struct {
+		BitRate  string `json:"bit_rate"`
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+// probeAudio returns the info about the first audio stream of path.
+// Containers like Ogg often only know the overall bitrate, which is used
+// then.
+func (s *syncer) probeAudio(path string) (*AudioInfo, error) {
+	args := slices.Concat([]string{"-v", "error", "-select_streams", "a:0",
+		"-show_entries", "stream=codec_name,bit_rate,sample_rate,channels:format=bit_rate,duration",
+		"-of", "json"}, inputFormatArgs(path), []string{path})
+	output, err := exec.CommandContext(s.runCtx, ffprobeBinary, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe: %w", err)
+	}
+	var probe ffprobeOutput
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return nil, fmt.Errorf("ffprobe: %w", err)
+	}
+	if len(probe.Streams) == 0 {
+		return nil, fmt.Errorf("no audio stream in %s", path)
+	}
+	stream := probe.Streams[0]
+	info := &AudioInfo{Codec: stream.CodecName, Channels: stream.Channels}
+	if info.BitRate, err = strconv.ParseInt(stream.BitRate, 10, 64); err != nil {
+		info.BitRate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+	}
+	info.SampleRate, _ = strconv.Atoi(stream.SampleRate)
+	if seconds, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+		info.Duration = time.Duration(seconds * float64(time.Second))
+	}
+	return info, nil
+}
+
+// recordAudioInfo reports whether the audio info of sources should be
+// recorded in the DB: with --audio-info, and for --passthrough, which
+// decides by it.
+func (s *syncer) recordAudioInfo() bool {
+	return s.options.audioInfo || len(s.options.passthroughRules) != 0
+}
+
+// probeSources fills in the audio info of the audio jobs. Unchanged sources
+// reuse what the DB recorded, the others are probed.
+func (s *syncer) probeSources(jobs []syncJob) {
+	if !s.recordAudioInfo() {
+		return
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		if job.isImage || job.skipReason != "" || !s.isAudioExtension(extOf(job.sourcePath)) {
+			continue
+		}
+		if e := job.existingEntry; e != nil && e.Audio != nil && !s.sourceChanged(*job) {
+			job.audio = e.Audio
+			continue
+		}
+		info, err := s.probeAudio(job.sourcePath)
+		if err != nil {
+			s.planLog("Error probing %s: %v\n", job.relPath, err)
+			continue
+		}
+		job.audio = info
+	}
+}
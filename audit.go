@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// runAuditTarget reports what a sync with the current options would do to
+// the files already in the target, typically a device another program has
+// been maintaining: which would be overwritten, deleted (with
+// --delete-removed), kept or left alone. Nothing is written, not even the
+// probe files or the lock.
+func (s *syncer) runAuditTarget() {
+	s.options.quietPlan = true
+
+	var oldDB syncDB
+	s.loadDB(&oldDB, s.syncDBPath())
+	jobs, err := s.planJobs(&oldDB)
+	if err != nil {
+		fmt.Println("Error during planning:", err)
+		exit(1)
+	}
+
+	// Compare case-insensitively, many devices are, and a case-only
+	// difference is still a clash there.
+	key := func(rel string) string {
+		return strings.ToLower(s.pathKey(rel))
+	}
+	planned := make(map[string]bool)
+	for _, job := range jobs {
+		if job.skipReason != "" {
+			continue
+		}
+		if job.thumbnail != "" {
+			planned[key(job.thumbnail)] = job.needsThumbnail
+		}
+		if job.cueSheet != "" {
+			planned[key(job.cueSheet)] = job.needsCue
+		}
+		written := job.needsProcessing
+		if job.archive {
+			// Members share the archive, any of them changing rebuilds it.
+			written = written || planned[key(job.relTargetPath)]
+		}
+		planned[key(job.relTargetPath)] = written
+	}
+
+	var overwritten, deleted []string
+	var kept, untouched int
+	types := s.deletableTypes()
+	existing := make(map[string]bool)
+	err = filepath.Walk(s.options.targetDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if s.isInternalPath(path, s.options.targetDir) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(s.options.targetDir, path)
+		existing[key(rel)] = true
+		written, ok := planned[key(rel)]
+		switch {
+		case ok && written:
+			overwritten = append(overwritten, rel)
+		case ok:
+			kept++
+		case s.options.deleteRemovedFiles && !s.hiddenSkipped(rel) && s.deletableType(rel, types):
+			deleted = append(deleted, rel)
+		default:
+			untouched++
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println("Error reading target:", err)
+		exit(1)
+	}
+	created := 0
+	for k := range planned {
+		if !existing[k] {
+			created++
+		}
+	}
+
+	s.printAuditList("Would overwrite", overwritten)
+	s.printAuditList("Would delete", deleted)
+	fmt.Printf("Would overwrite %d files, delete %d, create %d, keep %d up to date and leave %d alone.\n",
+		len(overwritten), len(deleted), created, kept, untouched)
+	if untouched > 0 {
+		fmt.Println("Files left alone are not tracked, --delete-removed would delete those of the types this sync writes, --deep-clean all of them.")
+	}
+}
+
+// printAuditList prints a titled, sorted list of target paths, if any.
+func (s *syncer) printAuditList(title string, paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	sort.SliceStable(paths, func(i, j int) bool { return s.pathCollator.Less(paths[i], paths[j]) })
+	fmt.Printf("%s %d files:\n", title, len(paths))
+	for _, p := range paths {
+		fmt.Println("  " + p)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// syncInBatches plans and processes the source in batches of
+// --batch-dirs top-level directories, instead of planning the whole library
+// before converting anything. Only the jobs of one batch are in memory at a
+// time, plus those that changed something, for the summary. It returns the
+// DB entries of all batches. The DB is saved after every batch; on errors
+// it is saved the same way and the error returned.
+func (s *syncer) syncInBatches(oldDB *syncDB, dbPath string) ([]SyncDBEntry, []syncJob, error) {
+	// Saving a batch writes the old entries of the others, so they are read
+	// up front.
+	if err := oldDB.load(); err != nil {
+		err = fmt.Errorf("reading DB: %w", err)
+		s.reportRunEnd(oldDB, nil, nil, err)
+		return nil, nil, err
+	}
+	scopes, err := s.batchScopes()
+	if err != nil {
+		s.reportRunEnd(oldDB, nil, nil, err)
+		return nil, nil, err
+	}
+
+	var entries []SyncDBEntry
+	var changed []syncJob
+	done := make(map[string]bool)
+	// Directories reached through symlinks are walked once in all batches.
+	visited := make(map[string]bool)
+	confirmed := false
+	s.claimedTargets = make(map[string]bool)
+	defer func() { s.claimedTargets = nil }()
+	// save writes the entries so far, and the old ones of the batches that
+	// didn't run yet, so an interrupted run keeps the completed batches.
+	save := func() syncDB {
+		newDB := syncDB{Entries: entries}
+		for _, e := range oldDB.Entries {
+			if !done[topLevelScope(e.SourcePath)] {
+				newDB.Entries = append(newDB.Entries, e)
+			}
+		}
+		s.saveDB(&newDB, dbPath)
+		return newDB
+	}
+	abort := func(err error) ([]SyncDBEntry, []syncJob, error) {
+		newDB := save()
+		s.reportRunEnd(oldDB, &newDB, changed, err)
+		return nil, nil, err
+	}
+
+	for start := 0; start < len(scopes); start += s.options.batchDirs {
+		batch := scopes[start:min(start+s.options.batchDirs, len(scopes))]
+		jobs, err := s.scanBatch(batch, oldDB, visited)
+		if err != nil {
+			return abort(err)
+		}
+		s.planScannedJobs(jobs, oldDB)
+		if !s.confirmMassChange(append(changed[:len(changed):len(changed)], jobs...), &confirmed) {
+			return abort(errTooManyChanges)
+		}
+
+		s.pruneUnselected(jobs)
+		batchEntries, err := s.executeJobs(jobs)
+		entries = append(entries, batchEntries...)
+		for _, scope := range batch {
+			done[scope] = true
+		}
+		for _, job := range jobs {
+			if job.needsProcessing || job.skipReason != "" && !job.filtered {
+				changed = append(changed, job)
+			}
+		}
+		if err != nil {
+			return abort(err)
+		}
+		save()
+	}
+	return entries, changed, nil
+}
+
+// batchScopes returns the top-level directories of the source in walk
+// order, and "." first if there are files directly in the source.
+func (s *syncer) batchScopes() ([]string, error) {
+	entries, err := os.ReadDir(s.options.sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	rootFiles := false
+	for _, entry := range entries {
+		if s.isInternalPath(filepath.Join(s.options.sourceDir, entry.Name()), s.options.sourceDir) {
+			continue
+		}
+		if entry.IsDir() || s.options.followSymlinks && isDirLink(filepath.Join(s.options.sourceDir, entry.Name())) {
+			dirs = append(dirs, entry.Name())
+		} else {
+			rootFiles = true
+		}
+	}
+	sort.Strings(dirs)
+	if rootFiles {
+		dirs = append([]string{"."}, dirs...)
+	}
+	return dirs, nil
+}
+
+// topLevelScope returns the batch scope a source path (relative to the
+// source) belongs to.
+func topLevelScope(rel string) string {
+	top, _, found := strings.Cut(rel, string(filepath.Separator))
+	if !found {
+		return "."
+	}
+	return top
+}
+
+// scanBatch creates the jobs for the files in the given batch scopes.
+// visited is shared by the batches, see scanDirs.
+func (s *syncer) scanBatch(scopes []string, oldDB *syncDB, visited map[string]bool) ([]syncJob, error) {
+	var dirs []string
+	var jobs []syncJob
+	for _, scope := range scopes {
+		if scope != "." {
+			dirs = append(dirs, scope)
+			continue
+		}
+		// Only the files directly in the source, the directories are
+		// scopes of their own.
+		markers := newMarkerState(&s.options)
+		if markers.enterDir(s.options.sourceDir) != "" {
+			continue
+		}
+		entries, err := os.ReadDir(s.options.sourceDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			path := filepath.Join(s.options.sourceDir, entry.Name())
+			if entry.IsDir() || s.options.followSymlinks && isDirLink(path) || s.isInternalPath(path, s.options.sourceDir) || !markers.included(path) {
+				continue
+			}
+			if job, ok := s.newJob(path, oldDB); ok {
+				jobs = append(jobs, job)
+			}
+		}
+	}
+	dirJobs, err := s.scanDirs(dirs, oldDB, visited)
+	return append(jobs, dirJobs...), err
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// overBudgetReason is the skip reason of files left out by --size-budget.
+const overBudgetReason = "over size budget"
+
+// Rules of --budget-priority.
+const (
+	budgetByPlaylists = "playlists"
+	budgetByRating    = "rating"
+	budgetByRecent    = "recent"
+)
+
+// applySizeBudget selects what fits into --size-budget when the library
+// doesn't: the audio files are taken in the order of --budget-priority while
+// they fit, the rest is skipped like a filter would. Images and sidecar
+// files follow the music of their directory and count towards the budget
+// with the first file taken from it. Targets that already exist count with
+// their real size, others with an estimate (see estimatedSize).
+func (s *syncer) applySizeBudget(jobs []syncJob) {
+	if s.options.sizeBudget <= 0 {
+		return
+	}
+	listed, err := s.playlistFiles(s.options.budgetPlaylists)
+	if err != nil {
+		s.planLog("Error reading --budget-playlist: %v\n", err)
+	}
+	ratios := s.conversionRatios(jobs)
+
+	var used int64
+	var tracks []int
+	followers := make(map[string][]int)
+	for i, job := range jobs {
+		switch {
+		case job.skipReason != "":
+		case job.isImage || job.sidecar:
+			dir := filepath.Dir(job.relPath)
+			followers[dir] = append(followers[dir], i)
+		case job.playlist:
+			used += s.estimatedSize(job, ratios)
+		default:
+			tracks = append(tracks, i)
+		}
+	}
+	sort.SliceStable(tracks, func(a, b int) bool {
+		return s.budgetBefore(jobs[tracks[a]], jobs[tracks[b]], listed)
+	})
+
+	selectedDirs := make(map[string]bool)
+	for _, i := range tracks {
+		job := &jobs[i]
+		dir := filepath.Dir(job.relPath)
+		size := s.estimatedSize(*job, ratios)
+		if !selectedDirs[dir] {
+			for _, k := range followers[dir] {
+				size += s.estimatedSize(jobs[k], ratios)
+			}
+		}
+		if used+size > s.options.sizeBudget {
+			job.skipReason, job.filtered = overBudgetReason, true
+			continue
+		}
+		used += size
+		selectedDirs[dir] = true
+	}
+	for dir, indexes := range followers {
+		if !selectedDirs[dir] {
+			for _, k := range indexes {
+				jobs[k].skipReason, jobs[k].filtered = overBudgetReason, true
+			}
+		}
+	}
+	s.planLog("Size budget: selected %s of %s\n", formatSize(used), formatSize(s.options.sizeBudget))
+}
+
+// budgetBefore reports whether job a goes before job b by --budget-priority.
+func (s *syncer) budgetBefore(a, b syncJob, listed map[string]bool) bool {
+	for _, rule := range s.options.budgetPriority {
+		switch rule {
+		case budgetByPlaylists:
+			if la, lb := listed[s.pathKey(a.relPath)], listed[s.pathKey(b.relPath)]; la != lb {
+				return la
+			}
+		case budgetByRating:
+			if ra, rb := s.ratingOf(a.relPath), s.ratingOf(b.relPath); ra != rb {
+				return ra > rb
+			}
+		case budgetByRecent:
+			if ta, tb := a.sourceInfo.ModTime(), b.sourceInfo.ModTime(); !ta.Equal(tb) {
+				return ta.After(tb)
+			}
+		}
+	}
+	return false
+}
+
+// ratingOf returns the rating of a file from --ratings-file, 0 if it has
+// none.
+func (s *syncer) ratingOf(relPath string) float64 {
+	if s.ratings == nil {
+		return 0
+	}
+	e, _ := s.lookupRating(relPath)
+	return e.Rating
+}
+
+// playlistFiles returns the files listed in the playlists at paths
+// (relative to the source or absolute), by pathKey.
+func (s *syncer) playlistFiles(paths []string) (map[string]bool, error) {
+	listed := make(map[string]bool)
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(s.options.sourceDir, path)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return listed, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			entry := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+			if entry == "" || strings.HasPrefix(entry, "#") {
+				continue
+			}
+			if rel, ok := s.playlistEntrySource(entry, filepath.Dir(path)); ok {
+				listed[s.pathKey(rel)] = true
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return listed, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return listed, nil
+}
+
+// conversionRatios returns, per command, how large the targets of the jobs
+// that are already synced with it are compared to their sources, to
+// estimate the size of the others.
+func (s *syncer) conversionRatios(jobs []syncJob) map[string]float64 {
+	sources := make(map[string]int64)
+	targets := make(map[string]int64)
+	for _, job := range jobs {
+		if size, ok := s.existingTargetSize(job); ok && job.sourceInfo.Size() > 0 {
+			sources[job.command] += job.sourceInfo.Size()
+			targets[job.command] += size
+		}
+	}
+	ratios := make(map[string]float64, len(sources))
+	for command, size := range sources {
+		ratios[command] = float64(targets[command]) / float64(size)
+	}
+	return ratios
+}
+
+// estimatedSize returns how much space the target of a job takes: the size
+// of the target if it is up to date, or else the source size scaled like
+// the other files converted with the same command, or projectedSize if
+// there are none yet.
+func (s *syncer) estimatedSize(job syncJob, ratios map[string]float64) int64 {
+	if size, ok := s.existingTargetSize(job); ok {
+		return size
+	}
+	if ratio, ok := ratios[job.command]; ok {
+		return int64(float64(job.sourceInfo.Size()) * ratio)
+	}
+	return projectedSize(job)
+}
+
+// existingTargetSize returns the size of the target of a job, if it was
+// made from the current source with the current command.
+func (s *syncer) existingTargetSize(job syncJob) (int64, bool) {
+	e := job.existingEntry
+	if e == nil || !e.hasTarget() || e.Command != job.command || e.Size != job.sourceInfo.Size() || !s.sameModTime(e.ModTime, job.sourceInfo.ModTime()) {
+		return 0, false
+	}
+	info, err := os.Stat(filepath.Join(s.options.targetDir, e.TargetPath))
+	if err != nil {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+// pruneUnselected deletes the targets of files that no longer fit into
+// --size-budget or fell out of --select, before anything new is written, so
+// the target never holds more than the budget. It doesn't wait for
+// --delete-removed: keeping the target to the selection is the point.
+func (s *syncer) pruneUnselected(jobs []syncJob) {
+	for _, job := range jobs {
+		e := job.existingEntry
+		if job.skipReason != overBudgetReason && job.skipReason != unselectedReason || e == nil || !e.hasTarget() {
+			continue
+		}
+		for _, rel := range []string{e.TargetPath, e.Thumbnail, e.Cue} {
+			if rel == "" {
+				continue
+			}
+			path := filepath.Join(s.options.targetDir, rel)
+			if err := s.checkTargetPath(path); err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			if err := s.removeTarget(path); err != nil && !os.IsNotExist(err) {
+				fmt.Println("Error deleting file:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Kinds of --checksums, and the extensions of their files.
+const (
+	checksumMD5 = "md5"
+	checksumFFP = "ffp"
+)
+
+// checksumsFileName is the name of the checksum files written into every
+// target directory, with the kind as extension.
+const checksumsFileName = "checksums"
+
+// isChecksumFile reports whether a path (relative to the target) is one of
+// the checksum files of --checksums still needed: its kind is enabled and
+// its directory is one of dirs, as returned by checksumDirs. Others are left
+// to be deleted like any file no source maps to.
+func (s *syncer) isChecksumFile(dirs map[string][]string, relPath string) bool {
+	name := filepath.Base(relPath)
+	kind := strings.TrimPrefix(filepath.Ext(name), ".")
+	if name != checksumsFileName+"."+kind || !slices.Contains(s.options.checksums, kind) {
+		return false
+	}
+	_, ok := dirs[filepath.Dir(relPath)]
+	return ok
+}
+
+// checksumDirs returns the names of the files recorded in db that exist in
+// the target, by their directory (relative to the target). It returns nil
+// without --checksums.
+func (s *syncer) checksumDirs(db *syncDB) map[string][]string {
+	if len(s.options.checksums) == 0 {
+		return nil
+	}
+	dirs := make(map[string][]string)
+	for _, e := range db.Entries {
+		if !e.hasTarget() {
+			continue
+		}
+		for _, rel := range []string{e.TargetPath, e.Cue} {
+			if rel != "" && fileExists(filepath.Join(s.options.targetDir, rel)) {
+				dirs[filepath.Dir(rel)] = append(dirs[filepath.Dir(rel)], filepath.Base(rel))
+			}
+		}
+	}
+	return dirs
+}
+
+// writeChecksums writes the checksum files of --checksums into every target
+// directory with files recorded in db: an md5sum style list of all of them,
+// and the FLAC fingerprints (the MD5 of the decoded audio stored in every
+// FLAC file) of the FLAC files. Only files that are missing or out of date
+// (listing other files, or older than one of them) are written, so
+// unchanged albums aren't read again.
+func (s *syncer) writeChecksums(db *syncDB) {
+	for dir, names := range s.checksumDirs(db) {
+		s.pathCollator.Sort(names)
+		for _, kind := range s.options.checksums {
+			if err := s.updateChecksumFile(dir, kind, names); err != nil {
+				fmt.Printf("Error writing %s: %v\n", filepath.Join(dir, checksumsFileName+"."+kind), err)
+			}
+		}
+	}
+}
+
+// updateChecksumFile writes the checksum file of the given kind for the
+// files called names in dir (relative to the target), if it is out of date.
+func (s *syncer) updateChecksumFile(dir, kind string, names []string) error {
+	if kind == checksumFFP {
+		names = slices.DeleteFunc(slices.Clone(names), func(name string) bool {
+			return !strings.EqualFold(filepath.Ext(name), ".flac")
+		})
+	}
+	path := filepath.Join(s.options.targetDir, dir, checksumsFileName+"."+kind)
+	if len(names) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if checksumsUpToDate(path, kind, names) {
+		return nil
+	}
+
+	var b strings.Builder
+	for _, name := range names {
+		sum, err := fileChecksum(filepath.Join(s.options.targetDir, dir, name), kind)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if kind == checksumFFP {
+			fmt.Fprintf(&b, "%s:%s\n", name, sum)
+		} else {
+			fmt.Fprintf(&b, "%s *%s\n", sum, name)
+		}
+	}
+	if err := s.checkTargetPath(path); err != nil {
+		return err
+	}
+	return s.perms.writeAtomically(path, func(w io.Writer) error {
+		_, err := io.WriteString(w, b.String())
+		return err
+	})
+}
+
+// checksumsUpToDate reports whether the checksum file at path lists exactly
+// the files called names, and none of them changed since it was written.
+// The order doesn't matter, so changing --sort-locale doesn't make every
+// album be read again.
+func checksumsUpToDate(path, kind string, names []string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	var listed []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if kind == checksumFFP {
+			if i := strings.LastIndex(line, ":"); i >= 0 {
+				listed = append(listed, line[:i])
+			}
+		} else if _, name, ok := strings.Cut(line, " *"); ok {
+			listed = append(listed, name)
+		}
+	}
+	slices.Sort(listed)
+	if !slices.Equal(listed, slices.Sorted(slices.Values(names))) {
+		return false
+	}
+	for _, name := range names {
+		file, err := os.Stat(filepath.Join(filepath.Dir(path), name))
+		if err != nil || file.ModTime().After(info.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
+
+// fileChecksum returns the checksum of a file for a checksum file: the MD5
+// of its content, or for ffp the MD5 of the decoded audio a FLAC file
+// stores.
+func fileChecksum(path, kind string) (string, error) {
+	if kind == checksumFFP {
+		_, sum, err := flacStreamInfo(path)
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(sum), nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
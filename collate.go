@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// nameCollator sorts names and relative paths for anything the tool prints or
+// generates (summaries, playlists, indexes). It uses locale-aware collation
+// and can ignore leading articles such as "The".
+type nameCollator struct {
+	col      *collate.Collator
+	prefixes []string
+}
+
+func newNameCollator(tag language.Tag, ignorePrefixes []string) *nameCollator {
+	c := &nameCollator{col: collate.New(tag, collate.IgnoreCase, collate.Numeric)}
+	for _, p := range ignorePrefixes {
+		if p = strings.TrimSpace(p); p != "" {
+			c.prefixes = append(c.prefixes, strings.ToLower(p)+" ")
+		}
+	}
+	return c
+}
+
+// key strips the ignored prefixes from every component of a path.
+func (c *nameCollator) key(s string) string {
+	if len(c.prefixes) == 0 {
+		return s
+	}
+	parts := strings.Split(s, string(filepath.Separator))
+	for i, part := range parts {
+		lower := strings.ToLower(part)
+		for _, p := range c.prefixes {
+			if strings.HasPrefix(lower, p) && len(part) > len(p) {
+				parts[i] = part[len(p):]
+				break
+			}
+		}
+	}
+	return strings.Join(parts, string(filepath.Separator))
+}
+
+// Less reports whether a sorts before b. Ties are broken by byte order so the
+// result is deterministic.
+func (c *nameCollator) Less(a, b string) bool {
+	if r := c.col.CompareString(c.key(a), c.key(b)); r != 0 {
+		return r < 0
+	}
+	return a < b
+}
+
+// Sort sorts a slice of names in place.
+func (c *nameCollator) Sort(names []string) {
+	sort.SliceStable(names, func(i, j int) bool { return c.Less(names[i], names[j]) })
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// commandInfo describes a subcommand for the usage text.
+type commandInfo struct {
+	name    string
+	summary string
+}
+
+// commands lists the subcommands in the order they are shown. Running
+// without a command is the same as "sync".
+var commands = []commandInfo{
+	{"sync", "Sync the source to the target (the default)"},
+	{"status", "Show the pending work: files to process, failures, removed sources"},
+	{"diff", "Show what changed since the last sync without touching the target"},
+	{"plan", "Print the planned actions without executing them (--format text|json)"},
+	{"apply", "Execute the actions of a JSON plan (--plan plan.json)"},
+	{"audit-target", "Report what a sync would overwrite, delete or leave alone in a target it didn't create, without changing anything"},
+	{"verify", "Check that the target holds every file recorded in the DB, and nothing else"},
+	{"clean", "Delete targets of removed sources (--removed) and stale temporary files (--temp)"},
+	{"import", "Seed the DB from an existing target (--import-from target) or another DB (--import-from db)"},
+	{"rebuild-db", "Reconstruct a lost or corrupted DB by pairing the sources with the files in the target"},
+	{"stats", "Show how the size of the target grew over time and when it is projected to be full"},
+	{"scrub", "Re-read the sources and report files whose content changed behind our back"},
+	{"decrypt", "Decrypt an encrypted target into --output (--encrypt-key)"},
+	{"gui", "Serve a web page to run syncs from a browser (--listen, default 127.0.0.1:8765)"},
+	{"worker", "Run conversions for a coordinator started with --workers (--listen, --worker-token)"},
+	{"db snapshots", "List the DB snapshots kept in the target"},
+	{"db rollback", "Restore a DB snapshot, the next sync reconciles the target with it"},
+	{"db remap", "Rewrite the paths in the DB after moving files (--map-source, --map-target)"},
+	{"config validate", "Check the config file given with --config without running anything"},
+	{"schema config", "Print the JSON Schema of config files"},
+	{"schema plan", "Print the JSON Schema of plans (plan --format json)"},
+}
+
+// commandGroups maps the commands that take a subcommand to a list of them,
+// for the error when it is missing.
+var commandGroups = map[string]string{
+	"db":     "snapshots, rollback or remap",
+	"config": "validate",
+	"schema": "config or plan",
+}
+
+// commandScopeAnnotation marks flags that only apply to some commands.
+const commandScopeAnnotation = "commands"
+
+// scopeFlag restricts a flag to the given commands.
+func scopeFlag(name string, commandNames ...string) {
+	flag.CommandLine.SetAnnotation(name, commandScopeAnnotation, commandNames)
+}
+
+// flagApplies reports whether a flag is meant for the given command.
+func flagApplies(f *flag.Flag, command string) bool {
+	scope, ok := f.Annotations[commandScopeAnnotation]
+	if !ok {
+		return true
+	}
+	for _, c := range scope {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCommand splits the command off the arguments. Arguments that don't
+// start with a known command are flags for sync.
+func parseCommand(args []string) (string, []string, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "sync", args, nil
+	}
+	if subcommands, ok := commandGroups[args[0]]; ok {
+		if len(args) < 2 {
+			return "", nil, fmt.Errorf("%s needs a subcommand: %s", args[0], subcommands)
+		}
+		args = append([]string{args[0] + " " + args[1]}, args[2:]...)
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			return args[0], args[1:], nil
+		}
+	}
+	return "", nil, fmt.Errorf("unknown command %q", args[0])
+}
+
+// checkFlagScopes rejects flags given on the command line that the command
+// doesn't use, instead of silently ignoring them.
+func checkFlagScopes(command string) error {
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if err == nil && !flagApplies(f, command) {
+			err = fmt.Errorf("--%s can't be used with %s", f.Name, command)
+		}
+	})
+	return err
+}
+
+// printUsage prints the commands and the flags that apply to command.
+func printUsage(command string) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\n", filepath.Base(os.Args[0]))
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags for %s:\n", command)
+	scoped := flag.NewFlagSet(command, flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		if flagApplies(f, command) {
+			scoped.AddFlag(f)
+		}
+	})
+	scoped.PrintDefaults()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// commitStrategy is how the output of a command, written to a temporary
+// file, replaces its target, so a target is never seen half written.
+type commitStrategy interface {
+	// tempPath returns where the temporary file for final is written.
+	tempPath(final string) string
+	// commit moves the finished temporary file tmp to final.
+	commit(tmp, final string) error
+}
+
+// renameCommit writes temporary files next to their target and renames them
+// into place. This is the default.
+type renameCommit struct {
+	perms *targetPerms
+}
+
+func (renameCommit) tempPath(final string) string {
+	return siblingTempPath(final)
+}
+
+// commit gives tmp --chmod and --chown before renaming it, so the target
+// never shows up with the wrong ones.
+func (c renameCommit) commit(tmp, final string) error {
+	if err := c.perms.apply(tmp, false); err != nil {
+		return err
+	}
+	return os.Rename(tmp, final)
+}
+
+// stagedCommit writes temporary files into --temp-dir. If that is on the
+// filesystem of the target they are renamed into place, otherwise they are
+// copied next to the target first and renamed from there, so replacing the
+// target stays atomic.
+type stagedCommit struct {
+	dir    string
+	sameFS bool
+	perms  *targetPerms
+	// files numbers the temporary files in dir. They can't be named after
+	// their target, as files of different directories share it.
+	files *atomic.Int64
+}
+
+func (c stagedCommit) tempPath(final string) string {
+	// Keep the extension, ffmpeg picks the output format from it.
+	return filepath.Join(c.dir, fmt.Sprintf("%s%d-%d%s", tempPrefix, os.Getpid(), c.files.Add(1), filepath.Ext(final)))
+}
+
+func (c stagedCommit) commit(tmp, final string) error {
+	if c.sameFS {
+		return renameCommit{c.perms}.commit(tmp, final)
+	}
+	in, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer in.Close()
+	return c.perms.writeAtomically(final, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
+
+// setupTempDir creates --temp-dir and selects the commit strategy for it,
+// checking whether a file can be renamed from there into the target.
+func (s *syncer) setupTempDir() error {
+	if s.options.tempDir == "" {
+		return nil
+	}
+	dir, err := filepath.Abs(s.options.tempDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	probe := filepath.Join(dir, fmt.Sprintf("%s%d-probe", tempPrefix, os.Getpid()))
+	f, err := os.Create(probe)
+	if err != nil {
+		return fmt.Errorf("temp directory is not writable: %w", err)
+	}
+	f.Close()
+	moved := filepath.Join(s.options.targetDir, filepath.Base(probe))
+	sameFS := os.Rename(probe, moved) == nil
+	os.Remove(probe)
+	os.Remove(moved)
+	s.targetCommit = stagedCommit{dir: dir, sameFS: sameFS, perms: &s.perms, files: new(atomic.Int64)}
+	return nil
+}
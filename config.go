@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfig reads a TOML or YAML file (picked by extension) whose keys are
+// flag names without the leading dashes, and sets every flag that wasn't
+// given on the command line. Flags that can be used multiple times take a
+// list.
+//
+//	source = "/music"
+//	target = "/mnt/player"
+//	exclude = ["\\.m3u$", "^Podcasts/"]
+//
+// A config file can list several targets (see targetsKey). With
+// --only-target, the options of that target replace the common ones. With
+// --profile, those of the profile (see profilesKey) do, before the target's.
+func (s *syncer) loadConfig(path string) error {
+	values, err := readConfigValues(path)
+	if err != nil {
+		return err
+	}
+	profiles, err := parseProfiles(values)
+	if err != nil {
+		return err
+	}
+	if name := flag.Lookup("profile").Value.String(); name != "" {
+		if err := selectProfile(profiles, name, values); err != nil {
+			return err
+		}
+	}
+	if s.configuredTargets, err = parseTargets(values); err != nil {
+		return err
+	}
+	if name := flag.Lookup("only-target").Value.String(); name != "" {
+		if len(s.configuredTargets) == 0 {
+			return fmt.Errorf("--only-target needs targets in the config file")
+		}
+		if err := selectTarget(s.configuredTargets, name, values); err != nil {
+			return err
+		}
+	}
+	return setOptions(values, configCheck(path, values))
+}
+
+// readConfigValues parses the TOML or YAML config file at path.
+func readConfigValues(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	default:
+		return nil, fmt.Errorf("unknown config format %q, use .toml or .yaml", filepath.Ext(path))
+	}
+	return values, err
+}
+
+// configCheck returns the check of setOptions for the config file at path:
+// it refuses the options that only make sense on the command line, and those
+// an untrusted file can't set.
+func configCheck(path string, values map[string]any) func(name string) error {
+	trusted := configTrusted(path, values)
+	return func(name string) error {
+		if commandLineOnlyFlags[name] {
+			return fmt.Errorf("unknown option %q", name)
+		}
+		if !trusted && untrustedConfigDenied[name] {
+			return fmt.Errorf("option %q can't be set from a config file inside the source directory, use --trust-config to allow it", name)
+		}
+		return nil
+	}
+}
+
+// loadOptionsJSON reads a JSON object like a config file from path, or from
+// stdin for "-", for programs that run this one. It is trusted like the
+// command line, and may name a config file to load as well.
+//
+//	{"source": "/music", "ffmpeg-audio": "ffmpeg -i $INPUT -c:a libopus $OUTPUT"}
+func loadOptionsJSON(path string) error {
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	values := make(map[string]any)
+	dec := json.NewDecoder(in)
+	// Keep numbers as they were written, not as float64.
+	dec.UseNumber()
+	if err := dec.Decode(&values); err != nil {
+		return err
+	}
+	return setOptions(values, func(name string) error {
+		if name == "options-json" {
+			return fmt.Errorf("unknown option %q", name)
+		}
+		return nil
+	})
+}
+
+// setOptions sets the flags named by the keys of values, in sorted order,
+// skipping those given on the command line. check can refuse an option.
+func setOptions(values map[string]any, check func(name string) error) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := flag.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("unknown option %q", name)
+		}
+		if err := check(name); err != nil {
+			return err
+		}
+		if f.Changed {
+			continue
+		}
+		if err := setOption(name, values[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setOption sets a flag to a value of a config file, which is a list for
+// flags that can be used multiple times.
+func setOption(name string, value any) error {
+	list, ok := value.([]any)
+	if !ok {
+		list = []any{value}
+	}
+	for _, v := range list {
+		if v == nil {
+			return fmt.Errorf("option %q: missing value", name)
+		}
+		if err := flag.Set(name, fmt.Sprint(v)); err != nil {
+			return fmt.Errorf("option %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// untrustedConfigDenied lists the options a config file that ships with the
+// library can't set: ones that delete files, move or change the target, run
+// commands, or send data somewhere. Such a file may come from anywhere (a
+// downloaded album, a shared folder), unlike the user's own config.
+var untrustedConfigDenied = map[string]bool{
+	"target":                true,
+	"delete-removed":        true,
+	"deep-clean":            true,
+	"trash-retention":       true,
+	"removed":               true,
+	"temp":                  true,
+	"yes":                   true,
+	"max-changes":           true,
+	"size-budget":           true,
+	"budget-priority":       true,
+	"budget-playlist":       true,
+	"select":                true,
+	"ffmpeg-audio":          true,
+	"ffmpeg-image":          true,
+	"ffmpeg-audio-for":      true,
+	"ffmpeg-audio-fallback": true,
+	"ffmpeg-image-fallback": true,
+	"oversize-command":      true,
+	"workers":               true,
+	"worker-token":          true,
+	"worker-fingerprint":    true,
+	"worker-programs":       true,
+	"listen":                true,
+	"gui-token":             true,
+	"tls-cert":              true,
+	"tls-key":               true,
+	"tls-self-signed":       true,
+	"healthcheck-url":       true,
+	"smtp-server":           true,
+	"smtp-user":             true,
+	"smtp-password":         true,
+	"mail-from":             true,
+	"mail-to":               true,
+	"mail-on":               true,
+	"encrypt-key":           true,
+	"output":                true,
+	"thumbnail-dir":         true,
+	"temp-dir":              true,
+	"command-overrides":     true,
+}
+
+// configTrusted reports whether the config file at path may set every
+// option. Files inside the source directory are part of the library rather
+// than the user's own setup, so they are only trusted with --trust-config.
+// The source is the one given on the command line. Keys of the file itself
+// can only make it less trusted: a file that names a source at or below its
+// own directory (other than the home or config directory of the user) is
+// taken to be part of that library, wherever it says the library is.
+func configTrusted(path string, values map[string]any) bool {
+	if f := flag.Lookup("trust-config"); f != nil && f.Value.String() == "true" {
+		return true
+	}
+	path = resolvePath(path)
+	if flag.CommandLine.Changed("source") {
+		return !isWithin(path, resolvePath(flag.Lookup("source").Value.String()))
+	}
+	v, ok := values["source"]
+	if !ok {
+		return true
+	}
+	source := resolvePath(fmt.Sprint(v))
+	if isWithin(path, source) {
+		return false
+	}
+	dir := filepath.Dir(path)
+	if isWithin(source, dir) && !userConfigLocation(dir) {
+		return false
+	}
+	return true
+}
+
+// userConfigLocation reports whether dir is the home or config directory of
+// the user, where their own config files live next to (or above) the library.
+func userConfigLocation(dir string) bool {
+	for _, get := range []func() (string, error){os.UserHomeDir, os.UserConfigDir} {
+		if d, err := get(); err == nil && resolvePath(d) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePath returns the absolute path with symlinks resolved, or as much
+// of that as possible.
+func resolvePath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return path
+}
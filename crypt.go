@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Encrypted targets are meant for untrusted storage such as cloud drives.
+// Every target file is encrypted with AES-256-GCM in fixed size chunks (the
+// STREAM construction: a random nonce prefix per file, a chunk counter and a
+// flag marking the last chunk, so chunks can't be reordered or truncated).
+// File names can optionally be encrypted as well, one path component at a
+// time, deterministically so the next sync finds them again.
+const (
+	encryptedExt = ".enc"
+	encMagic     = "SMSENC1\n"
+	encChunkSize = 64 << 10
+	encPrefixLen = 7
+	// encBlobMagic starts the files the program keeps for itself in an
+	// encrypted target, such as the DB, sealed in one piece.
+	encBlobMagic = "SMSENCB1\n"
+)
+
+var (
+	errDecrypt   = errors.New("decryption failed (wrong key or corrupted file)")
+	errEncrypted = errors.New("the file is encrypted, use --encrypt-key")
+)
+
+type targetCipher struct {
+	content cipher.AEAD
+	names   cipher.AEAD
+	blobs   cipher.AEAD
+	// nameNonceKey derives the nonce of an encrypted name from the name.
+	nameNonceKey []byte
+	// obfuscateNames encrypts the names as well (--obfuscate-names).
+	obfuscateNames bool
+}
+
+// loadTargetKey reads a key file holding 32 random bytes in hex, e.g. made
+// with "head -c 32 /dev/urandom | xxd -p -c 64".
+func loadTargetKey(path string, obfuscateNames bool) (*targetCipher, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must contain a 32 byte key in hex", path)
+	}
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	newAEAD := func(k []byte) cipher.AEAD {
+		block, _ := aes.NewCipher(k)
+		aead, _ := cipher.NewGCM(block)
+		return aead
+	}
+	return &targetCipher{
+		content:        newAEAD(derive("content")),
+		names:          newAEAD(derive("names")),
+		blobs:          newAEAD(derive("blobs")),
+		nameNonceKey:   derive("name-nonce"),
+		obfuscateNames: obfuscateNames,
+	}, nil
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, encPrefixLen+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encPrefixLen:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptFile encrypts src into dst with the key of the target, going
+// through a temporary file so dst is never left half written.
+func (s *syncer) encryptFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return s.perms.writeAtomically(dst, func(w io.Writer) error {
+		return s.targetKey.encrypt(w, in)
+	})
+}
+
+// encrypt writes the content of in to w encrypted.
+func (c *targetCipher) encrypt(w io.Writer, in io.Reader) error {
+	prefix := make([]byte, encPrefixLen)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, encMagic); err != nil {
+		return err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return err
+	}
+	return transformChunks(in, encChunkSize, func(chunk []byte, counter uint32, last bool) error {
+		_, err := w.Write(c.content.Seal(nil, chunkNonce(prefix, counter, last), chunk, nil))
+		return err
+	})
+}
+
+// decryptFile decrypts a file written by encryptFile into dst.
+func (s *syncer) decryptFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	header := make([]byte, len(encMagic)+encPrefixLen)
+	if _, err := io.ReadFull(in, header); err != nil || string(header[:len(encMagic)]) != encMagic {
+		return fmt.Errorf("%s is not an encrypted file", src)
+	}
+	return s.perms.writeAtomically(dst, func(w io.Writer) error {
+		return s.targetKey.decrypt(w, in, header[len(encMagic):])
+	})
+}
+
+// decrypt writes the content of in, encrypted with the given prefix, to w
+// decrypted. The header has already been read from in.
+func (c *targetCipher) decrypt(w io.Writer, in io.Reader, prefix []byte) error {
+	return transformChunks(in, encChunkSize+c.content.Overhead(), func(chunk []byte, counter uint32, last bool) error {
+		plain, err := c.content.Open(nil, chunkNonce(prefix, counter, last), chunk, nil)
+		if err != nil {
+			return errDecrypt
+		}
+		_, err = w.Write(plain)
+		return err
+	})
+}
+
+// transformChunks reads r in chunks of size bytes and calls fn for each of
+// them, telling it whether it is the last one. An empty input still gives one
+// (empty) last chunk.
+func transformChunks(r io.Reader, size int, fn func(chunk []byte, counter uint32, last bool) error) error {
+	br := bufio.NewReaderSize(r, size)
+	buf := make([]byte, size)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		_, err = br.Peek(1)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		last := err == io.EOF
+		if err := fn(buf[:n], counter, last); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// sealInternal encrypts the content of a file the program keeps for itself
+// in the target when the target is encrypted, since the DB and its
+// snapshots list every source and target path.
+func (s *syncer) sealInternal(data []byte) []byte {
+	if s.targetKey == nil {
+		return data
+	}
+	nonce := make([]byte, s.targetKey.blobs.NonceSize())
+	rand.Read(nonce)
+	return s.targetKey.blobs.Seal(append([]byte(encBlobMagic), nonce...), nonce, data, nil)
+}
+
+// openInternal reverses sealInternal. Files written in the clear, by
+// versions that didn't encrypt them, are returned as they are, so the next
+// write encrypts them.
+func (s *syncer) openInternal(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(encBlobMagic)) {
+		return data, nil
+	}
+	if s.targetKey == nil {
+		return nil, errEncrypted
+	}
+	data = data[len(encBlobMagic):]
+	nonceSize := s.targetKey.blobs.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errDecrypt
+	}
+	plain, err := s.targetKey.blobs.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return plain, nil
+}
+
+func (c *targetCipher) encryptName(name string) string {
+	mac := hmac.New(sha256.New, c.nameNonceKey)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:c.names.NonceSize()]
+	return base64.RawURLEncoding.EncodeToString(c.names.Seal(nonce, nonce, []byte(name), nil))
+}
+
+func (c *targetCipher) decryptName(name string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil || len(data) < c.names.NonceSize() {
+		return "", fmt.Errorf("%s is not an encrypted name", name)
+	}
+	nonceSize := c.names.NonceSize()
+	plain, err := c.names.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return "", errDecrypt
+	}
+	return string(plain), nil
+}
+
+// encryptedRelPath returns the path an encrypted target is stored under.
+func (c *targetCipher) encryptedRelPath(rel string) string {
+	if c.obfuscateNames {
+		parts := strings.Split(rel, string(filepath.Separator))
+		for i, part := range parts {
+			parts[i] = c.encryptName(part)
+		}
+		rel = filepath.Join(parts...)
+	}
+	return rel + encryptedExt
+}
+
+// decryptedRelPath reverses encryptedRelPath.
+func (c *targetCipher) decryptedRelPath(rel string) (string, error) {
+	if !strings.HasSuffix(rel, encryptedExt) {
+		return "", fmt.Errorf("%s is not an encrypted file", rel)
+	}
+	rel = strings.TrimSuffix(rel, encryptedExt)
+	if !c.obfuscateNames {
+		return rel, nil
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i, part := range parts {
+		name, err := c.decryptName(part)
+		if err != nil {
+			return "", err
+		}
+		if name == "" || name == "." || name == ".." || strings.ContainsRune(name, filepath.Separator) {
+			return "", fmt.Errorf("invalid decrypted name %q", name)
+		}
+		parts[i] = name
+	}
+	return filepath.Join(parts...), nil
+}
+
+// applyEncryption moves every job's target to its encrypted path. It runs
+// after all other layout rules, so collisions and buckets are resolved on
+// the readable names.
+func (s *syncer) applyEncryption(jobs []syncJob) {
+	if s.targetKey == nil {
+		return
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		job.relTargetPath = s.targetKey.encryptedRelPath(job.relTargetPath)
+		job.targetFile = filepath.Join(s.options.targetDir, job.relTargetPath)
+	}
+}
+
+// withEncryption runs process with the job writing to a local staging file
+// instead of its target, then encrypts the result into the target. That way
+// no plaintext ever reaches the (untrusted) target.
+func (s *syncer) withEncryption(job *syncJob, process func() error) error {
+	if s.targetKey == nil {
+		return process()
+	}
+	if err := s.checkTargetPath(job.targetFile); err != nil {
+		return err
+	}
+	plain, err := s.targetKey.decryptedRelPath(job.relTargetPath)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(s.stagingRoot, "job-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	final := job.targetFile
+	staged := filepath.Join(dir, filepath.Base(plain))
+	job.targetFile = staged
+	err = process()
+	job.targetFile = final
+	if err != nil || job.skipReason != "" {
+		return err
+	}
+	return s.encryptFile(staged, final)
+}
+
+// runDecrypt decrypts every encrypted file of the target into output.
+func (s *syncer) runDecrypt(output string) {
+	if output == "" {
+		fmt.Println("Output directory must be specified with --output.")
+		exit(1)
+	}
+	output, _ = filepath.Abs(output)
+	if isWithin(output, s.options.targetDir) {
+		fmt.Println("The output directory must not be inside the target.")
+		exit(1)
+	}
+
+	failed := 0
+	err := filepath.Walk(s.options.targetDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if s.isInternalPath(path, s.options.targetDir) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(s.options.targetDir, path)
+		plain, err := s.targetKey.decryptedRelPath(rel)
+		if err == nil {
+			err = s.decryptFile(path, filepath.Join(output, plain))
+		}
+		if err != nil {
+			fmt.Printf("Error decrypting %s: %v\n", rel, err)
+			failed++
+			return nil
+		}
+		fmt.Printf("Decrypted: %s\n", plain)
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Error walking target:", err)
+		exit(1)
+	}
+	if failed > 0 {
+		fmt.Printf("%d files could not be decrypted.\n", failed)
+		exit(1)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// cueSheetRelPath returns where the cue sheet of a target is written: next
+// to it, with the extension replaced.
+func cueSheetRelPath(relTargetPath string) string {
+	return strings.TrimSuffix(relTargetPath, filepath.Ext(relTargetPath)) + ".cue"
+}
+
+// planCueSheets decides which audio files need their cue sheet written with
+// --cue-sheets: those that are converted again, and those that were never
+// checked for chapters or whose cue sheet is missing. Files found to have
+// no chapters are remembered and not probed again until they change.
+func (s *syncer) planCueSheets(jobs []syncJob) {
+	if !s.options.cueSheets {
+		return
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		if job.skipReason != "" || job.isImage || job.archive || job.playlist || job.sidecar {
+			continue
+		}
+		job.cueSheet = cueSheetRelPath(job.relTargetPath)
+		e := job.existingEntry
+		job.needsCue = job.needsProcessing || e == nil ||
+			!e.NoChapters && (e.Cue != job.cueSheet || !fileExists(filepath.Join(s.options.targetDir, job.cueSheet)))
+	}
+}
+
+// cueProbe is what ffprobe tells about the chapters of a file.
+type cueProbe struct {
+	Chapters []struct {
+		StartTime string            `json:"start_time"`
+		Tags      map[string]string `json:"tags"`
+	} `json:"chapters"`
+	Format struct {
+		Tags map[string]string `json:"tags"`
+	} `json:"format"`
+}
+
+// cueFileLine matches the FILE lines of a cue sheet.
+var cueFileLine = regexp.MustCompile(`(?m)^[ \t]*FILE[ \t].*$`)
+
+// sourceCueSheet returns a cue sheet for the target of job, or "" if the
+// source has no chapters. A cue sheet embedded as a tag is used as it is,
+// pointed at the target. Otherwise one is made from the chapters, which
+// includes the CUESHEET block of FLAC files.
+func (s *syncer) sourceCueSheet(job syncJob) (string, error) {
+	args := slices.Concat([]string{"-v", "error", "-show_chapters",
+		"-show_entries", "format_tags=cuesheet,title,artist", "-of", "json"}, inputFormatArgs(job.sourcePath), []string{job.sourcePath})
+	output, err := exec.CommandContext(s.runCtx, ffprobeBinary, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("ffprobe: %w", err)
+	}
+	var probe cueProbe
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return "", fmt.Errorf("ffprobe: %w", err)
+	}
+	tag := func(tags map[string]string, name string) string {
+		for key, value := range tags {
+			if strings.EqualFold(key, name) {
+				return value
+			}
+		}
+		return ""
+	}
+	file := fmt.Sprintf("FILE %s %s", cueQuote(filepath.Base(job.relTargetPath)), cueFileType(job.relTargetPath))
+	if sheet := tag(probe.Format.Tags, "cuesheet"); sheet != "" {
+		return cueFileLine.ReplaceAllLiteralString(sheet, file), nil
+	}
+	if len(probe.Chapters) == 0 {
+		return "", nil
+	}
+
+	var b strings.Builder
+	if performer := tag(probe.Format.Tags, "artist"); performer != "" {
+		fmt.Fprintf(&b, "PERFORMER %s\n", cueQuote(performer))
+	}
+	if title := tag(probe.Format.Tags, "title"); title != "" {
+		fmt.Fprintf(&b, "TITLE %s\n", cueQuote(title))
+	}
+	b.WriteString(file + "\n")
+	for i, chapter := range probe.Chapters {
+		seconds, _ := strconv.ParseFloat(chapter.StartTime, 64)
+		// Cue sheets count in frames, 75 to the second.
+		frames := int(seconds*75 + 0.5)
+		fmt.Fprintf(&b, "  TRACK %02d AUDIO\n", i+1)
+		if title := tag(chapter.Tags, "title"); title != "" {
+			fmt.Fprintf(&b, "    TITLE %s\n", cueQuote(title))
+		}
+		fmt.Fprintf(&b, "    INDEX 01 %02d:%02d:%02d\n", frames/75/60, frames/75%60, frames%75)
+	}
+	return b.String(), nil
+}
+
+// cueQuote quotes a value for a cue sheet, which has no escapes.
+func cueQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, "'") + `"`
+}
+
+// cueFileType returns the file type of a FILE line. Players ignore it for
+// anything but MP3, WAVE stands for any other audio.
+func cueFileType(relTargetPath string) string {
+	if strings.EqualFold(filepath.Ext(relTargetPath), ".mp3") {
+		return "MP3"
+	}
+	return "WAVE"
+}
+
+// writeCueSheet writes the cue sheet of a job, if it needs one. Like a
+// thumbnail, a failed cue sheet doesn't fail the job, it is just tried again
+// on the next run.
+func (s *syncer) writeCueSheet(job *syncJob) {
+	if !job.needsCue {
+		return
+	}
+	sheet, err := s.sourceCueSheet(*job)
+	if err != nil {
+		fmt.Printf("Error reading the chapters of %s: %v\n", job.relPath, err)
+		return
+	}
+	if sheet == "" {
+		job.noChapters = true
+		return
+	}
+	path := filepath.Join(s.options.targetDir, job.cueSheet)
+	if err := s.checkTargetPath(path); err != nil {
+		fmt.Printf("Error writing cue sheet of %s: %v\n", job.relPath, err)
+		return
+	}
+	err = s.perms.writeAtomically(path, func(w io.Writer) error {
+		_, err := io.WriteString(w, sheet)
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Error writing cue sheet of %s: %v\n", job.relPath, err)
+		return
+	}
+	job.cueOK = true
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// Values of --db-backend. The SQLite backend keeps one row per entry, keyed
+// by source path and indexed by its lookupKey. A run looks up the files it
+// scans there (see openDBFile) and only reads the whole DB once it needs
+// it, for the files that are gone. Saving only writes the rows that
+// changed, in a single transaction, so large libraries don't rewrite the
+// whole file on every run and an interrupted save leaves the previous state
+// intact.
+const (
+	dbBackendJSON    = "json"
+	dbBackendSQLite  = "sqlite"
+	sqliteDBFileName = ".syncdb.sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS entries (
+	source_path TEXT PRIMARY KEY,
+	target_path TEXT NOT NULL,
+	data        TEXT NOT NULL,
+	source_key  TEXT
+);
+`
+
+// sqliteIndex is created once the entries table has the source_key column,
+// which DBs written by older versions get added when they are next saved.
+const sqliteIndex = `CREATE INDEX IF NOT EXISTS entries_source_key ON entries(source_key);`
+
+// syncDBPath returns where the DB of the target is stored with the
+// configured backend, and --db-name.
+func (s *syncer) syncDBPath() string {
+	name := dbFileName
+	if s.options.dbBackend == dbBackendSQLite {
+		name = sqliteDBFileName
+	}
+	if s.options.dbName != "" {
+		name = namedDBPrefix + s.options.dbName + filepath.Ext(name)
+	}
+	return filepath.Join(s.options.targetDir, name)
+}
+
+func isSQLiteDB(path string) bool {
+	return strings.HasSuffix(path, filepath.Ext(sqliteDBFileName))
+}
+
+// otherBackendPath returns where the other backend keeps the DB at path.
+func otherBackendPath(path string) string {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	if isSQLiteDB(path) {
+		return base + filepath.Ext(dbFileName)
+	}
+	return base + filepath.Ext(sqliteDBFileName)
+}
+
+func openSQLiteDB(path string) (*sql.DB, error) {
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetMaxOpenConns(1)
+	if _, err := conn.Exec("PRAGMA busy_timeout = 5000;" + sqliteSchema); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ok, err := hasSourceKeys(conn); err == nil && !ok {
+		_, err = conn.Exec("ALTER TABLE entries ADD COLUMN source_key TEXT")
+	}
+	if err == nil {
+		_, err = conn.Exec(sqliteIndex)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// hasSourceKeys reports whether the entries table has the source_key column.
+func hasSourceKeys(conn *sql.DB) (bool, error) {
+	var n int
+	err := conn.QueryRow("SELECT COUNT(*) FROM pragma_table_info('entries') WHERE name = 'source_key'").Scan(&n)
+	return n > 0, err
+}
+
+// sqliteStore looks up the entries of a SQLite DB that weren't read yet.
+type sqliteStore struct {
+	conn     *sql.DB
+	bySource *sql.Stmt
+	// err is the first lookup that failed, which load reports.
+	err error
+}
+
+// openSQLite opens the SQLite DB at path for lookups, see openDBFile. A DB
+// written by an older version, which has no index to look entries up by,
+// is read right away instead.
+func (db *syncDB) openSQLite(path string) error {
+	// Opening would create an empty DB, which isn't what a read should do.
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	conn.SetMaxOpenConns(1)
+	db.Entries, db.bySource, db.byTarget = nil, nil, nil
+	db.store = &sqliteStore{conn: conn}
+	_, err = conn.Exec("PRAGMA busy_timeout = 5000")
+	var indexed bool
+	if err == nil {
+		indexed, err = hasSourceKeys(conn)
+	}
+	if err == nil && indexed {
+		db.store.bySource, err = conn.Prepare("SELECT data FROM entries WHERE source_key = ? ORDER BY source_path")
+	}
+	if err == nil && !indexed {
+		err = db.load()
+	}
+	if err != nil {
+		db.close()
+	}
+	return err
+}
+
+// find returns the entry for a source path, or nil. The rows with the same
+// lookupKey are the candidates key picks from.
+func (st *sqliteStore) find(key func(string) string, relPath string) *SyncDBEntry {
+	if st.err != nil {
+		return nil
+	}
+	rows, err := st.bySource.Query(lookupKey(relPath))
+	if err != nil {
+		st.err = err
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data string
+		var e SyncDBEntry
+		if err := rows.Scan(&data); err != nil {
+			st.err = err
+			return nil
+		}
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			st.err = err
+			return nil
+		}
+		if key(e.SourcePath) == key(relPath) {
+			return &e
+		}
+	}
+	if err := rows.Err(); err != nil {
+		st.err = err
+	}
+	return nil
+}
+
+// load reads the entries still in the file of a SQLite DB, and closes it.
+// It fails if a lookup failed before, as those files looked new. Other DBs
+// are loaded already.
+func (db *syncDB) load() error {
+	st := db.store
+	if st == nil {
+		return nil
+	}
+	defer db.close()
+	if st.err != nil {
+		return st.err
+	}
+	rows, err := st.conn.Query("SELECT data FROM entries ORDER BY source_path")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	db.Entries = nil
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		var e SyncDBEntry
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return err
+		}
+		db.Entries = append(db.Entries, e)
+	}
+	return rows.Err()
+}
+
+// close closes the file of a SQLite DB whose entries weren't loaded, for
+// callers done with it early.
+func (db *syncDB) close() {
+	if db.store == nil {
+		return
+	}
+	if db.store.bySource != nil {
+		db.store.bySource.Close()
+	}
+	db.store.conn.Close()
+	db.store = nil
+}
+
+func (db *syncDB) writeSQLite(path string) error {
+	conn, err := openSQLiteDB(path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Rows without a source_key come from older versions and are written
+	// again to get one.
+	type storedRow struct {
+		data  string
+		keyed bool
+	}
+	stored := make(map[string]storedRow)
+	rows, err := tx.Query("SELECT source_path, data, source_key IS NOT NULL FROM entries")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var source string
+		var row storedRow
+		if err := rows.Scan(&source, &row.data, &row.keyed); err != nil {
+			rows.Close()
+			return err
+		}
+		stored[source] = row
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	upsert, err := tx.Prepare("INSERT OR REPLACE INTO entries (source_path, target_path, data, source_key) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer upsert.Close()
+	for _, e := range db.Entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		old, ok := stored[e.SourcePath]
+		delete(stored, e.SourcePath)
+		if ok && old.keyed && old.data == string(data) {
+			continue
+		}
+		if _, err := upsert.Exec(e.SourcePath, e.TargetPath, string(data), lookupKey(e.SourcePath)); err != nil {
+			return err
+		}
+	}
+	for source := range stored {
+		if _, err := tx.Exec("DELETE FROM entries WHERE source_path = ?", source); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+)
+
+func TestSQLiteLookups(t *testing.T) {
+	s := newTestSyncer(t, "A/01.flac", "A/02.flac")
+	s.options.dbBackend = dbBackendSQLite
+	if _, err := s.sync(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var db syncDB
+	if err := s.openDB(&db, s.syncDBPath()); err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	if db.store == nil || len(db.Entries) != 0 {
+		t.Fatalf("opening read %d entries, want them looked up", len(db.Entries))
+	}
+	if e := db.find(s.pathKey, "A/01.flac"); e == nil || e.TargetPath != "A/01.opus" {
+		t.Errorf("A/01.flac has entry %+v", e)
+	}
+	if e := db.find(s.pathKey, "a/01.FLAC"); e != nil {
+		t.Errorf("a/01.FLAC has entry %+v with exact path matching", e)
+	}
+	s.options.pathMatch = pathMatchCaseInsensitive
+	if e := db.find(s.pathKey, "a/01.FLAC"); e == nil || e.SourcePath != "A/01.flac" {
+		t.Errorf("a/01.FLAC has entry %+v, want the one of A/01.flac", e)
+	}
+	if e := db.find(s.pathKey, "A/03.flac"); e != nil {
+		t.Errorf("A/03.flac has entry %+v", e)
+	}
+
+	if err := db.load(); err != nil {
+		t.Fatal(err)
+	}
+	if db.store != nil || len(db.Entries) != 2 {
+		t.Errorf("loading read %d entries, want 2", len(db.Entries))
+	}
+}
+
+func TestSQLiteOldSchema(t *testing.T) {
+	s := newTestSyncer(t)
+	s.options.dbBackend = dbBackendSQLite
+	path := s.syncDBPath()
+	// The table as older versions created it, without source_key.
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(SyncDBEntry{SourcePath: "A/01.flac", TargetPath: "A/01.opus"})
+	_, err = conn.Exec(`CREATE TABLE entries (source_path TEXT PRIMARY KEY, target_path TEXT NOT NULL, data TEXT NOT NULL);
+		INSERT INTO entries VALUES ('A/01.flac', 'A/01.opus', ?)`, string(data))
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var db syncDB
+	if err := s.openDB(&db, path); err != nil {
+		t.Fatal(err)
+	}
+	if db.store != nil || len(db.Entries) != 1 {
+		t.Fatalf("got %d entries, want the one entry read right away", len(db.Entries))
+	}
+	if err := s.writeDB(&db, path); err != nil {
+		t.Fatal(err)
+	}
+
+	db = syncDB{}
+	if err := s.openDB(&db, path); err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	if db.store == nil {
+		t.Fatal("the saved DB has no index to look entries up by")
+	}
+	if e := db.find(s.pathKey, "A/01.flac"); e == nil || e.TargetPath != "A/01.opus" {
+		t.Errorf("A/01.flac has entry %+v", e)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Values of --dedupe-art.
+const (
+	dedupeHardlink = "hardlink"
+	dedupeCopy     = "copy"
+)
+
+// planArtDedupe finds images that have the same content and command as
+// another image of this run, e.g. the cover of a compilation series repeated
+// in every album. Only the first of them is converted; the others get its
+// target hardlinked or copied after all other jobs ran (see runDedupes).
+func (s *syncer) planArtDedupe(jobs []syncJob) {
+	if s.options.dedupeArt == "" {
+		return
+	}
+	donors := make(map[string]*syncJob)
+	// Up to date images first, so they are used rather than converted again.
+	for _, pending := range []bool{false, true} {
+		for i := range jobs {
+			job := &jobs[i]
+			if !job.isImage || job.archive || job.skipReason != "" || job.needsProcessing != pending {
+				continue
+			}
+			hash := job.sourceHash
+			if e := job.existingEntry; hash == "" && e != nil && e.SourceHash != "" && !s.sourceChanged(*job) {
+				hash = e.SourceHash
+			}
+			if hash == "" {
+				var err error
+				if hash, err = hashFile(job.sourcePath); err != nil {
+					s.planLog("Error hashing %s: %v\n", job.relPath, err)
+					continue
+				}
+			}
+			job.sourceHash = hash
+			key := hash + "\x00" + job.command
+			if donor := donors[key]; donor != nil && pending {
+				job.dedupeOf = donor
+			} else if donor == nil {
+				donors[key] = job
+			}
+		}
+	}
+}
+
+// runDedupes links or copies the target of the image each job at indexes
+// duplicates, once all other jobs ran. If that image failed, the job fails
+// too and is retried on the next run.
+func (s *syncer) runDedupes(jobs []syncJob, indexes []int, entries []SyncDBEntry, done []bool, progress *progressTracker) error {
+	for _, i := range indexes {
+		if s.interrupted() {
+			return errInterrupted
+		}
+		job := &jobs[i]
+		progress.Begin(*job)
+		job.attempts++
+		err := s.dedupeTarget(job)
+		progress.Advance(*job, err)
+		done[i] = true
+		if err != nil {
+			progress.Logf("Error processing %s: %v\n", job.relPath, err)
+			job.lastError = err.Error()
+			entries[i] = s.failedEntry(job)
+			if s.options.failFast {
+				return err
+			}
+			continue
+		}
+		progress.Logf("%s Deduplicated: %s (same as %s)\n", progress, job.relPath, job.dedupeOf.relPath)
+		entries[i] = job.entry(statusOK)
+	}
+	return nil
+}
+
+// dedupeTarget gives job the target of the image it duplicates, as a
+// hardlink if possible with --dedupe-art hardlink, else as a copy.
+func (s *syncer) dedupeTarget(job *syncJob) error {
+	donor := job.dedupeOf
+	if donor.lastError != "" || !fileExists(donor.targetFile) {
+		return fmt.Errorf("%s, which has the same content, wasn't converted", donor.relPath)
+	}
+	if err := s.checkTargetPath(job.targetFile); err != nil {
+		return err
+	}
+	if err := s.perms.makeDirs(filepath.Dir(job.targetFile)); err != nil {
+		return err
+	}
+	job.variant = donor.variant
+	if s.options.dedupeArt == dedupeHardlink {
+		tmp := siblingTempPath(job.targetFile)
+		if err := os.Link(donor.targetFile, tmp); err == nil {
+			// Not renameInto, the link shares the donor's mode and owner.
+			return os.Rename(tmp, job.targetFile)
+		}
+	}
+	return s.copyFile(donor.targetFile, job.targetFile)
+}
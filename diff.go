@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// runDiff compares the current plan with the state recorded by the last run
+// and prints only what would change, without writing anything.
+func (s *syncer) runDiff() {
+	s.options.quietPlan = true
+
+	var oldDB syncDB
+	s.loadDB(&oldDB, s.syncDBPath())
+
+	jobs, err := s.planJobs(&oldDB)
+	if err != nil {
+		fmt.Println("Error during planning:", err)
+		return
+	}
+
+	lines, planned := s.diffLines(&oldDB, jobs)
+	if len(lines) == 0 {
+		fmt.Println("No changes since the last sync.")
+		return
+	}
+	for _, l := range lines {
+		fmt.Println(l)
+	}
+	fmt.Println()
+	s.buildSummary(&oldDB, planned, jobs).Print()
+}
+
+// diffLines returns the lines runDiff prints for the planned jobs, sorted
+// by path, and the DB the plan would leave behind for the summary. Files
+// left for a later run, like those excluded by --exclude-glob, keep their
+// entries and targets, so they aren't listed as removed.
+func (s *syncer) diffLines(oldDB *syncDB, jobs []syncJob) ([]string, *syncDB) {
+	var planned syncDB
+	var lines []string
+	seen := make(map[string]bool)
+	for _, job := range jobs {
+		if job.deferred && job.existingEntry != nil {
+			seen[s.pathKey(job.relPath)] = true
+			planned.Entries = append(planned.Entries, *job.existingEntry)
+		}
+		if job.filtered {
+			continue
+		}
+		if job.skipReason != "" {
+			lines = append(lines, fmt.Sprintf("! %s (%s)", job.relPath, job.skipReason))
+			seen[s.pathKey(job.relPath)] = true
+			continue
+		}
+		seen[s.pathKey(job.relPath)] = true
+		planned.Entries = append(planned.Entries, SyncDBEntry{SourcePath: job.relPath, TargetPath: job.relTargetPath})
+		switch {
+		case !job.needsProcessing:
+		case job.existingEntry == nil || !job.existingEntry.hasTarget():
+			lines = append(lines, "+ "+job.relPath)
+		default:
+			lines = append(lines, fmt.Sprintf("~ %s (%s)", job.relPath, job.reason))
+		}
+	}
+	for _, e := range oldDB.Entries {
+		// The target of a removed source matching the glob filter is kept.
+		if e.hasTarget() && !seen[s.pathKey(e.SourcePath)] && !s.globFiltered(e.SourcePath) {
+			lines = append(lines, "- "+e.SourcePath)
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return s.pathCollator.Less(lines[i][2:], lines[j][2:]) })
+	return lines, &planned
+}
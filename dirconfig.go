@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// dirConfigNames are the files in a source directory that change how the
+// files in it (and below it) are converted, e.g. a different preset for a
+// folder of audiobooks or lectures.
+var dirConfigNames = []string{".smsync.toml", ".smsync.yaml", ".smsync.yml"}
+
+// dirConfigOptions are the options a directory config can set, the only
+// ones that make sense for a part of the library. Those that run commands
+// are also in untrustedConfigDenied, and need --trust-config.
+var dirConfigOptions = map[string]bool{
+	"preset":                 true,
+	"target-audio-extension": true,
+	"target-image-extension": true,
+	"ffmpeg-audio":           true,
+	"ffmpeg-image":           true,
+}
+
+var dirExtPattern = regexp.MustCompile(`^[A-Za-z0-9]{1,10}$`)
+
+// dirConfig is what the directory configs from the source down to a
+// directory set. Empty fields keep the global options.
+type dirConfig struct {
+	audioCommand string
+	audioExt     string
+	imageCommand string
+	imageExt     string
+}
+
+// dirConfigFor returns the settings of the directory configs that apply to
+// the source file at sourcePath, or nil if there are none.
+func (s *syncer) dirConfigFor(sourcePath string) *dirConfig {
+	s.dirConfigsMu.Lock()
+	defer s.dirConfigsMu.Unlock()
+	return s.lookupDirConfig(filepath.Dir(sourcePath))
+}
+
+// lookupDirConfig is dirConfigFor for a directory. The caller holds
+// dirConfigsMu.
+func (s *syncer) lookupDirConfig(dir string) *dirConfig {
+	if c, ok := s.dirConfigs[dir]; ok {
+		return c
+	}
+	var parent *dirConfig
+	if dir != s.options.sourceDir && isWithin(dir, s.options.sourceDir) {
+		parent = s.lookupDirConfig(filepath.Dir(dir))
+	}
+	c := parent
+	for _, name := range dirConfigNames {
+		path := filepath.Join(dir, name)
+		if !fileExists(path) {
+			continue
+		}
+		own, err := readDirConfig(path, parent)
+		if err != nil {
+			relPath, _ := filepath.Rel(s.options.sourceDir, path)
+			s.planLog("Error in %s, ignoring it: %v\n", relPath, err)
+			continue
+		}
+		c = own
+		break
+	}
+	s.dirConfigs[dir] = c
+	return c
+}
+
+// readDirConfig reads the directory config at path on top of the settings
+// of its parents. Being part of the library, it is never trusted with more
+// than dirConfigOptions, and with those that run commands only given
+// --trust-config.
+func readDirConfig(path string, parent *dirConfig) (*dirConfig, error) {
+	values, err := readConfigValues(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &dirConfig{}
+	if parent != nil {
+		*c = *parent
+	}
+	trusted := flag.Lookup("trust-config").Value.String() == "true"
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// The preset goes first, so the options given next to it win.
+	if i := sort.SearchStrings(names, "preset"); i < len(names) && names[i] == "preset" {
+		names = append([]string{"preset"}, append(names[:i:i], names[i+1:]...)...)
+	}
+	for _, name := range names {
+		if !trusted && untrustedConfigDenied[name] {
+			return nil, fmt.Errorf("option %q can't be set from a config file inside the source directory, use --trust-config to allow it", name)
+		}
+		if !dirConfigOptions[name] {
+			return nil, fmt.Errorf("option %q can't be set for a directory", name)
+		}
+		value, ok := values[name].(string)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("option %q: expected a string", name)
+		}
+		switch name {
+		case "preset":
+			preset, ok := presets[strings.ToLower(value)]
+			if !ok {
+				return nil, fmt.Errorf("unknown preset %q, use one of %s", value, strings.Join(presetNames(), ", "))
+			}
+			c.audioCommand, c.audioExt = preset.command, preset.ext
+		case "ffmpeg-audio":
+			c.audioCommand = value
+		case "ffmpeg-image":
+			c.imageCommand = value
+		case "target-audio-extension", "target-image-extension":
+			if !dirExtPattern.MatchString(value) {
+				return nil, fmt.Errorf("option %q: invalid extension %q", name, value)
+			}
+			if name == "target-audio-extension" {
+				c.audioExt = value
+			} else {
+				c.imageExt = value
+			}
+		}
+	}
+	return c, nil
+}
+
+// isDirConfig reports whether the file at path is a directory config, which
+// is never synced itself.
+func isDirConfig(path string) bool {
+	name := strings.ToLower(filepath.Base(path))
+	for _, n := range dirConfigNames {
+		if name == n {
+			return true
+		}
+	}
+	return false
+}
+
+// resetDirConfigs forgets the directory configs read so far, for watch mode
+// to pick up changes to them.
+func (s *syncer) resetDirConfigs() {
+	s.dirConfigsMu.Lock()
+	defer s.dirConfigsMu.Unlock()
+	clear(s.dirConfigs)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// compileGlob turns a glob pattern for a path relative to the source into a
+// regular expression. * and ? don't match a slash, ** matches any number of
+// directories, [...] matches one of a set of characters ([!...] one not in
+// it), and a pattern without a slash matches the name in every directory.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	pattern = filepath.ToSlash(pattern)
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[' && i+2 < len(pattern) && strings.Contains(pattern[i+2:], "]"):
+			end := i + 2 + strings.Index(pattern[i+2:], "]")
+			class := pattern[i+1 : end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i = end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// globFiltered reports whether a path (relative to the source or the
+// target) is left out by --include-glob and --exclude-glob: it matches none
+// of the include patterns, if there are any, or one of the exclude patterns.
+func (s *syncer) globFiltered(relPath string) bool {
+	rel := filepath.ToSlash(relPath)
+	if len(s.options.includeGlobs) != 0 && !matchesAny(s.options.includeGlobs, rel) {
+		return true
+	}
+	return matchesAny(s.options.excludeGlobs, rel)
+}
+
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Values of scrub --flac.
+const (
+	flacScrubSources = "sources"
+	flacScrubTargets = "targets"
+	flacScrubBoth    = "both"
+)
+
+// flacStreamInfo reads the bits per sample and the MD5 of the decoded audio
+// from the STREAMINFO block a FLAC file starts with.
+func flacStreamInfo(path string) (int, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	// "fLaC", the 4 byte metadata block header and the 34 byte STREAMINFO.
+	header := make([]byte, 42)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:4]) != "fLaC" || header[4]&0x7f != 0 {
+		return 0, nil, fmt.Errorf("not a FLAC file")
+	}
+	info := header[8:]
+	// Bits per sample minus one is stored in 5 bits spanning bytes 12 and 13.
+	bps := int(binary.BigEndian.Uint16(info[12:14])>>4&0x1f) + 1
+	return bps, info[18:34], nil
+}
+
+// verifyFlac checks the audio of a FLAC file against the MD5 stored in it.
+// The flac tool is used if it is installed, otherwise ffmpeg decodes the file
+// into the same sample format the MD5 was computed over.
+func verifyFlac(path string) error {
+	bps, want, err := flacStreamInfo(path)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(want, make([]byte, 16)) {
+		return fmt.Errorf("no MD5 stored in the file")
+	}
+
+	if flacTool, err := exec.LookPath("flac"); err == nil {
+		if output, err := exec.Command(flacTool, "-s", "-t", path).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+
+	codec := map[int]string{8: "pcm_s8", 16: "pcm_s16le", 24: "pcm_s24le", 32: "pcm_s32le"}[(bps+7)/8*8]
+	output, err := exec.Command(ffmpegBinary, "-v", "error", "-i", path, "-map", "0:a", "-c:a", codec, "-f", "md5", "-").Output()
+	if err != nil {
+		return fmt.Errorf("decoding failed: %v", err)
+	}
+	got := strings.TrimPrefix(strings.TrimSpace(string(output)), "MD5=")
+	if got != hex.EncodeToString(want) {
+		return fmt.Errorf("MD5 of the decoded audio doesn't match the one stored in the file")
+	}
+	return nil
+}
+
+// runFlacScrub verifies the embedded MD5 of the FLAC sources and/or targets
+// recorded in the DB. Unlike the file hashes this attributes corruption to
+// the audio data itself, and works without any hashes recorded beforehand.
+func (s *syncer) runFlacScrub(mode string) {
+	if mode != flacScrubSources && mode != flacScrubTargets && mode != flacScrubBoth {
+		fmt.Println("Invalid --flac, use sources, targets or both:", mode)
+		exit(1)
+	}
+	if mode != flacScrubSources && s.targetKey != nil {
+		fmt.Println("Encrypted targets can't be verified.")
+		exit(1)
+	}
+
+	var db syncDB
+	s.loadDB(&db, s.syncDBPath())
+
+	var paths []string
+	for _, e := range db.Entries {
+		if mode != flacScrubTargets && strings.EqualFold(filepath.Ext(e.SourcePath), ".flac") {
+			paths = append(paths, filepath.Join(s.options.sourceDir, e.SourcePath))
+		}
+		if mode != flacScrubSources && e.hasTarget() && strings.EqualFold(filepath.Ext(e.TargetPath), ".flac") {
+			paths = append(paths, filepath.Join(s.options.targetDir, e.TargetPath))
+		}
+	}
+
+	failed := 0
+	for _, path := range paths {
+		if err := verifyFlac(path); err != nil {
+			fmt.Printf("FAILED: %s: %v\n", path, err)
+			failed++
+		}
+	}
+	fmt.Printf("Verified %d FLAC files: %d failed\n", len(paths), failed)
+	if failed > 0 {
+		exit(1)
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+// forced reports whether a job is forced to be converted again by --force
+// or a matching --force-match pattern, whatever the DB says about it.
+func (s *syncer) forced(job syncJob) bool {
+	if s.options.force {
+		return true
+	}
+	return matchesAny(s.options.forceMatches, filepath.ToSlash(job.relPath))
+}
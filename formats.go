@@ -0,0 +1,81 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// audioFormat is a source audio format and what it takes to read it.
+type audioFormat struct {
+	exts []string
+	// demuxer is the ffmpeg input format forced for files of the format.
+	// ffmpeg detects formats by content, which fails for some files of
+	// these: APE and WavPack files with an ID3v2 tag or other junk in front,
+	// AIFF files with chunks it doesn't expect before the sound data.
+	demuxer string
+}
+
+// audioFormats are the source audio formats supported out of the box. Their
+// extensions are the default of --source-audio-extensions; others can be
+// added there and are read as ffmpeg detects them.
+var audioFormats = []audioFormat{
+	{exts: []string{"mp3"}},
+	{exts: []string{"flac"}},
+	{exts: []string{"opus"}},
+	{exts: []string{"m4a"}},                 // AAC or ALAC
+	{exts: []string{"wma"}},                 // see the DRM hint in hints.go
+	{exts: []string{"ape"}, demuxer: "ape"}, // Monkey's Audio
+	{exts: []string{"wv"}, demuxer: "wv"},   // WavPack
+	{exts: []string{"aiff", "aif"}, demuxer: "aiff"},
+}
+
+// defaultAudioExtensions returns the extensions of audioFormats, for the
+// default of --source-audio-extensions.
+func defaultAudioExtensions() string {
+	var exts []string
+	for _, f := range audioFormats {
+		exts = append(exts, f.exts...)
+	}
+	return strings.Join(exts, ",")
+}
+
+// formatOf returns the format of a file by its extension.
+func formatOf(path string) (audioFormat, bool) {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	for _, f := range audioFormats {
+		if slices.Contains(f.exts, ext) {
+			return f, true
+		}
+	}
+	return audioFormat{}, false
+}
+
+// inputFormatArgs returns the ffmpeg and ffprobe options to put in front of
+// the input path to read it, if its format needs any.
+func inputFormatArgs(path string) []string {
+	if f, ok := formatOf(path); ok && f.demuxer != "" {
+		return []string{"-f", f.demuxer}
+	}
+	return nil
+}
+
+// withInputFormat adds inputFormatArgs to the arguments of an ffmpeg command
+// reading inputPath, in front of its -i. Commands that choose the input
+// format themselves are left alone. This happens when the command runs, so
+// the recorded command doesn't change and nothing is converted again.
+func withInputFormat(args []string, inputPath string) []string {
+	extra := inputFormatArgs(inputPath)
+	if len(extra) == 0 || len(args) == 0 || strings.TrimSuffix(filepath.Base(args[0]), ".exe") != ffmpegBinary {
+		return args
+	}
+	for i := 1; i+1 < len(args); i++ {
+		if args[i] == "-f" {
+			return args
+		}
+		if args[i] == "-i" && args[i+1] == inputPath {
+			return slices.Concat(args[:i], extra, args[i:])
+		}
+	}
+	return args
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	flag "github.com/spf13/pflag"
+)
+
+// guiPage is the single page of the GUI.
+//
+//go:embed gui/index.html
+var guiPage []byte
+
+// defaultListen is where the GUI and workers listen unless --listen says
+// otherwise: only this machine, as anyone who can reach them can start
+// syncs or run commands.
+const defaultListen = "127.0.0.1:8765"
+
+// maxGUILog is how many lines of output the GUI keeps of a run.
+const maxGUILog = 500
+
+// guiRequest is what the page asks to run: the sync of a source to a target
+// with a preset.
+type guiRequest struct {
+	Source        string `json:"source"`
+	Target        string `json:"target"`
+	Preset        string `json:"preset"`
+	DeleteRemoved bool   `json:"delete_removed"`
+	DryRun        bool   `json:"dry_run"`
+}
+
+// guiFailure is a file that failed in a run, for the errors pane.
+type guiFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// guiState is the run the GUI started last, as the page polls it.
+type guiState struct {
+	mu sync.Mutex
+	// base is the syncer of the gui command. Every run starts from its
+	// options, those of the command line and --config.
+	base *syncer
+	// commandSet and extSet tell whether those options set the audio
+	// command and extension, which a preset doesn't override.
+	commandSet, extSet bool
+	// stop cancels the running run, done is closed once it ended.
+	stop     context.CancelFunc
+	done     chan struct{}
+	Running  bool          `json:"running"`
+	Command  string        `json:"command,omitempty"`
+	Progress progressEvent `json:"progress"`
+	Log      []string      `json:"log"`
+	Failures []guiFailure  `json:"failures"`
+	Result   string        `json:"result,omitempty"`
+}
+
+// runGUI serves a small web page to run syncs from a browser, for people
+// who'd rather not deal with flags and ffmpeg templates: pick the source and
+// the target, choose a preset, and follow the progress and the failures.
+// Every run is a sync (or plan) with the options of s underneath the
+// choices of the page, run in this process. On a network address it needs
+// a token (see guiProtect) and HTTPS.
+func (s *syncer) runGUI(listen, token string, tls serverTLS) {
+	if token == "" && !isLoopbackListen(listen) {
+		fmt.Println("The GUI needs a --gui-token to listen on a network address, anyone who can reach it could start syncs.")
+		exit(1)
+	}
+	if !isLoopbackListen(listen) && !tls.enabled() {
+		fmt.Println("The GUI on a network address needs HTTPS (--tls-self-signed, or --tls-cert and --tls-key), the token would cross the network in plain text.")
+		exit(1)
+	}
+	state := &guiState{
+		base:       s,
+		commandSet: flag.CommandLine.Changed("ffmpeg-audio"),
+		extSet:     flag.CommandLine.Changed("target-audio-extension"),
+	}
+	state.handleSignals()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(guiPage)
+	})
+	mux.HandleFunc("/api/presets", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, presetNames())
+	})
+	mux.HandleFunc("/api/dirs", handleGUIDirs)
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		writeJSON(w, state)
+	})
+	mux.HandleFunc("/api/run", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req guiRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if err := state.start(req); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/api/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		state.cancel()
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	tls = prepareTLS(tls)
+	scheme := "http"
+	if tls.enabled() {
+		scheme = "https"
+	}
+	server := &http.Server{Addr: listen, Handler: guiProtect(mux, token, tls.enabled())}
+	fmt.Printf("GUI running at %s://%s/\n", scheme, guiAddress(listen))
+	if token != "" {
+		fmt.Printf("Open %s://%s/?token=<your --gui-token> to log in, or enter it as the password when asked.\n", scheme, guiAddress(listen))
+	}
+	if err := tls.listenAndServe(server); err != nil {
+		fmt.Println("Error running GUI:", err)
+		exit(1)
+	}
+}
+
+// guiAddress returns the address to open in a browser for listen: the host
+// name of this machine if it listens on all addresses.
+func guiAddress(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		if host, err = os.Hostname(); err != nil {
+			host = "localhost"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// writeJSON answers a request with v as JSON.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleGUIDirs lists the subdirectories of ?path= (the home directory if
+// empty), for the directory pickers of the page.
+func handleGUIDirs(w http.ResponseWriter, r *http.Request) {
+	dir := r.URL.Query().Get("path")
+	if dir == "" {
+		dir, _ = os.UserHomeDir()
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	dirs := []string{}
+	for _, entry := range entries {
+		if !hiddenName(entry.Name()) && (entry.IsDir() || isDirLink(filepath.Join(dir, entry.Name()))) {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	sort.Strings(dirs)
+	writeJSON(w, map[string]any{"path": dir, "parent": filepath.Dir(dir), "dirs": dirs})
+}
+
+// start runs the sync (or plan, for a dry run) the page asked for, unless
+// one is running already.
+func (s *guiState) start(req guiRequest) error {
+	if req.Source == "" || req.Target == "" {
+		return fmt.Errorf("choose a source and a target")
+	}
+	run := s.base.forRun()
+	run.options.sourceDir, _ = filepath.Abs(req.Source)
+	run.options.targetDir, _ = filepath.Abs(req.Target)
+	run.options.deleteRemovedFiles = req.DeleteRemoved
+	if req.Preset != "" {
+		if err := run.applyPreset(req.Preset, s.commandSet, s.extSet); err != nil {
+			return err
+		}
+		if !s.commandSet {
+			run.options.ffmpegAudioCommand = run.withTagArgs(run.options.ffmpegAudioCommand)
+		}
+	}
+	command := "sync"
+	if req.DryRun {
+		command = "plan"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Running {
+		return fmt.Errorf("a %s is running already", s.Command)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	s.stop, s.done, s.Running, s.Command = stop, make(chan struct{}), true, command
+	s.Progress, s.Log, s.Failures, s.Result = progressEvent{}, nil, nil, ""
+	go s.run(ctx, run, command)
+	return nil
+}
+
+// run runs a sync or plan with run, recording its progress and outcome.
+func (s *guiState) run(ctx context.Context, run *syncer, command string) {
+	var summary *syncSummary
+	var err error
+	if command == "plan" {
+		err = s.plan(run)
+	} else if err = run.lockTarget(); err == nil {
+		summary, err = run.sync(ctx, progressEvents(s.record))
+		run.unlockTarget()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop()
+	close(s.done)
+	s.Running = false
+	switch {
+	case err != nil:
+		s.Result = fmt.Sprintf("%s failed: %v", command, err)
+	case summary != nil && len(summary.failed) > 0:
+		s.Result = fmt.Sprintf("%s complete, but %d files failed", command, len(summary.failed))
+	default:
+		s.Result = command + " complete"
+	}
+	if summary != nil {
+		var out strings.Builder
+		summary.Write(&out)
+		for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+			s.addLog(line)
+		}
+	}
+}
+
+// plan adds what a sync with run would do to the log, like the text
+// format of the plan command.
+func (s *guiState) plan(run *syncer) error {
+	run.options.quietPlan = true
+	var oldDB syncDB
+	if err := run.openDB(&oldDB, run.syncDBPath()); err != nil {
+		return err
+	}
+	defer oldDB.close()
+	jobs, err := run.planJobs(&oldDB)
+	if err != nil {
+		return err
+	}
+	p := run.buildPlanFile(jobs, &oldDB)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range p.Actions {
+		s.addLog(a.text())
+	}
+	return nil
+}
+
+// record records a progress event of the running sync: the log lines, the
+// files that failed and how far it got.
+func (s *guiState) record(e progressEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case e.Event == "log" && e.Message != "":
+		s.addLog(e.Message)
+	case e.Event == "done" && e.Error != "":
+		s.Failures = append(s.Failures, guiFailure{Path: e.Path, Error: e.Error})
+	}
+	s.Progress = e
+}
+
+// addLog adds a line to the log, dropping the oldest beyond maxGUILog. The
+// caller holds mu.
+func (s *guiState) addLog(line string) {
+	s.Log = append(s.Log, line)
+	if len(s.Log) > maxGUILog {
+		s.Log = s.Log[len(s.Log)-maxGUILog:]
+	}
+}
+
+// cancel stops the running run like an interrupt would, so what completed
+// is saved.
+func (s *guiState) cancel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Running {
+		s.stop()
+	}
+}
+
+// handleSignals makes SIGINT and SIGTERM stop the GUI like they stop a sync:
+// a running sync is cancelled and what it completed saved before exiting.
+// A second signal exits immediately.
+func (s *guiState) handleSignals() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		again := make(chan os.Signal, 1)
+		signal.Notify(again, os.Interrupt, syscall.SIGTERM)
+		stop()
+		go func() {
+			<-again
+			exit(130)
+		}()
+		s.mu.Lock()
+		running, done := s.Running, s.done
+		s.mu.Unlock()
+		if running {
+			fmt.Println("\nInterrupted, saving the results so far. Interrupt again to exit immediately.")
+			s.cancel()
+			<-done
+		}
+		exit(130)
+	}()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// guiTokenCookie keeps the --gui-token of a browser that logged in with a
+// ?token= link, so it isn't asked again.
+const guiTokenCookie = "smsync_token"
+
+// serverTLS is how the GUI or a worker serves HTTPS: with the certificate
+// and key in certFile and keyFile (e.g. from certbot or another ACME
+// client), or with a self-signed certificate made on first use.
+type serverTLS struct {
+	certFile   string
+	keyFile    string
+	selfSigned bool
+}
+
+func (t serverTLS) enabled() bool {
+	return t.certFile != "" || t.selfSigned
+}
+
+// prepareTLS checks the TLS options and makes the self-signed certificate
+// if asked for one, printing its fingerprint. It returns the files to serve.
+func prepareTLS(t serverTLS) serverTLS {
+	if t.selfSigned && t.certFile != "" {
+		fmt.Println("--tls-self-signed can't be combined with --tls-cert.")
+		exit(1)
+	}
+	if (t.certFile == "") != (t.keyFile == "") {
+		fmt.Println("--tls-cert and --tls-key must be given together.")
+		exit(1)
+	}
+	if !t.selfSigned {
+		return t
+	}
+	var err error
+	if t.certFile, t.keyFile, err = selfSignedCertificate(); err != nil {
+		fmt.Println("Error creating a self-signed certificate:", err)
+		exit(1)
+	}
+	fingerprint, err := certificateFingerprint(t.certFile)
+	if err != nil {
+		fmt.Println("Error:", err)
+		exit(1)
+	}
+	fmt.Printf("Self-signed certificate %s\nSHA-256 fingerprint %s\n", t.certFile, fingerprint)
+	return t
+}
+
+// listenAndServe runs server, with HTTPS if enabled.
+func (t serverTLS) listenAndServe(server *http.Server) error {
+	if t.enabled() {
+		return server.ListenAndServeTLS(t.certFile, t.keyFile)
+	}
+	return server.ListenAndServe()
+}
+
+// isLoopbackListen reports whether the GUI listening on listen can only be
+// reached from this machine.
+func isLoopbackListen(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil || host == "" {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// guiProtect wraps the handler of the GUI: with a token, requests must carry
+// it as a bearer token, the password of basic auth (any user name), or the
+// cookie set by opening the page with ?token=. Without one (only on
+// loopback), requests must be addressed to localhost by name or address, so
+// a site whose name was rebound to 127.0.0.1 can't use the GUI from the
+// browser. In both cases POSTs must come from the page itself, so a web page
+// open in the same browser can't start syncs.
+func guiProtect(next http.Handler, token string, secure bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" && !isLoopbackHost(r.Host) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if token != "" && !guiAuthorized(r, token) {
+			if r.URL.Path == "/" && validToken(r.URL.Query().Get("token"), token) {
+				http.SetCookie(w, &http.Cookie{
+					Name:     guiTokenCookie,
+					Value:    token,
+					Path:     "/",
+					HttpOnly: true,
+					Secure:   secure,
+					SameSite: http.SameSiteStrictMode,
+				})
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="SimpleMusicSync", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodPost && !sameOrigin(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackHost reports whether the Host header of a request names this
+// machine: localhost, 127.0.0.1 or [::1], with any port.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.EqualFold(host, "localhost") || host == "127.0.0.1" || host == "::1"
+}
+
+// guiAuthorized reports whether a request carries the token.
+func guiAuthorized(r *http.Request, token string) bool {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return validToken(bearer, token)
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return validToken(password, token)
+	}
+	if c, err := r.Cookie(guiTokenCookie); err == nil {
+		return validToken(c.Value, token)
+	}
+	return false
+}
+
+func validToken(given, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// sameOrigin reports whether a request comes from a page of the GUI, by its
+// Origin header. Requests without one (not from a browser) pass.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// selfSignedCertificate returns the paths of the self-signed certificate
+// and key of the GUI, made on first use and kept in the user's config
+// directory so browsers only have to accept it once. It is valid for
+// localhost, the host name and the addresses of this machine.
+func selfSignedCertificate() (string, string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", "", err
+	}
+	dir = filepath.Join(dir, "SimpleMusicSync")
+	certFile, keyFile := filepath.Join(dir, "gui-cert.pem"), filepath.Join(dir, "gui-key.pem")
+	if fileExists(certFile) && fileExists(keyFile) {
+		return certFile, keyFile, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "SimpleMusicSync GUI"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 0, 825),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+	}
+	if host, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, host)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// certificateFingerprint returns the SHA-256 fingerprint of the certificate
+// in certFile, to compare with what a browser shows before accepting it.
+func certificateFingerprint(certFile string) (string, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", fmt.Errorf("%s: no PEM certificate", certFile)
+	}
+	sum := sha256.Sum256(block.Bytes)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":"), nil
+}
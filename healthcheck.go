@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxHealthcheckBody keeps the pinged report within what healthcheck
+// services accept.
+const maxHealthcheckBody = 10000
+
+var healthcheckClient = &http.Client{Timeout: 10 * time.Second}
+
+// pingHealthcheckStart tells the healthcheck service that a run started, so
+// it can measure how long runs take and notice runs that hang.
+func (s *syncer) pingHealthcheckStart() {
+	if s.options.healthcheckURL != "" {
+		s.healthcheckPing("/start", "")
+	}
+}
+
+// pingHealthcheck reports the end of a run with the report as body.
+func (s *syncer) pingHealthcheck(failed bool, body string) {
+	if s.options.healthcheckURL == "" {
+		return
+	}
+	suffix := ""
+	if failed {
+		suffix = "/fail"
+	}
+	s.healthcheckPing(suffix, body)
+}
+
+func (s *syncer) healthcheckPing(suffix, body string) {
+	if len(body) > maxHealthcheckBody {
+		body = body[:maxHealthcheckBody]
+	}
+	url := strings.TrimSuffix(s.options.healthcheckURL, "/") + suffix
+	resp, err := healthcheckClient.Post(url, "text/plain; charset=utf-8", strings.NewReader(body))
+	if err != nil {
+		fmt.Println("Error pinging healthcheck:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		fmt.Println("Error pinging healthcheck:", resp.Status)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// junkNames are the (lowercase) names of files and directories that
+// operating systems and NAS boxes leave in shared folders, skipped like
+// hidden ones with --skip-hidden.
+var junkNames = map[string]bool{
+	"@eadir":                    true, // Synology thumbnails
+	"#recycle":                  true,
+	"#snapshot":                 true,
+	"$recycle.bin":              true,
+	"system volume information": true,
+	"lost+found":                true,
+	"thumbs.db":                 true,
+	"ehthumbs.db":               true,
+	"desktop.ini":               true,
+	"icon\r":                    true, // custom folder icons on macOS
+}
+
+// hiddenName reports whether a file or directory name is hidden (starts
+// with a dot, like .DS_Store, ._track.flac or .stfolder) or junk.
+func hiddenName(name string) bool {
+	return strings.HasPrefix(name, ".") || junkNames[strings.ToLower(name)]
+}
+
+// hiddenSkipped reports whether --skip-hidden leaves the path (relative to
+// the source or the target) alone: it or one of its directories is hidden.
+func (s *syncer) hiddenSkipped(relPath string) bool {
+	if !s.options.skipHidden {
+		return false
+	}
+	for _, part := range strings.Split(filepath.ToSlash(relPath), "/") {
+		if hiddenName(part) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// failureHint maps a known error pattern in command output to a human
+// readable explanation. The hint may reference submatches of the pattern
+// using $1, $2 and so on.
+type failureHint struct {
+	kind    string
+	pattern *regexp.Regexp
+	hint    string
+}
+
+var failureHints = []failureHint{
+	{"missing-command", regexp.MustCompile(`exec: "([^"]+)": executable file not found`), "$1 is not installed or not in your PATH"},
+	{"unknown-encoder", regexp.MustCompile(`Unknown encoder '([^']+)'`), "your ffmpeg lacks the $1 encoder, install a full ffmpeg build (e.g. ffmpeg-full)"},
+	{"unknown-encoder", regexp.MustCompile(`Encoder ([^ ]+) not found`), "your ffmpeg lacks the $1 encoder, install a full ffmpeg build (e.g. ffmpeg-full)"},
+	{"invalid-data", regexp.MustCompile(`Invalid data found when processing input`), "the source file is corrupt or not a format ffmpeg understands"},
+	{"unknown-option", regexp.MustCompile(`Unrecognized option '([^']+)'`), "your ffmpeg does not support the -$1 option used in the command template"},
+	{"drm", regexp.MustCompile(`DRM protected stream detected`), "the source is DRM protected (e.g. WMA bought from an old store), ffmpeg can't decode it"},
+	{"unsupported-version", regexp.MustCompile(`Unsupported file version - ([0-9.]+)`), "ffmpeg can't read files of Monkey's Audio $1, re-encode the source with a current Monkey's Audio"},
+	{"permission-denied", regexp.MustCompile(`(?i)permission denied`), "check that the source is readable and the target directory is writable"},
+	{"disk-full", regexp.MustCompile(`(?i)no space left on device`), "the target device is full"},
+	{"read-only", regexp.MustCompile(`(?i)read-only file system`), "the target is mounted read-only"},
+}
+
+// classifyFailure looks for known error patterns in the error and command
+// output. It returns the failure kind, a hint, and the line that matched, or
+// empty strings if nothing matched.
+func classifyFailure(err error, output string) (kind, hint, line string) {
+	var lines []string
+	if err != nil {
+		lines = append(lines, err.Error())
+	}
+	lines = append(lines, strings.Split(output, "\n")...)
+
+	for _, h := range failureHints {
+		for _, l := range lines {
+			m := h.pattern.FindStringSubmatchIndex(l)
+			if m == nil {
+				continue
+			}
+			expanded := h.pattern.ExpandString(nil, h.hint, l, m)
+			return h.kind, string(expanded), strings.TrimSpace(l)
+		}
+	}
+	return "", "", ""
+}
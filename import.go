@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Sources of import.
+const (
+	importFromTarget = "target"
+	importFromDB     = "db"
+)
+
+// foreignNames are bookkeeping files of other sync tools that may be found in
+// an imported target. Like our own internal files they are never deleted.
+var foreignNames = map[string]bool{
+	".stfolder":   true,
+	".stignore":   true,
+	".stversions": true,
+}
+
+// runImport seeds the DB from an existing target, so switching to this tool
+// or moving the library doesn't mean re-encoding everything.
+//
+// With "target", the files already in the target (e.g. an rsync mirror or a
+// syncthing folder) are adopted: every planned job whose target file exists
+// is recorded as up to date with the current source and command. Where it
+// doesn't, a file with the same path apart from case and extension, as
+// another tool may have converted the library to, is adopted instead (see
+// findTargetByStem). With "db",
+// the entries of another DB are imported, with their paths rewritten by the
+// OLD=NEW prefix mappings in sourceMaps and targetMaps.
+func (s *syncer) runImport(from, importDB string, sourceMaps, targetMaps []string) {
+	dbPath := s.syncDBPath()
+	var oldDB syncDB
+	s.loadDB(&oldDB, dbPath)
+
+	var imported []SyncDBEntry
+	switch from {
+	case importFromTarget:
+		s.options.quietPlan = true
+		jobs, err := s.planJobs(&oldDB)
+		if err != nil {
+			fmt.Println("Error during planning:", err)
+			exit(1)
+		}
+		for _, job := range jobs {
+			if job.skipReason != "" || !job.needsProcessing || job.archive || job.playlist {
+				continue
+			}
+			adopted := false
+			if !fileExists(job.targetFile) {
+				rel, ok := s.findTargetByStem(job)
+				if !ok {
+					continue
+				}
+				job.relTargetPath, adopted = rel, true
+			}
+			e := job.entry(statusOK)
+			e.Adopted = adopted
+			imported = append(imported, e)
+		}
+	case importFromDB:
+		if importDB == "" {
+			fmt.Println("The DB to import must be specified with --import-db.")
+			exit(1)
+		}
+		var other syncDB
+		if err := s.readDB(&other, importDB); err != nil {
+			fmt.Println("Error loading DB to import:", err)
+			exit(1)
+		}
+		for _, e := range other.Entries {
+			e.SourcePath = mapPathPrefix(e.SourcePath, sourceMaps)
+			e.TargetPath = mapPathPrefix(e.TargetPath, targetMaps)
+			if filepath.IsAbs(e.SourcePath) || (e.TargetPath != "" && filepath.IsAbs(e.TargetPath)) {
+				fmt.Printf("Skipping %s: path is still absolute, use --map-source/--map-target to make it relative\n", e.SourcePath)
+				continue
+			}
+			if e.TargetPath != "" && !isWithin(filepath.Join(s.options.targetDir, e.TargetPath), s.options.targetDir) {
+				fmt.Printf("Skipping %s: target outside of the target directory\n", e.SourcePath)
+				continue
+			}
+			imported = append(imported, e)
+		}
+	default:
+		fmt.Println("Invalid --import-from, use target or db:", from)
+		exit(1)
+	}
+
+	replaced := make(map[string]bool)
+	for _, e := range imported {
+		replaced[s.pathKey(e.SourcePath)] = true
+		fmt.Printf("Imported: %s\n", e.SourcePath)
+	}
+	var newDB syncDB
+	for _, e := range oldDB.Entries {
+		if !replaced[s.pathKey(e.SourcePath)] {
+			newDB.Entries = append(newDB.Entries, e)
+		}
+	}
+	newDB.Entries = append(newDB.Entries, imported...)
+
+	if err := s.snapshotDB(dbPath, s.options.dbSnapshots); err != nil {
+		fmt.Println("Error creating DB snapshot:", err)
+	}
+	s.saveDB(&newDB, dbPath)
+	fmt.Printf("Imported %d entries.\n", len(imported))
+}
+
+// mapPathPrefix rewrites the first matching OLD=NEW prefix of path. Paths
+// are compared with forward slashes, whole path components only. An empty
+// OLD matches every relative path, so "=Music" moves everything into Music.
+func mapPathPrefix(path string, maps []string) string {
+	slashed := filepath.ToSlash(path)
+	for _, m := range maps {
+		from, to, ok := strings.Cut(m, "=")
+		if !ok {
+			continue
+		}
+		from, to = strings.TrimSuffix(filepath.ToSlash(from), "/"), strings.TrimSuffix(filepath.ToSlash(to), "/")
+		var rest string
+		switch {
+		case from == "" && !filepath.IsAbs(path):
+			rest = slashed
+		case slashed == from:
+		case strings.HasPrefix(slashed, from+"/"):
+			rest = slashed[len(from)+1:]
+		default:
+			continue
+		}
+		if to != "" && rest != "" {
+			rest = to + "/" + rest
+		} else if rest == "" {
+			rest = to
+		}
+		return filepath.FromSlash(rest)
+	}
+	return path
+}
+
+// adoptAudioExtensions and adoptImageExtensions are the formats other tools
+// may have converted a library to, besides the configured source formats.
+var (
+	adoptAudioExtensions = map[string]bool{"mp3": true, "m4a": true, "aac": true, "ogg": true, "oga": true, "opus": true, "flac": true, "wav": true, "wma": true, "aiff": true, "mka": true}
+	adoptImageExtensions = map[string]bool{"jpg": true, "jpeg": true, "png": true, "bmp": true, "gif": true, "webp": true}
+)
+
+// findTargetByStem looks for a file in the target that has the path job
+// would get, ignoring case and the extension, with an extension of the same
+// kind (audio or image). It returns the path relative to the target.
+func (s *syncer) findTargetByStem(job syncJob) (string, bool) {
+	fold := func(name string) string { return strings.ToLower(norm.NFC.String(name)) }
+	dir := s.options.targetDir
+	parts := strings.Split(job.relTargetPath, string(filepath.Separator))
+	for i, part := range parts {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return "", false
+		}
+		last := i == len(parts)-1
+		found := ""
+		for _, entry := range entries {
+			name := entry.Name()
+			if !last {
+				if entry.IsDir() && fold(name) == fold(part) {
+					found = name
+					break
+				}
+				continue
+			}
+			ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")
+			kindMatches := job.isImage && (s.isImageExtension(ext) || adoptImageExtensions[ext]) ||
+				!job.isImage && !job.sidecar && (s.isAudioExtension(ext) || adoptAudioExtensions[ext]) ||
+				job.sidecar && fold(filepath.Ext(name)) == fold(filepath.Ext(part))
+			if !entry.IsDir() && kindMatches && fold(strings.TrimSuffix(name, filepath.Ext(name))) == fold(strings.TrimSuffix(part, filepath.Ext(part))) {
+				found = name
+				break
+			}
+		}
+		if found == "" {
+			return "", false
+		}
+		dir = filepath.Join(dir, found)
+	}
+	rel, err := filepath.Rel(s.options.targetDir, dir)
+	return rel, err == nil
+}
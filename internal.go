@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	dbFileName = ".syncdb.json"
+	// tempPrefix marks temporary files written next to their final location.
+	// Anything starting with it is leftover from an interrupted run if it is
+	// still around later, so it can be garbage collected safely.
+	tempPrefix = ".smstmp-"
+)
+
+// internalNames lists the files and directories the tool creates for its own
+// bookkeeping. Anything with one of these names is never classified,
+// converted, copied or deleted, no matter where it shows up. They are all
+// lower case, like tempPrefix and namedDBPrefix, so they can be matched
+// ignoring case.
+var internalNames = map[string]bool{
+	dbFileName:                    true,
+	sqliteDBFileName:              true,
+	sqliteDBFileName + "-journal": true,
+	sqliteDBFileName + "-wal":     true,
+	sqliteDBFileName + "-shm":     true,
+	snapshotDirName:               true,
+	lockFileName:                  true,
+	trashDirName:                  true,
+	statsFileName:                 true,
+	lastSyncFileName:              true,
+}
+
+// isInternalPath reports whether path must be left alone while walking the
+// tree rooted at walkRoot. Besides the internal names, this also covers the
+// case where the target lives inside the source (or the other way around):
+// the nested tree is skipped entirely so we neither convert our own outputs
+// nor delete the source library.
+func (s *syncer) isInternalPath(path, walkRoot string) bool {
+	name := filepath.Base(path)
+	if !s.targetCaps.caseSensitive {
+		name = strings.ToLower(name)
+	}
+	if internalNames[name] || foreignNames[name] || strings.HasPrefix(name, tempPrefix) || strings.HasPrefix(name, namedDBPrefix) {
+		return true
+	}
+
+	other := s.options.targetDir
+	if walkRoot == s.options.targetDir {
+		other = s.options.sourceDir
+	}
+	// Only a tree nested in the walked one is skipped: walking a target
+	// inside the source, everything is within the source.
+	return other != walkRoot && s.isWithinDir(other, walkRoot) && s.isWithinDir(path, other)
+}
+
+// checkTargetPath makes sure a path we are about to write or delete is inside
+// the target directory. Mapping rules or odd source paths must never lead to
+// writes outside of it. Files staged for encryption are fine as well.
+func (s *syncer) checkTargetPath(path string) error {
+	if s.stagingRoot != "" && path != s.stagingRoot && isWithin(path, s.stagingRoot) {
+		return nil
+	}
+	// The target directory itself doesn't count as inside.
+	if !s.isWithinDir(path, s.options.targetDir) || s.isWithinDir(s.options.targetDir, path) {
+		return fmt.Errorf("refusing to touch %s: outside of the target directory", path)
+	}
+	return nil
+}
+
+// isWithin reports whether path is dir itself or somewhere below it.
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// isWithinDir is isWithin for the source and target directories, ignoring
+// case if the target is case-insensitive: one may be nested in the other
+// under a name spelled differently.
+func (s *syncer) isWithinDir(path, dir string) bool {
+	if !s.targetCaps.caseSensitive {
+		path, dir = strings.ToLower(path), strings.ToLower(dir)
+	}
+	return isWithin(path, dir)
+}
+
+// tempPath returns the path of a temporary file for the given final path,
+// where the commit strategy of the target wants it.
+func (s *syncer) tempPath(final string) string {
+	return s.targetCommit.tempPath(final)
+}
+
+// siblingTempPath returns the path of a temporary file next to the given
+// final path (so it can be renamed into place). It keeps the extension, since
+// ffmpeg picks the output format from it.
+func siblingTempPath(final string) string {
+	return filepath.Join(filepath.Dir(final), fmt.Sprintf("%s%d-%s", tempPrefix, os.Getpid(), filepath.Base(final)))
+}
+
+// cleanTempFiles removes temporary files and staging directories older than
+// maxAge from the target and --temp-dir.
+func (s *syncer) cleanTempFiles(maxAge time.Duration) (int, error) {
+	removed := 0
+	cutoff := time.Now().Add(-maxAge)
+	err := filepath.Walk(s.options.targetDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && internalNames[info.Name()] {
+			return filepath.SkipDir
+		}
+		if !strings.HasPrefix(info.Name(), tempPrefix) || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := s.checkTargetPath(path); err != nil {
+			return err
+		}
+		fmt.Printf("Removing stale temporary file: %s\n", path)
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		removed++
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil || s.options.tempDir == "" {
+		return removed, err
+	}
+
+	// Only the files directly in --temp-dir are ours.
+	entries, err := os.ReadDir(s.options.tempDir)
+	if os.IsNotExist(err) {
+		return removed, nil
+	}
+	for _, entry := range entries {
+		info, ierr := entry.Info()
+		if ierr != nil || entry.IsDir() || !strings.HasPrefix(entry.Name(), tempPrefix) || info.ModTime().After(cutoff) {
+			continue
+		}
+		path := filepath.Join(s.options.tempDir, entry.Name())
+		fmt.Printf("Removing stale temporary file: %s\n", path)
+		if err := os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, err
+}
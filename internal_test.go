@@ -0,0 +1,108 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestIsWithin(t *testing.T) {
+	tests := []struct {
+		path, dir string
+		want      bool
+	}{
+		{"/target", "/target", true},
+		{"/target/A/01.opus", "/target", true},
+		{"/target/..foo", "/target", true},
+		{"/target2/A/01.opus", "/target", false},
+		{"/target2", "/target", false},
+		{"/", "/target", false},
+		{"/target/../etc/passwd", "/target", false},
+		{"/target/A/../../etc", "/target", false},
+		{"/target/A/../B", "/target", true},
+		{"/Target/A", "/target", false},
+	}
+	for _, tt := range tests {
+		path, dir := filepath.FromSlash(tt.path), filepath.FromSlash(tt.dir)
+		if got := isWithin(path, dir); got != tt.want {
+			t.Errorf("isWithin(%q, %q) = %v, want %v", tt.path, tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTargetPath(t *testing.T) {
+	tests := []struct {
+		path          string
+		caseSensitive bool
+		want          bool
+	}{
+		{"/target/A/01.opus", true, true},
+		{"/target/" + dbFileName, true, true},
+		{"/target", true, false},
+		{"/target/", true, false},
+		{"/target/..", true, false},
+		{"/target/../source/01.flac", true, false},
+		{"/target2/01.opus", true, false},
+		{"/staging/A/01.opus", true, true},
+		{"/staging", true, false},
+		{"/Target/A/01.opus", true, false},
+		{"/Target/A/01.opus", false, true},
+		{"/TARGET", false, false},
+		{"/Target2/01.opus", false, false},
+	}
+	for _, tt := range tests {
+		s := newSyncer()
+		s.options.targetDir = filepath.FromSlash("/target")
+		s.stagingRoot = filepath.FromSlash("/staging")
+		s.targetCaps.caseSensitive = tt.caseSensitive
+		err := s.checkTargetPath(filepath.FromSlash(tt.path))
+		if got := err == nil; got != tt.want {
+			t.Errorf("checkTargetPath(%q) with case-sensitive %v: %v, want allowed %v", tt.path, tt.caseSensitive, err, tt.want)
+		}
+	}
+}
+
+func TestIsInternalPath(t *testing.T) {
+	tests := []struct {
+		path, walkRoot string
+		caseSensitive  bool
+		want           bool
+	}{
+		{"/target/" + dbFileName, "/target", true, true},
+		{"/target/" + sqliteDBFileName, "/target", true, true},
+		{"/target/" + sqliteDBFileName + "-wal", "/target", true, true},
+		{"/target/" + namedDBPrefix + "car.json", "/target", true, true},
+		{"/target/" + lockFileName, "/target", true, true},
+		{"/target/" + trashDirName, "/target", true, true},
+		{"/target/" + snapshotDirName, "/target", true, true},
+		{"/target/A/" + tempPrefix + "123-01.opus", "/target", true, true},
+		{"/target/" + statsFileName, "/target", true, true},
+		{"/target/" + lastSyncFileName, "/target", true, true},
+		{"/target/A/01.opus", "/target", true, false},
+		{"/target/A/syncdb.json", "/target", true, false},
+		// Case only matters on a case-sensitive target.
+		{"/target/.SyncDB.json", "/target", true, false},
+		{"/target/.SyncDB.json", "/target", false, true},
+		{"/target/A/.SMSTMP-123-01.opus", "/target", false, true},
+		// The target inside the source, and the other way around.
+		{"/source/phone", "/source", true, true},
+		{"/source/phone/A/01.opus", "/source", true, true},
+		{"/source/phone2", "/source", true, false},
+		{"/source/Phone", "/source", true, false},
+		{"/source/Phone", "/source", false, true},
+		{"/source/A/../phone", "/source", true, true},
+		{"/source/A/01.flac", "/source", true, false},
+		{"/source/phone/A/01.opus", "/source/phone", true, false},
+	}
+	for _, tt := range tests {
+		s := newSyncer()
+		s.options.sourceDir = filepath.FromSlash("/source")
+		s.options.targetDir = filepath.FromSlash("/source/phone")
+		s.targetCaps.caseSensitive = tt.caseSensitive
+		if tt.walkRoot == "/target" {
+			s.options.targetDir = filepath.FromSlash("/target")
+		}
+		if got := s.isInternalPath(filepath.FromSlash(tt.path), filepath.FromSlash(tt.walkRoot)); got != tt.want {
+			t.Errorf("isInternalPath(%q, %q) with case-sensitive %v = %v, want %v", tt.path, tt.walkRoot, tt.caseSensitive, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// errInterrupted is returned when a run was stopped by SIGINT or SIGTERM.
+var errInterrupted = errors.New("interrupted")
+
+// handleSignals makes SIGINT and SIGTERM stop the run gracefully: no new
+// jobs are started, running commands are killed, and the results of the
+// jobs that completed are saved to the DB, the rest is recorded as pending.
+// A second signal exits immediately, ending the lease of the target lock.
+func (s *syncer) handleSignals() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	s.runCtx = ctx
+	go func() {
+		<-ctx.Done()
+		again := make(chan os.Signal, 1)
+		signal.Notify(again, os.Interrupt, syscall.SIGTERM)
+		stop()
+		fmt.Println("\nInterrupted, saving the results so far. Interrupt again to exit immediately.")
+		<-again
+		exit(130)
+	}()
+}
+
+func (s *syncer) interrupted() bool {
+	return s.runCtx.Err() != nil
+}
+
+// exitStatus returns the exit status for a run that failed with err, 130
+// (the shell's convention for SIGINT) if it was interrupted.
+func exitStatus(err error) int {
+	if errors.Is(err, errInterrupted) {
+		return 130
+	}
+	return 1
+}
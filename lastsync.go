@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+// lastSyncFileName is written at the root of the target after every sync
+// that completed without failures, so the device itself tells when it was
+// last synced and by what, for scripts that can't see the DB on the host.
+const lastSyncFileName = ".last-sync.json"
+
+// lastSyncMarker is the content of lastSyncFileName. The counts are of
+// files. It is left in the clear for scripts on the device even when the
+// target is encrypted, so it holds no paths then.
+type lastSyncMarker struct {
+	Time    time.Time `json:"time"`
+	RunID   string    `json:"run_id"`
+	Version string    `json:"version"`
+	Source  string    `json:"source,omitempty"`
+	Files   int       `json:"files"`
+	Added   int       `json:"added"`
+	Updated int       `json:"updated"`
+	Removed int       `json:"removed"`
+	Skipped int       `json:"skipped"`
+}
+
+// toolVersion returns the version of this binary as recorded by the Go
+// toolchain: the module version for go install, "(devel)" for local builds.
+func toolVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// newRunID returns a random ID telling runs apart, even those started in
+// the same second.
+func newRunID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// writeLastSyncMarker replaces the marker at the root of the target with
+// the outcome of the run summarized in summary.
+func (s *syncer) writeLastSyncMarker(db *syncDB, summary *syncSummary) error {
+	marker := lastSyncMarker{
+		Time:    time.Now().UTC().Truncate(time.Second),
+		RunID:   newRunID(),
+		Version: toolVersion(),
+		Skipped: len(summary.skipped),
+	}
+	// An encrypted target doesn't tell where it came from.
+	if s.targetKey == nil {
+		marker.Source = s.options.sourceDir
+	}
+	for _, e := range db.Entries {
+		if e.hasTarget() {
+			marker.Files++
+		}
+	}
+	for _, a := range summary.albums {
+		marker.Added += a.added
+		marker.Updated += a.updated
+		marker.Removed += a.removed
+	}
+	data, _ := json.MarshalIndent(marker, "", "  ")
+	return s.perms.writeAtomically(filepath.Join(s.options.targetDir, lastSyncFileName), func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// buckets are the sub-folders used by --bucket-dirs, keyed by the first
+// letter of the file name. Anything not covered ends up in "#".
+var buckets = []string{"A-C", "D-F", "G-I", "J-L", "M-O", "P-R", "S-U", "V-Z"}
+
+// targetRelPath returns the path of the target file for a source file,
+// relative to the target directory.
+func (s *syncer) targetRelPath(relPath, targetExt string) string {
+	rel := strings.TrimSuffix(relPath, filepath.Ext(relPath)) + "." + targetExt
+	rel = s.normalizeArtistDir(rel)
+	return flattenPath(rel, s.options.flatten)
+}
+
+// flattenPath collapses the directories of a relative path to at most levels
+// levels by joining the deepest ones with " - ", so Artist/Album/01.opus
+// becomes "Artist - Album/01.opus" with one level. levels <= 0 leaves the
+// path alone.
+func flattenPath(rel string, levels int) string {
+	if levels <= 0 {
+		return rel
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	dirs, name := parts[:len(parts)-1], parts[len(parts)-1]
+	if len(dirs) <= levels {
+		return rel
+	}
+	joined := strings.Join(dirs[levels-1:], " - ")
+	return filepath.Join(append(append([]string{}, dirs[:levels-1]...), joined, name)...)
+}
+
+// resolveCollisions makes sure no two jobs write to the same target file,
+// which can happen once paths are flattened or renamed. Later jobs (in walk
+// order, so deterministic) get a " (2)", " (3)", ... suffix. When syncing
+// in batches, the targets claimed by earlier batches count as taken too.
+func (s *syncer) resolveCollisions(jobs []syncJob) {
+	taken := s.claimedTargets
+	if taken == nil {
+		taken = make(map[string]bool)
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		if job.skipReason != "" {
+			continue
+		}
+		key := strings.ToLower(job.targetFile)
+		if s.targetCaps.caseSensitive {
+			key = job.targetFile
+		}
+		if job.archive {
+			// All files of an album share its archive.
+			taken[key] = true
+			continue
+		}
+		if taken[key] {
+			ext := filepath.Ext(job.targetFile)
+			stem := strings.TrimSuffix(job.targetFile, ext)
+			for n := 2; ; n++ {
+				candidate := fmt.Sprintf("%s (%d)%s", stem, n, ext)
+				k := candidate
+				if !s.targetCaps.caseSensitive {
+					k = strings.ToLower(candidate)
+				}
+				if !taken[k] {
+					job.targetFile, key = candidate, k
+					break
+				}
+			}
+			job.relTargetPath, _ = filepath.Rel(s.options.targetDir, job.targetFile)
+			s.planLog("Renaming target of %s to avoid a collision: %s\n", job.relPath, job.relTargetPath)
+		}
+		taken[key] = true
+	}
+}
+
+// applyDirLimits checks the number of files that would end up in each target
+// directory. Some players (and FAT32 with long file names) choke on huge
+// directories, so directories over the limit are either reported or, with
+// --bucket-dirs, split into alphabetical sub-folders.
+func (s *syncer) applyDirLimits(jobs []syncJob) {
+	if s.options.maxFilesPerDir <= 0 {
+		return
+	}
+
+	perDir := make(map[string][]int)
+	for i, job := range jobs {
+		if job.skipReason != "" || job.archive {
+			continue
+		}
+		dir := filepath.Dir(job.targetFile)
+		perDir[dir] = append(perDir[dir], i)
+	}
+
+	dirs := make([]string, 0, len(perDir))
+	for dir := range perDir {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		indexes := perDir[dir]
+		if len(indexes) <= s.options.maxFilesPerDir {
+			continue
+		}
+		rel, _ := filepath.Rel(s.options.targetDir, dir)
+		if !s.options.bucketDirs {
+			s.planLog("Warning: %s would contain %d files (limit %d)\n", rel, len(indexes), s.options.maxFilesPerDir)
+			continue
+		}
+
+		s.planLog("Splitting %s into sub-folders (%d files, limit %d)\n", rel, len(indexes), s.options.maxFilesPerDir)
+		for _, i := range indexes {
+			name := filepath.Base(jobs[i].targetFile)
+			jobs[i].targetFile = filepath.Join(dir, bucketFor(name), name)
+			jobs[i].relTargetPath, _ = filepath.Rel(s.options.targetDir, jobs[i].targetFile)
+		}
+	}
+}
+
+// bucketFor returns the alphabetical bucket a file name belongs to.
+func bucketFor(name string) string {
+	for _, r := range name {
+		if unicode.IsDigit(r) {
+			return "0-9"
+		}
+		r = unicode.ToUpper(r)
+		for _, b := range buckets {
+			if r >= rune(b[0]) && r <= rune(b[len(b)-1]) {
+				return b
+			}
+		}
+		break
+	}
+	return "#"
+}
+
+// fatInvalidChars are the characters FAT and exFAT (and Windows in general)
+// don't allow in names.
+const fatInvalidChars = `?:*"<>|\`
+
+// nameReplacements are the --name-replacement schemes for the characters of
+// fatInvalidChars: what each one is replaced with.
+var nameReplacements = map[string]func(r rune) string{
+	"remove":     func(rune) string { return "" },
+	"underscore": func(rune) string { return "_" },
+	// The fullwidth forms look the same but are allowed everywhere.
+	"unicode": func(r rune) string { return string(r + 0xFEE0) },
+}
+
+// setNameReplacement selects the named --name-replacement scheme.
+func (s *syncer) setNameReplacement(name string) error {
+	replace, ok := nameReplacements[name]
+	if !ok {
+		return fmt.Errorf("unknown name replacement %q, use remove, underscore or unicode", name)
+	}
+	s.nameReplacement = replace
+	return nil
+}
+
+// fatSafeName returns name with the characters FAT filesystems reject
+// replaced according to --name-replacement, without control characters and
+// without trailing dots and spaces, which they silently drop (so two names
+// could end up the same file). "Title: Subtitle?" becomes "Title Subtitle".
+func (s *syncer) fatSafeName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r < 0x20:
+		case strings.ContainsRune(fatInvalidChars, r):
+			b.WriteString(s.nameReplacement(r))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	name = strings.Join(strings.Fields(b.String()), " ")
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+// windowsReservedNames are the device names Windows doesn't allow as a file
+// or directory name, with or without an extension.
+var windowsReservedNames = map[string]bool{"CON": true, "PRN": true, "AUX": true, "NUL": true}
+
+func init() {
+	for _, n := range []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "¹", "²", "³"} {
+		windowsReservedNames["COM"+n] = true
+		windowsReservedNames["LPT"+n] = true
+	}
+}
+
+// windowsSafeName returns name with an underscore after the base name if it
+// is reserved on Windows: "CON.flac" becomes "CON_.flac", "aux" "aux_".
+func windowsSafeName(name string) string {
+	base, rest, hasExt := strings.Cut(name, ".")
+	// Windows ignores trailing spaces of the base name, "NUL .txt" is NUL.
+	if !windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		return name
+	}
+	name = strings.TrimRight(base, " ") + "_"
+	if hasExt {
+		name += "." + rest
+	}
+	return name
+}
+
+// safeTargetPath makes every component of a target path (relative to the
+// target) safe with fatSafeName and, with --windows-safe-names,
+// windowsSafeName, keeping the extension of the file name.
+func (s *syncer) safeTargetPath(rel string) string {
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i, part := range parts {
+		if i == len(parts)-1 {
+			ext := filepath.Ext(part)
+			part = s.fatSafeName(strings.TrimSuffix(part, ext)) + ext
+		} else {
+			part = s.fatSafeName(part)
+		}
+		if s.options.windowsSafeNames {
+			part = windowsSafeName(part)
+		}
+		parts[i] = part
+	}
+	return strings.Join(parts, string(filepath.Separator))
+}
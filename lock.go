@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const lockFileName = ".syncdb.lock"
+
+// heldLocks are the target locks taken by the process. They stay open for
+// as long as it runs, unless released with unlockTarget. The locks on them are released by the OS when the
+// process exits, however it exits, so there are no stale locks to clean up
+// after a crash.
+var heldLocks struct {
+	sync.Mutex
+	files []*os.File
+}
+
+// lockTarget makes sure only one process at a time changes the target and
+// its DB, e.g. a manual sync while a --watch is running, or two scheduled
+// runs overlapping. Otherwise the later one to finish would overwrite the
+// DB with a version that doesn't know about the other's work.
+func (s *syncer) lockTarget() error {
+	if err := s.perms.makeDirs(s.options.targetDir); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(s.options.targetDir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// Best effort, the lock file may belong to whoever created it.
+	s.perms.apply(f.Name(), false)
+	if err := lockFile(f); err != nil {
+		owner, _ := io.ReadAll(f)
+		f.Close()
+		if len(owner) == 0 {
+			return fmt.Errorf("another run is using %s", s.options.targetDir)
+		}
+		return fmt.Errorf("another run is using %s (%s)", s.options.targetDir, strings.TrimSpace(string(owner)))
+	}
+
+	// Locks on network shares often only hold between the processes of one
+	// machine, so a run on another machine is also told apart by the lease
+	// it keeps renewing.
+	host, _ := os.Hostname()
+	owner, _ := io.ReadAll(f)
+	var pid int
+	var ownerHost string
+	fmt.Sscanf(string(owner), "pid %d on %s", &pid, &ownerHost)
+	ownerHost = strings.TrimSuffix(ownerHost, ",")
+	if info, err := f.Stat(); err == nil && s.options.leaseTimeout > 0 && ownerHost != "" && ownerHost != host &&
+		time.Since(info.ModTime()) < s.options.leaseTimeout {
+		f.Close()
+		return fmt.Errorf("a run on %s is using %s (%s), if it crashed its lease expires %s after it was last renewed",
+			ownerHost, s.options.targetDir, strings.TrimSpace(string(owner)), s.options.leaseTimeout)
+	}
+
+	// Record who holds the lock, for the error messages above.
+	f.Truncate(0)
+	f.WriteAt([]byte(fmt.Sprintf("pid %d on %s, since %s\n", os.Getpid(), host, time.Now().Format(time.DateTime))), 0)
+	heldLocks.Lock()
+	heldLocks.files = append(heldLocks.files, f)
+	heldLocks.Unlock()
+	if s.options.leaseTimeout > 0 {
+		go s.renewLease(f.Name())
+	}
+	return nil
+}
+
+// renewLease keeps the lease of the target lock from expiring while the
+// process runs, by touching the lock file.
+func (s *syncer) renewLease(path string) {
+	ticker := time.NewTicker(s.options.leaseTimeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		heldLocks.Lock()
+		held := slices.ContainsFunc(heldLocks.files, func(f *os.File) bool { return f.Name() == path })
+		heldLocks.Unlock()
+		if !held {
+			return
+		}
+		now := time.Now()
+		os.Chtimes(path, now, now)
+	}
+}
+
+// unlockTarget releases the target lock taken by lockTarget, for a process
+// that goes on to sync other targets, like the GUI.
+func (s *syncer) unlockTarget() {
+	path := filepath.Join(s.options.targetDir, lockFileName)
+	heldLocks.Lock()
+	defer heldLocks.Unlock()
+	for i, f := range heldLocks.files {
+		if f.Name() == path {
+			f.Truncate(0)
+			f.Close()
+			heldLocks.files = slices.Delete(heldLocks.files, i, i+1)
+			return
+		}
+	}
+}
+
+// releaseTarget ends the leases of the target locks, so a run on another
+// machine can start right away. The locks themselves are released when the
+// process exits.
+func releaseTarget() {
+	heldLocks.Lock()
+	defer heldLocks.Unlock()
+	for _, f := range heldLocks.files {
+		f.Truncate(0)
+	}
+}
+
+// exit ends the process with status code, ending the lease of the target
+// lock first. Use it instead of os.Exit, which skips the deferred release
+// in main.
+func exit(code int) {
+	releaseTarget()
+	os.Exit(code)
+}
+
+// mustLockTarget takes the target lock or exits.
+func (s *syncer) mustLockTarget() {
+	if err := s.lockTarget(); err != nil {
+		fmt.Println("Error:", err)
+		exit(1)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFile takes an exclusive lock on f without waiting for it. The locked
+// range lies past the end of the file, so others can still read who holds
+// the lock.
+func lockFile(f *os.File) error {
+	var ol windows.Overlapped
+	ol.OffsetHigh = 1
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &ol)
+}
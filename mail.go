@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Values of --mail-on.
+const (
+	mailAlways    = "always"
+	mailOnFailure = "failure"
+)
+
+// mailReport mails the report of a run, if an SMTP server is configured.
+func (s *syncer) mailReport(failed bool, body string) {
+	if s.options.smtpServer == "" || (s.options.mailOn == mailOnFailure && !failed) {
+		return
+	}
+	status := "complete"
+	if failed {
+		status = "FAILED"
+	}
+	hostname, _ := os.Hostname()
+	subject := fmt.Sprintf("SimpleMusicSync %s: %s -> %s", status, s.options.sourceDir, s.options.targetDir)
+	if err := s.sendMail(subject, body, hostname); err != nil {
+		fmt.Println("Error sending report mail:", err)
+	}
+}
+
+func (s *syncer) sendMail(subject, body, hostname string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.options.mailFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.options.mailTo, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "X-Mailer: SimpleMusicSync on %s\r\n", hostname)
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if s.options.smtpUser != "" {
+		host, _, err := net.SplitHostPort(s.options.smtpServer)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.options.smtpUser, s.options.smtpPassword, host)
+	}
+	return smtp.SendMail(s.options.smtpServer, auth, s.options.mailFrom, s.options.mailTo, msg.Bytes())
+}
@@ -2,207 +2,985 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
 	"time"
 	"unicode"
 
 	flag "github.com/spf13/pflag"
+	"golang.org/x/text/language"
 )
 
 type optionsType struct {
-	sourceDir             string
-	targetDir             string
-	targetAudioExtension  string
-	targetImageExtension  string
-	sourceAudioExtensions []string
-	sourceImageExtensions []string
-	ffmpegAudioCommand    string
-	ffmpegImageCommand    string
-	deleteRemovedFiles    bool
-	excludes              []string
-	includes              []string
-}
-
-var options optionsType
-
-type SyncDBEntry struct {
-	SourcePath string    `json:"sourcePath"`
-	TargetPath string    `json:"targetPath"`
-	Size       int64     `json:"size"`
-	ModTime    time.Time `json:"modTime"`
-	Command    string    `json:"command"`
-}
-
-type syncDB struct {
-	Entries []SyncDBEntry `json:"entries"`
+	sourceDir                string
+	targetDir                string
+	targetAudioExtension     string
+	targetImageExtension     string
+	sourceAudioExtensions    []string
+	sourceImageExtensions    []string
+	sidecarExtensions        []string
+	deepClean                bool
+	ffmpegAudioCommand       string
+	ffmpegImageCommand       string
+	ffmpegAudioFor           map[string]string
+	passthroughRules         []passthroughRule
+	selectRules              []selectionRule
+	tagFilter                *tagFilter
+	ffmpegAudioFallbacks     []string
+	ffmpegImageFallbacks     []string
+	deleteRemovedFiles       bool
+	deleteMode               string
+	pruneEmptyDirs           bool
+	trashRetention           time.Duration
+	excludes                 []string
+	includes                 []string
+	includeGlobs             []*regexp.Regexp
+	excludeGlobs             []*regexp.Regexp
+	skipHidden               bool
+	followSymlinks           bool
+	maxFilesPerDir           int
+	bucketDirs               bool
+	normalizeArtistDirs      bool
+	markedOnly               bool
+	minRating                float64
+	maxFileSize              int64
+	sizeBudget               int64
+	budgetPriority           []string
+	budgetPlaylists          []string
+	oversizePolicy           string
+	oversizeCommand          string
+	quietPlan                bool
+	maxChanges               int
+	rateLimit                int
+	assumeYes                bool
+	audioHash                bool
+	audioInfo                bool
+	metadataRefreshThreshold int
+	dbSnapshots              int
+	mtimeWindow              time.Duration
+	tempMaxAge               time.Duration
+	probeTarget              bool
+	flatten                  int
+	filesFrom                string
+	workers                  []string
+	workerToken              string
+	workerFingerprint        string
+	obfuscateNames           bool
+	archives                 []string
+	audiobooks               []string
+	audiobookFormat          string
+	audiobookBitrate         string
+	sourceHash               bool
+	checksum                 bool
+	verifyBeforeReprocess    bool
+	failFast                 bool
+	quarantineAfter          int
+	refreshArt               bool
+	force                    bool
+	forceMatches             []*regexp.Regexp
+	id3v2Version             int
+	id3v1                    bool
+	dedupeArt                string
+	detectMoves              bool
+	onlyReasons              []string
+	skipReasons              []string
+	commandOverrides         bool
+	xattrs                   bool
+	playlists                bool
+	playlistPaths            string
+	playlistRoot             string
+	playlistSeparator        string
+	fatSafeNames             bool
+	windowsSafeNames         bool
+	batchDirs                int
+	maxPathLength            int
+	tempDir                  string
+	thumbnails               string
+	cueSheets                bool
+	checksums                []string
+	progressJSON             bool
+	thumbnailDir             string
+	thumbnailSize            string
+	pathMatch                string
+	dbBackend                string
+	dbName                   string
+	leaseTimeout             time.Duration
+	smtpServer               string
+	smtpUser                 string
+	smtpPassword             string
+	mailFrom                 string
+	mailTo                   []string
+	mailOn                   string
+	healthcheckURL           string
 }
 
 func main() {
+	s := newSyncer()
+	defer releaseTarget()
+	configFile := flag.String("config", "", "Load options from this TOML or YAML file, flags on the command line take precedence")
+	profile := flag.String("profile", "", "Apply the options of the profile with this name from the config file, e.g. a device like phone, car or dap")
+	onlyTarget := flag.String("only-target", "", "With several targets in the config file, only run for the one with this name")
+	optionsJSON := flag.String("options-json", "", "Load options from a JSON object in this file, or stdin for -, with the same keys as a config file (for scripts and GUIs; flags on the command line take precedence)")
+	flag.Bool("trust-config", false, "Allow a --config file inside the source directory to set options that delete files, change the target or run commands")
 	sourceDir := flag.String("source", "", "Source directory")
 	targetDir := flag.String("target", "", "Target directory")
 	targetAudioExt := flag.String("target-audio-extension", "opus", "Extension for converted audio")
 	targetImageExt := flag.String("target-image-extension", "jpeg", "Extension for converted images")
-	sourceAudioExts := flag.String("source-audio-extensions", "mp3,flac,opus", "Comma-separated audio extensions")
+	sourceAudioExts := flag.String("source-audio-extensions", defaultAudioExtensions(), "Comma-separated audio extensions")
 	sourceImageExts := flag.String("source-image-extensions", "jpg,jpeg,png,gif", "Comma-separated image extensions")
+	sidecarExts := flag.String("sidecar-extensions", "", "Comma-separated extensions of extra files copied as they are, e.g. lrc,cue,nfo,pdf,txt")
 	ffmpegAudio := flag.String("ffmpeg-audio", "", "FFmpeg command template for audio")
+	preset := flag.String("preset", "", "Use a built-in audio pipeline instead of --ffmpeg-audio and --target-audio-extension: "+strings.Join(presetNames(), ", "))
 	ffmpegImage := flag.String("ffmpeg-image", "", "FFmpeg command template for images")
+	ffmpegAudioFor := flag.StringArray("ffmpeg-audio-for", []string{}, "Command template for audio files with this source extension instead of --ffmpeg-audio, as EXT=TEMPLATE (can be used multiple times)")
+	passthrough := flag.StringArray("passthrough", []string{}, "Copy or remux audio in this codec at or below this bitrate instead of converting it, as CODEC[:MAXBITRATE] like opus:128k (can be used multiple times)")
+	ffmpegAudioFallbacks := flag.StringArray("ffmpeg-audio-fallback", []string{}, "Fallback command template for audio, tried in order when the previous one fails (can be used multiple times)")
+	ffmpegImageFallbacks := flag.StringArray("ffmpeg-image-fallback", []string{}, "Fallback command template for images, tried in order when the previous one fails (can be used multiple times)")
+	preview := flag.Duration("preview", 0, "Generate preview clips of this length (e.g. 30s) as low bitrate Opus instead of full conversions, into a separate target")
+	previewStart := flag.Duration("preview-start", 0, "With --preview, where in the track the clip starts")
+	previewBitrate := flag.String("preview-bitrate", "32k", "With --preview, the Opus bitrate of the clips")
+	thumbnails := flag.String("thumbnails", "", "Render a spectrogram or waveform PNG of every track into --thumbnail-dir")
+	thumbnailDir := flag.String("thumbnail-dir", "_thumbnails", "Directory in the target for --thumbnails, mirroring the layout of the target")
+	cueSheets := flag.Bool("cue-sheets", false, "Write a .cue next to audio targets whose source has chapters or an embedded cue sheet, e.g. single-file live sets")
+	progressJSON := flag.Bool("progress-json", false, "Write the progress of the jobs to stderr as JSON lines (start, begin, done, log and end events), for GUIs and scripts driving a run")
+	checksums := flag.StringSlice("checksums", nil, "Keep checksum files for verification tools in every target directory: md5 (checksums.md5, md5sum format) and/or ffp (checksums.ffp, FLAC fingerprints of the FLAC files), comma-separated")
+	thumbnailSize := flag.String("thumbnail-size", "800x120", "Size of --thumbnails as WIDTHxHEIGHT")
+	chmod := flag.String("chmod", "", "Octal mode for files created in the target, e.g. 0664 (default: leave it to the umask)")
+	dirMode := flag.String("dirmode", "", "Octal mode for directories created in the target, e.g. 2775 (default: leave it to the umask)")
+	chown := flag.String("chown", "", "Owner for files and directories created in the target, as USER[:GROUP] or :GROUP (needs root to give files away)")
+	batchDirs := flag.Int("batch-dirs", 0, "Plan and sync this many top-level source directories at a time instead of the whole library at once, to bound memory use (0 to disable)")
+	fatSafeNames := flag.Bool("fat-safe-names", false, "Remove characters FAT/exFAT don't allow (?:*\"<>|\\) and trailing dots and spaces from target names (enabled automatically if the target rejects them)")
+	windowsSafeNames := flag.Bool("windows-safe-names", false, "Like --fat-safe-names, and also rename names Windows reserves for devices (CON, PRN, AUX, NUL, COM1-9, LPT1-9) by adding an underscore (default on Windows and with --target-fs ntfs, exfat or fat32)")
+	nameReplacement := flag.String("name-replacement", "remove", "What --fat-safe-names and --windows-safe-names replace invalid characters with: remove, underscore or unicode (fullwidth lookalikes like ？ and ：)")
+	playlists := flag.Bool("playlists", false, "Copy .m3u/.m3u8 playlists to the target with their entries pointing at the synced files, dropping entries of files that aren't synced")
+	playlistPaths := flag.String("playlist-paths", playlistPathsRelative, "How --playlists entries point at files: relative to the playlist, or absolute below --playlist-root")
+	playlistRoot := flag.String("playlist-root", "/", "Path of the target root on the device for --playlist-paths absolute, e.g. /Music or E:\\Music")
+	playlistSeparator := flag.String("playlist-separator", playlistSeparatorSlash, "Path separator in --playlists entries: slash or backslash (for some Windows based devices)")
+	xattrs := flag.Bool("xattrs", false, "Copy the extended attributes (e.g. macOS Finder tags) of sources to their targets, except the quarantine flag")
+	commandOverrides := flag.Bool("command-overrides", false, "Convert a source file with the command in a "+overrideExtension+" file next to it (e.g. track.flac"+overrideExtension+") instead of the configured one, if there is one")
+	onlyReasons := flag.StringArray("only-reason", []string{}, "Only process files for this reason and leave the others for a later run: "+strings.Join(reasonKinds, ", ")+" (can be used multiple times)")
+	skipReasons := flag.StringArray("skip-reason", []string{}, "Leave files that would be processed for this reason for a later run, e.g. command-changed after a template change (can be used multiple times)")
+	detectMoves := flag.Bool("detect-moves", false, "Move the existing target of a file that was moved or renamed in the source instead of converting it again (matched by size and hash or modification time)")
+	dedupeArt := flag.String("dedupe-art", "", "Convert images with identical content (e.g. the cover of a compilation series) once and hardlink or copy the result to the other albums: hardlink or copy")
+	id3v2Version := flag.Int("id3v2-version", 0, "ID3v2 version of the tags of MP3 targets, 3 for old car stereos and players that can't read 2.4 (default: ffmpeg's, 2.4)")
+	id3v1 := flag.Bool("id3v1", false, "Also write an ID3v1 tag to MP3 targets, for players that read nothing else")
+	force := flag.Bool("force", false, "Convert every file again, e.g. after discovering a bad encoder build")
+	forceMatch := flag.StringArray("force-match", []string{}, "Convert the files matching this glob pattern (relative to the source, ** for any directories) again, e.g. \"Artist/Album/**\" (can be used multiple times)")
+	refreshArt := flag.Bool("refresh-art", false, "Convert all images again (e.g. after changing --ffmpeg-image in a way that doesn't change the template), leaving audio alone")
+	failFast := flag.Bool("fail-fast", false, "Stop at the first file that fails to process, instead of continuing and listing the failures at the end")
+	quarantineAfter := flag.Int("quarantine-after", 5, "Stop retrying a file after it failed this many times in a row, until its source changes or it is forced (0 to retry forever)")
 	deleteRemoved := flag.Bool("delete-removed", false, "Delete files in target not present in source")
+	deepClean := flag.Bool("deep-clean", false, "Let --delete-removed delete untracked files of any type in the target, not only those of types this sync writes (audio, images, sidecars, playlists, ...)")
+	deleteMode := flag.String("delete-mode", deleteModeRemove, "How --delete-removed deletes files: remove, or trash to move them into "+trashDirName+"/<timestamp>/ in the target")
+	pruneEmptyDirs := flag.Bool("prune-empty-dirs", false, "Remove directories in the target that --delete-removed leaves empty")
+	trashRetention := flag.Duration("trash-retention", 0, "With --delete-mode trash, empty runs in the trash older than this, e.g. 720h (0 keeps them)")
 	excludes := flag.StringArray("exclude", []string{}, "Exclude files matching this regex pattern (checked against the relative path) (can be used multiple times)")
 	includes := flag.StringArray("include", []string{}, "Include files matching this regex pattern (overrides excludes) (can be used multiple times)")
+	includeGlobs := flag.StringArray("include-glob", []string{}, "Only sync files matching this glob pattern (relative to the source, ** for any directories), e.g. \"Albums/**\" (can be used multiple times)")
+	excludeGlobs := flag.StringArray("exclude-glob", []string{}, "Don't sync files matching this glob pattern, e.g. \"**/Demos/**\"; their targets are kept, not deleted (can be used multiple times)")
+	skipHidden := flag.Bool("skip-hidden", true, "Skip hidden files and directories (names starting with a dot) and junk like @eaDir, Thumbs.db and desktop.ini in the source, and don't delete them from the target (--skip-hidden=false to sync them)")
+	followSymlinks := flag.Bool("follow-symlinks", false, "Descend into symlinked directories of the source, e.g. links to a NAS mount; directories reached twice are walked once and links to their own parents are skipped")
 
-	flag.Parse()
+	archives := flag.StringArray("archive", []string{}, "Pack files matching this regex pattern (checked against the relative path) into per-album tar.zst archives instead of converting them (can be used multiple times)")
+	audiobooks := flag.StringArray("audiobook", []string{}, "Merge the audio files of directories matching this regex pattern (checked against the relative path) into one file with chapters per directory (can be used multiple times)")
+	audiobookFormat := flag.String("audiobook-format", audiobookM4B, "Format of merged audiobooks: m4b or opus")
+	audiobookBitrate := flag.String("audiobook-bitrate", "64k", "Bitrate of merged audiobooks")
+	maxFilesPerDir := flag.Int("max-files-per-dir", 0, "Warn when a target directory would hold more than this many files (0 to disable)")
+	bucketDirs := flag.Bool("bucket-dirs", false, "Split target directories exceeding --max-files-per-dir into alphabetical sub-folders (A-C, D-F, ...)")
+	maxFileSize := flag.String("max-file-size", "", "Maximum size of a single target file, e.g. 4GiB for FAT32 (empty to disable)")
+	oversizePolicy := flag.String("oversize-policy", oversizeSkip, "What to do with files exceeding --max-file-size: skip, compress or fail")
+	oversizeCommand := flag.String("oversize-command", "", "Command template used instead of the normal one for oversized files with --oversize-policy compress")
+	sortLocale := flag.String("sort-locale", "", "Locale used for sorting names in reports and checksum files, e.g. de or sv (default: language neutral)")
+	sortIgnore := flag.String("sort-ignore-articles", "", "Comma-separated leading articles to ignore when sorting, e.g. \"The,A,An\"")
+	normalizeArtistDirs := flag.Bool("normalize-artist-dirs", false, "Normalize artist directory names (\"Beatles, The\" -> \"The Beatles\", unified feat. spelling)")
+	artistMapFile := flag.String("artist-map", "", "File with \"From = To\" lines mapping artist directory names to a canonical name")
+	markedOnly := flag.Bool("marked-only", false, "Only sync directories containing a .sync marker file (and everything below them)")
+	ratingsFile := flag.String("ratings-file", "", "CSV or JSON file mapping relative source paths to a rating or include flag, used as a filter")
+	tagFilterExpr := flag.String("filter", "", "Only sync audio files whose tags match this expression, e.g. 'genre != \"Audiobook\" && rating >= 3' (see the README)")
+	selectRules := flag.StringArray("select", []string{}, "Only sync files picked by one of these rules, removing the targets of the others: added:AGE (modified within e.g. 90d), playlist:FILE (listed in an .m3u, relative to the source or absolute), rating:MIN (rated at least MIN in --ratings-file) (can be used multiple times)")
+	sizeBudget := flag.String("size-budget", "", "Only sync what fits into this size, e.g. 60GiB for a 64 GB card, picking files by --budget-priority and pruning those that no longer fit from the target (empty to disable)")
+	budgetPriority := flag.StringSlice("budget-priority", []string{budgetByPlaylists, budgetByRating, budgetByRecent}, "Order in which --size-budget picks files, comma-separated rules: playlists (listed in --budget-playlist first), rating (highest in --ratings-file first), recent (newest first)")
+	budgetPlaylists := flag.StringArray("budget-playlist", []string{}, "Playlist (.m3u, relative to the source or absolute) whose files --size-budget picks first (can be used multiple times)")
+	minRating := flag.Float64("min-rating", 0, "Minimum rating from --ratings-file for a file to be synced")
+	maxChanges := flag.Int("max-changes", 0, "Ask for confirmation when more than this many files would be processed (0 to disable)")
+	rateLimit := flag.Int("rate-limit", 0, "Maximum number of files to process per minute (0 for no limit)")
+	assumeYes := flag.Bool("yes", false, "Don't ask for confirmation, e.g. when --max-changes is exceeded")
+	audioInfo := flag.Bool("audio-info", false, "Record codec, bitrate, sample rate, channels and duration of every audio source in the DB (requires ffprobe)")
+	audioHash := flag.Bool("audio-hash", false, "Record a hash of the decoded audio of every source file in the DB (requires ffmpeg)")
+	metadataRefreshThreshold := flag.Int("metadata-refresh-threshold", 0, "When at least this percentage of the library changed, only refresh the tags of files whose audio is unchanged instead of re-encoding them (0 to disable, implies --audio-hash)")
+	sourceHash := flag.Bool("source-hash", false, "Record a SHA-256 of every source file in the DB, so scrub can detect silent corruption (hashes each file once)")
+	checksum := flag.Bool("checksum", false, "Detect changed sources by their content (SHA-256) instead of size and modification time, reads every source on every run")
+	pathMatch := flag.String("path-match", pathMatchExact, "How source paths are matched against the DB: exact, normalized (ignore separators and Unicode normalization) or case-insensitive")
+	verifyBeforeReprocess := flag.Bool("verify-before-reprocess", false, "When only the modification time of a source changed, compare its content (SHA-256) with the recorded hash before reprocessing it")
+	dbName := flag.String("db-name", "", "Keep the DB of this machine in .syncdb-NAME in the target instead of the shared one, for several machines syncing their own sources into one target; files of the other DBs are left alone")
+	leaseTimeout := flag.Duration("lease-timeout", 2*time.Minute, "How long the target lock of a run on another machine is honored after it was last renewed, for network shares that don't pass locks between machines (0 to disable)")
+	dbBackend := flag.String("db-backend", dbBackendJSON, "How the DB is stored in the target: json, or sqlite to look entries up through an index and save only the entries that changed, in one transaction (switching converts the existing DB)")
+	dbSnapshots := flag.Int("db-snapshots", 5, "Number of DB snapshots to keep in the target for db rollback (0 to disable)")
+	rollbackSteps := flag.Int("steps", 1, "db rollback: how many snapshots to go back")
+	flatten := flag.Int("flatten", 0, "Collapse the target tree to at most this many directory levels, e.g. 1 for \"Artist - Album/track\" (0 to keep the source structure)")
+	filesFrom := flag.String("files-from", "", "Only sync the files listed in this file (one path relative to the source per line, - for stdin)")
+	mtimeWindow := flag.Duration("mtime-window", 0, "Treat modification times within this window as equal, e.g. 2s for FAT or some NAS shares")
+	maxPathLength := flag.Int("max-path-length", 0, "Shorten target paths (relative to the target) longer than this, counted in bytes or UTF-16 units like the target filesystem counts names, e.g. 255 for some car head units (0 for no limit)")
+	targetFS := flag.String("target-fs", "", "Filesystem of the target, for the file name length limit instead of probing it: "+strings.Join(fsPresetNames(), ", "))
+	probe := flag.Bool("probe-target", true, "Probe the target filesystem at startup and enable matching limits automatically")
+	verifyDecode := flag.Bool("decode", false, "verify: also decode audio targets to find truncated or corrupt files, and compare their duration with the source's")
+	verifyTolerance := flag.Duration("duration-tolerance", time.Second, "verify: how much the duration of a target may differ from its source with --decode")
+	verifyRequeue := flag.Bool("requeue", false, "verify: mark the entries of missing, empty or corrupt targets as failed, so the next sync converts them again")
+	cleanTemp := flag.Bool("temp", false, "clean: remove stale temporary files from the target")
+	tempDir := flag.String("temp-dir", "", "Directory for the output of commands before it is moved into the target, e.g. a local disk for a slow target (default: next to the target file)")
+	tempMaxAge := flag.Duration("temp-max-age", 24*time.Hour, "Age after which leftover temporary files in the target are considered stale and removed")
+	scrubFlac := flag.String("flac", "", "scrub: verify the MD5 embedded in FLAC files instead, for sources, targets or both")
+	flag.Lookup("flac").NoOptDefVal = flacScrubSources
+	planFormat := flag.String("format", "text", "plan: output format, text or json")
+	planPath := flag.String("plan", "", "apply: plan file written by plan --format json")
+	workers := flag.StringSlice("workers", []string{}, "Comma-separated URLs of worker processes to offload conversions to (list a URL several times to run several jobs on it at once)")
+	guiToken := flag.String("gui-token", "", "gui: secret to log in with, needed to listen on a network address")
+	tlsCert := flag.String("tls-cert", "", "gui, worker: serve HTTPS with the certificate in this PEM file (e.g. from certbot), together with --tls-key")
+	tlsKey := flag.String("tls-key", "", "gui, worker: private key of --tls-cert")
+	tlsSelfSigned := flag.Bool("tls-self-signed", false, "gui, worker: serve HTTPS with a self-signed certificate, made on first use and kept in the user config directory")
+	workerToken := flag.String("worker-token", "", "Shared secret between coordinator and workers")
+	workerFingerprint := flag.String("worker-fingerprint", "", "Accept the HTTPS certificate of the --workers with this SHA-256 fingerprint, e.g. one made with --tls-self-signed")
+	workerPrograms := flag.StringSlice("worker-programs", []string{ffmpegBinary}, "worker: comma-separated names of the programs coordinators may run")
+	listen := flag.String("listen", defaultListen, "worker, gui: address to listen on")
+	watch := flag.Bool("watch", false, "Keep running after the sync and sync changes to the source as they happen")
+	watchPoll := flag.Duration("watch-poll", 0, "With --watch, rescan the source at this interval (e.g. 5m) instead of relying on change notifications, for network mounts")
+	watchDelay := flag.Duration("watch-delay", 5*time.Second, "With --watch, wait until the source has been quiet for this long before syncing changes")
+	healthcheckURL := flag.String("healthcheck-url", "", "Ping this URL (healthchecks.io style) when a run starts (/start), succeeds and fails (/fail)")
+	smtpServer := flag.String("smtp-server", "", "SMTP server (host:port) to mail a report to at the end of every run")
+	smtpUser := flag.String("smtp-user", "", "User name for the SMTP server")
+	smtpPassword := flag.String("smtp-password", "", "Password for the SMTP server (better kept in the config file)")
+	mailFrom := flag.String("mail-from", "", "Sender address of the report mail")
+	mailTo := flag.StringSlice("mail-to", []string{}, "Comma-separated recipients of the report mail")
+	mailOn := flag.String("mail-on", mailAlways, "When to mail the report: always or failure")
+	encryptKey := flag.String("encrypt-key", "", "Encrypt every target file with the key in this file (32 bytes in hex), for targets on untrusted storage")
+	obfuscateNames := flag.Bool("obfuscate-names", false, "With --encrypt-key, also encrypt file and directory names in the target")
+	decryptOutput := flag.String("output", "", "decrypt: directory to write the decrypted files to")
+	statsWindow := flag.Duration("window", 90*24*time.Hour, "stats: how far back the growth trend looks")
+	rollbackSnapshot := flag.String("snapshot", "", "db rollback: name of the snapshot to restore (see db snapshots)")
 
-	options = optionsType{
-		sourceDir:             *sourceDir,
-		targetDir:             *targetDir,
-		targetAudioExtension:  *targetAudioExt,
-		targetImageExtension:  *targetImageExt,
-		sourceAudioExtensions: strings.Split(*sourceAudioExts, ","),
-		sourceImageExtensions: strings.Split(*sourceImageExts, ","),
-		ffmpegAudioCommand:    *ffmpegAudio,
-		ffmpegImageCommand:    *ffmpegImage,
-		deleteRemovedFiles:    *deleteRemoved,
-		excludes:              *excludes,
-		includes:              *includes,
-	}
+	importFrom := flag.String("import-from", importFromTarget, "import: where to import from, target (adopt existing target files) or db (another DB, see --import-db)")
+	importDB := flag.String("import-db", "", "import: DB file to import with --import-from db")
+	mapSource := flag.StringArray("map-source", []string{}, "import, db remap: rewrite source paths starting with OLD to start with NEW, as OLD=NEW (can be used multiple times)")
+	mapTarget := flag.StringArray("map-target", []string{}, "import, db remap: rewrite target paths starting with OLD to start with NEW, as OLD=NEW (can be used multiple times)")
+	cleanRemoved := flag.Bool("removed", false, "clean: delete targets whose source was removed, and files in the target that belong to no source")
 
-	if options.sourceDir == "" || options.targetDir == "" {
-		fmt.Println("Source and target directories must be specified.")
-		flag.Usage()
-		os.Exit(1)
+	scopeFlag("steps", "db rollback")
+	scopeFlag("snapshot", "db rollback")
+	scopeFlag("decode", "verify")
+	scopeFlag("duration-tolerance", "verify")
+	scopeFlag("requeue", "verify")
+	scopeFlag("temp", "clean")
+	scopeFlag("removed", "clean")
+	scopeFlag("flac", "scrub")
+	scopeFlag("format", "plan")
+	scopeFlag("plan", "apply")
+	scopeFlag("listen", "worker", "gui")
+	scopeFlag("gui-token", "gui")
+	scopeFlag("tls-cert", "gui", "worker")
+	scopeFlag("tls-key", "gui", "worker")
+	scopeFlag("tls-self-signed", "gui", "worker")
+	scopeFlag("worker-programs", "worker")
+	scopeFlag("output", "decrypt")
+	scopeFlag("window", "stats")
+	scopeFlag("import-from", "import")
+	scopeFlag("import-db", "import")
+	scopeFlag("map-source", "import", "db remap")
+	scopeFlag("map-target", "import", "db remap")
+	scopeFlag("watch", "sync")
+	scopeFlag("watch-delay", "sync")
+	scopeFlag("watch-poll", "sync")
+
+	command, args, err := parseCommand(os.Args[1:])
+	if err != nil {
+		fmt.Println("Error:", err)
+		printUsage("sync")
+		exit(2)
+	}
+	flag.Usage = func() { printUsage(command) }
+	flag.CommandLine.Parse(args)
+	if err := checkFlagScopes(command); err != nil {
+		fmt.Println("Error:", err)
+		exit(2)
+	}
+	// These look at the config and the flags themselves, so they run before
+	// either is loaded.
+	switch command {
+	case "config validate":
+		runConfigValidate(*configFile)
+		return
+	case "schema config":
+		runSchema("config")
+		return
+	case "schema plan":
+		runSchema("plan")
+		return
+	}
+	if *optionsJSON != "" {
+		if err := loadOptionsJSON(*optionsJSON); err != nil {
+			fmt.Println("Error loading --options-json:", err)
+			exit(1)
+		}
+	}
+	if *configFile != "" {
+		if err := s.loadConfig(*configFile); err != nil {
+			fmt.Println("Error loading config:", err)
+			exit(1)
+		}
 	}
 
-	options.sourceDir, _ = filepath.Abs(options.sourceDir)
-	options.targetDir, _ = filepath.Abs(options.targetDir)
+	s.options = optionsType{
+		sourceDir:                *sourceDir,
+		targetDir:                *targetDir,
+		targetAudioExtension:     *targetAudioExt,
+		targetImageExtension:     *targetImageExt,
+		sourceAudioExtensions:    strings.Split(*sourceAudioExts, ","),
+		sourceImageExtensions:    strings.Split(*sourceImageExts, ","),
+		sidecarExtensions:        strings.Split(*sidecarExts, ","),
+		deepClean:                *deepClean,
+		ffmpegAudioCommand:       *ffmpegAudio,
+		ffmpegImageCommand:       *ffmpegImage,
+		ffmpegAudioFallbacks:     *ffmpegAudioFallbacks,
+		ffmpegImageFallbacks:     *ffmpegImageFallbacks,
+		deleteRemovedFiles:       *deleteRemoved,
+		deleteMode:               *deleteMode,
+		pruneEmptyDirs:           *pruneEmptyDirs,
+		trashRetention:           *trashRetention,
+		excludes:                 *excludes,
+		includes:                 *includes,
+		skipHidden:               *skipHidden,
+		followSymlinks:           *followSymlinks,
+		maxFilesPerDir:           *maxFilesPerDir,
+		bucketDirs:               *bucketDirs,
+		normalizeArtistDirs:      *normalizeArtistDirs,
+		markedOnly:               *markedOnly,
+		minRating:                *minRating,
+		oversizePolicy:           *oversizePolicy,
+		oversizeCommand:          *oversizeCommand,
+		maxChanges:               *maxChanges,
+		rateLimit:                *rateLimit,
+		assumeYes:                *assumeYes,
+		audioHash:                *audioHash,
+		audioInfo:                *audioInfo,
+		metadataRefreshThreshold: *metadataRefreshThreshold,
+		dbSnapshots:              *dbSnapshots,
+		mtimeWindow:              *mtimeWindow,
+		tempMaxAge:               *tempMaxAge,
+		probeTarget:              *probe,
+		flatten:                  *flatten,
+		filesFrom:                *filesFrom,
+		workers:                  *workers,
+		workerToken:              *workerToken,
+		workerFingerprint:        *workerFingerprint,
+		obfuscateNames:           *obfuscateNames,
+		archives:                 *archives,
+		audiobooks:               *audiobooks,
+		audiobookFormat:          *audiobookFormat,
+		audiobookBitrate:         *audiobookBitrate,
+		sourceHash:               *sourceHash,
+		checksum:                 *checksum,
+		verifyBeforeReprocess:    *verifyBeforeReprocess,
+		failFast:                 *failFast,
+		quarantineAfter:          *quarantineAfter,
+		refreshArt:               *refreshArt,
+		force:                    *force,
+		id3v2Version:             *id3v2Version,
+		id3v1:                    *id3v1,
+		dedupeArt:                *dedupeArt,
+		detectMoves:              *detectMoves,
+		onlyReasons:              *onlyReasons,
+		skipReasons:              *skipReasons,
+		commandOverrides:         *commandOverrides,
+		xattrs:                   *xattrs,
+		playlists:                *playlists,
+		playlistPaths:            *playlistPaths,
+		playlistRoot:             *playlistRoot,
+		playlistSeparator:        *playlistSeparator,
+		fatSafeNames:             *fatSafeNames,
+		windowsSafeNames:         *windowsSafeNames,
+		batchDirs:                *batchDirs,
+		maxPathLength:            *maxPathLength,
+		tempDir:                  *tempDir,
+		thumbnails:               *thumbnails,
+		cueSheets:                *cueSheets,
+		checksums:                *checksums,
+		progressJSON:             *progressJSON,
+		budgetPriority:           *budgetPriority,
+		budgetPlaylists:          *budgetPlaylists,
+		thumbnailDir:             *thumbnailDir,
+		thumbnailSize:            *thumbnailSize,
+		pathMatch:                *pathMatch,
+		dbBackend:                *dbBackend,
+		dbName:                   *dbName,
+		leaseTimeout:             *leaseTimeout,
+		smtpServer:               *smtpServer,
+		smtpUser:                 *smtpUser,
+		smtpPassword:             *smtpPassword,
+		mailFrom:                 *mailFrom,
+		mailTo:                   *mailTo,
+		mailOn:                   *mailOn,
+		healthcheckURL:           *healthcheckURL,
+	}
+	if *profile != "" && *configFile == "" {
+		fmt.Println("--profile needs profiles in a --config file.")
+		exit(1)
+	}
+	if *onlyTarget != "" && *configFile == "" {
+		fmt.Println("--only-target needs targets in a --config file.")
+		exit(1)
+	}
+	if len(s.configuredTargets) != 0 && *onlyTarget == "" && command != "gui" {
+		if *watch {
+			fmt.Println("--watch can't be used with several targets, run one watcher per target with --only-target.")
+			exit(1)
+		}
+		exit(s.runTargets(command))
+	}
 
-	if err := os.MkdirAll(options.targetDir, 0755); err != nil {
-		fmt.Println("Error creating target directory:", err)
-		os.Exit(1)
+	if *targetFS != "" {
+		if err := s.setTargetFS(*targetFS); err != nil {
+			fmt.Println("Error:", err)
+			exit(1)
+		}
+	}
+	if !flag.CommandLine.Changed("windows-safe-names") &&
+		(runtime.GOOS == "windows" || s.targetFSPreset != nil && s.targetFSPreset.windowsNames) {
+		s.options.windowsSafeNames = true
+	}
+	if s.options.maxPathLength != 0 && s.options.maxPathLength < minPathLength {
+		fmt.Printf("--max-path-length must be at least %d.\n", minPathLength)
+		exit(1)
+	}
+	if err := s.setNameReplacement(*nameReplacement); err != nil {
+		fmt.Println("Error:", err)
+		exit(1)
+	}
+	if s.perms.fileMode, err = parseMode(*chmod); err != nil {
+		fmt.Println("Error parsing --chmod:", err)
+		exit(1)
+	}
+	if s.perms.dirMode, err = parseMode(*dirMode); err != nil {
+		fmt.Println("Error parsing --dirmode:", err)
+		exit(1)
+	}
+	if s.perms.uid, s.perms.gid, err = parseOwner(*chown); err != nil {
+		fmt.Println("Error parsing --chown:", err)
+		exit(1)
+	}
+	if s.options.maxFileSize, err = parseSize(*maxFileSize); err != nil {
+		fmt.Println("Error parsing --max-file-size:", err)
+		exit(1)
+	}
+	if s.options.sizeBudget, err = parseSize(*sizeBudget); err != nil {
+		fmt.Println("Error parsing --size-budget:", err)
+		exit(1)
+	}
+	for _, rule := range s.options.budgetPriority {
+		if rule != budgetByPlaylists && rule != budgetByRating && rule != budgetByRecent {
+			fmt.Println("Invalid --budget-priority, use playlists, rating and recent:", rule)
+			exit(1)
+		}
+	}
+	if s.options.sizeBudget > 0 && (s.options.batchDirs > 0 || *watch) {
+		fmt.Println("--size-budget needs the whole library at once, it can't be used with --batch-dirs or --watch.")
+		exit(1)
+	}
+	if *sortLocale != "" || *sortIgnore != "" {
+		tag := language.Und
+		if *sortLocale != "" {
+			if tag, err = language.Parse(*sortLocale); err != nil {
+				fmt.Println("Error parsing --sort-locale:", err)
+				exit(1)
+			}
+		}
+		s.pathCollator = newNameCollator(tag, strings.Split(*sortIgnore, ","))
+	}
+	if len(*ffmpegAudioFor) != 0 {
+		s.options.ffmpegAudioFor = make(map[string]string)
+		for _, spec := range *ffmpegAudioFor {
+			ext, template, ok := strings.Cut(spec, "=")
+			ext = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(ext)), ".")
+			if !ok || ext == "" {
+				fmt.Printf("Invalid --ffmpeg-audio-for %q, expected EXT=TEMPLATE.\n", spec)
+				exit(1)
+			}
+			s.options.ffmpegAudioFor[ext] = template
+		}
+	}
+	if *tagFilterExpr != "" {
+		if s.options.tagFilter, err = parseTagFilter(*tagFilterExpr); err != nil {
+			fmt.Println("Error parsing --filter:", err)
+			exit(1)
+		}
+	}
+	for _, spec := range *selectRules {
+		rule, err := parseSelectionRule(spec)
+		if err != nil {
+			fmt.Println("Error parsing --select:", err)
+			exit(1)
+		}
+		s.options.selectRules = append(s.options.selectRules, rule)
+	}
+	for _, spec := range *passthrough {
+		rule, err := parsePassthroughRule(spec)
+		if err != nil {
+			fmt.Println("Error parsing --passthrough:", err)
+			exit(1)
+		}
+		s.options.passthroughRules = append(s.options.passthroughRules, rule)
+	}
+	if *preset != "" {
+		if *preview > 0 {
+			fmt.Println("--preview can't be combined with --preset.")
+			exit(1)
+		}
+		if err := s.applyPreset(*preset, flag.CommandLine.Changed("ffmpeg-audio"), flag.CommandLine.Changed("target-audio-extension")); err != nil {
+			fmt.Println("Error:", err)
+			exit(1)
+		}
+	}
+	if *preview > 0 {
+		if len(s.options.passthroughRules) != 0 {
+			fmt.Println("--preview can't be combined with --passthrough.")
+			exit(1)
+		}
+		if s.options.ffmpegAudioCommand != "" || len(s.options.ffmpegAudioFor) != 0 {
+			fmt.Println("--preview can't be combined with --ffmpeg-audio or --ffmpeg-audio-for.")
+			exit(1)
+		}
+		if flag.CommandLine.Changed("target-audio-extension") && s.options.targetAudioExtension != previewExt {
+			fmt.Printf("--preview clips are Opus, --target-audio-extension must be %s.\n", previewExt)
+			exit(1)
+		}
+		s.options.ffmpegAudioCommand = previewCommand(*previewStart, *preview, *previewBitrate)
+		s.options.targetAudioExtension = previewExt
+	}
+	if s.options.id3v2Version != 0 && s.options.id3v2Version != 3 && s.options.id3v2Version != 4 {
+		fmt.Println("Invalid --id3v2-version, use 3 or 4:", s.options.id3v2Version)
+		exit(1)
+	}
+	s.options.ffmpegAudioCommand = s.withTagArgs(s.options.ffmpegAudioCommand)
+	for i, template := range s.options.ffmpegAudioFallbacks {
+		s.options.ffmpegAudioFallbacks[i] = s.withTagArgs(template)
+	}
+	for ext, template := range s.options.ffmpegAudioFor {
+		s.options.ffmpegAudioFor[ext] = s.withTagArgs(template)
+	}
+	if *artistMapFile != "" {
+		if err := s.loadArtistMap(*artistMapFile); err != nil {
+			fmt.Println("Error loading artist map:", err)
+			exit(1)
+		}
+	}
+	if *ratingsFile != "" {
+		if err := s.loadRatings(*ratingsFile); err != nil {
+			fmt.Println("Error loading ratings file:", err)
+			exit(1)
+		}
+	}
+	if *encryptKey != "" {
+		if s.targetKey, err = loadTargetKey(*encryptKey, s.options.obfuscateNames); err != nil {
+			fmt.Println("Error loading encryption key:", err)
+			exit(1)
+		}
+	} else if s.options.obfuscateNames {
+		fmt.Println("--obfuscate-names requires --encrypt-key.")
+		exit(1)
+	}
+	if s.options.audiobookFormat != audiobookM4B && s.options.audiobookFormat != audiobookOpus {
+		fmt.Println("Invalid --audiobook-format, use m4b or opus:", s.options.audiobookFormat)
+		exit(1)
+	}
+	switch s.options.thumbnails {
+	case "", thumbnailSpectrogram, thumbnailWaveform:
+	default:
+		fmt.Println("Invalid --thumbnails, use spectrogram or waveform:", s.options.thumbnails)
+		exit(1)
+	}
+	if s.options.playlistPaths != playlistPathsRelative && s.options.playlistPaths != playlistPathsAbsolute {
+		fmt.Println("Invalid --playlist-paths, use relative or absolute:", s.options.playlistPaths)
+		exit(1)
+	}
+	if s.options.playlistSeparator != playlistSeparatorSlash && s.options.playlistSeparator != playlistSeparatorBackslash {
+		fmt.Println("Invalid --playlist-separator, use slash or backslash:", s.options.playlistSeparator)
+		exit(1)
+	}
+	if s.options.playlists && s.targetKey != nil {
+		fmt.Println("--playlists can't be combined with --encrypt-key.")
+		exit(1)
+	}
+	if s.options.dedupeArt != "" && s.options.dedupeArt != dedupeHardlink && s.options.dedupeArt != dedupeCopy {
+		fmt.Println("Invalid --dedupe-art, use hardlink or copy:", s.options.dedupeArt)
+		exit(1)
+	}
+	if s.options.dedupeArt != "" && s.targetKey != nil {
+		fmt.Println("--dedupe-art can't be combined with --encrypt-key.")
+		exit(1)
+	}
+	if s.options.xattrs && s.targetKey != nil {
+		fmt.Println("--xattrs can't be combined with --encrypt-key, the attributes would be stored in plain text.")
+		exit(1)
+	}
+	if s.options.cueSheets && s.targetKey != nil {
+		fmt.Println("--cue-sheets can't be used with --encrypt-key.")
+		exit(1)
+	}
+	if s.options.thumbnails != "" && s.targetKey != nil {
+		fmt.Println("--thumbnails can't be used with --encrypt-key.")
+		exit(1)
+	}
+	for _, kind := range s.options.checksums {
+		if kind != checksumMD5 && kind != checksumFFP {
+			fmt.Println("Invalid --checksums, use md5 and/or ffp:", kind)
+			exit(1)
+		}
+	}
+	if len(s.options.checksums) != 0 && s.targetKey != nil {
+		fmt.Println("--checksums can't be used with --encrypt-key.")
+		exit(1)
+	}
+	var thumbWidth, thumbHeight int
+	if n, _ := fmt.Sscanf(s.options.thumbnailSize, "%dx%d", &thumbWidth, &thumbHeight); n != 2 || thumbWidth <= 0 || thumbHeight <= 0 {
+		fmt.Println("Invalid --thumbnail-size, use WIDTHxHEIGHT:", s.options.thumbnailSize)
+		exit(1)
+	}
+	if !filepath.IsLocal(s.options.thumbnailDir) {
+		fmt.Println("--thumbnail-dir must be a relative path inside the target:", s.options.thumbnailDir)
+		exit(1)
+	}
+	if *optionsJSON == "-" && s.options.filesFrom == "-" {
+		fmt.Println("--options-json and --files-from can't both read from stdin.")
+		exit(1)
+	}
+	if err := checkReasonKinds(append(s.options.onlyReasons, s.options.skipReasons...)); err != nil {
+		fmt.Println("Error:", err)
+		exit(1)
+	}
+	for _, globs := range []struct {
+		flag     string
+		patterns []string
+		compiled *[]*regexp.Regexp
+	}{
+		{"force-match", *forceMatch, &s.options.forceMatches},
+		{"include-glob", *includeGlobs, &s.options.includeGlobs},
+		{"exclude-glob", *excludeGlobs, &s.options.excludeGlobs},
+	} {
+		for _, pattern := range globs.patterns {
+			re, err := compileGlob(pattern)
+			if err != nil {
+				fmt.Printf("Invalid --%s %q: %v\n", globs.flag, pattern, err)
+				exit(1)
+			}
+			*globs.compiled = append(*globs.compiled, re)
+		}
+	}
+	if s.options.deleteMode != deleteModeRemove && s.options.deleteMode != deleteModeTrash {
+		fmt.Println("Invalid --delete-mode, use remove or trash:", s.options.deleteMode)
+		exit(1)
+	}
+	if strings.ContainsAny(s.options.dbName, `/\`) || s.options.dbName == "." || s.options.dbName == ".." {
+		fmt.Println("Invalid --db-name, it must be a plain name:", s.options.dbName)
+		exit(1)
+	}
+	if s.options.dbBackend != dbBackendJSON && s.options.dbBackend != dbBackendSQLite {
+		fmt.Println("Invalid --db-backend, use json or sqlite:", s.options.dbBackend)
+		exit(1)
+	}
+	if s.options.quarantineAfter < 0 {
+		fmt.Println("--quarantine-after must not be negative.")
+		exit(1)
+	}
+	if s.options.dbBackend == dbBackendSQLite && s.targetKey != nil {
+		fmt.Println("--db-backend sqlite can't be used with --encrypt-key, the SQLite DB isn't encrypted.")
+		exit(1)
+	}
+	switch s.options.pathMatch {
+	case pathMatchExact, pathMatchNormalized, pathMatchCaseInsensitive:
+	default:
+		fmt.Println("Invalid --path-match, use exact, normalized or case-insensitive:", s.options.pathMatch)
+		exit(1)
+	}
+	if s.options.mailOn != mailAlways && s.options.mailOn != mailOnFailure {
+		fmt.Println("Invalid --mail-on:", s.options.mailOn)
+		exit(1)
+	}
+	if s.options.smtpServer != "" && (s.options.mailFrom == "" || len(s.options.mailTo) == 0) {
+		fmt.Println("--smtp-server requires --mail-from and --mail-to.")
+		exit(1)
+	}
+	if s.options.oversizePolicy != oversizeSkip && s.options.oversizePolicy != oversizeCompress && s.options.oversizePolicy != oversizeFail {
+		fmt.Println("Invalid --oversize-policy, use skip, compress or fail (splitting files into parts isn't supported):", s.options.oversizePolicy)
+		exit(1)
 	}
 
-	dbPath := filepath.Join(options.targetDir, ".syncdb.json")
-	var oldDB syncDB
-	oldDB.Load(dbPath)
+	if command == "worker" {
+		s.runWorker(*listen, *workerToken, *workerPrograms, serverTLS{certFile: *tlsCert, keyFile: *tlsKey, selfSigned: *tlsSelfSigned})
+		return
+	}
+	if command == "gui" {
+		s.runGUI(*listen, *guiToken, serverTLS{certFile: *tlsCert, keyFile: *tlsKey, selfSigned: *tlsSelfSigned})
+		return
+	}
 
-	var newDB syncDB
+	if command == "clean" {
+		if s.options.targetDir == "" {
+			fmt.Println("Target directory must be specified.")
+			exit(1)
+		}
+		if !*cleanTemp && !*cleanRemoved {
+			fmt.Println("Nothing to clean, use --removed to delete targets of removed sources and --temp to remove stale temporary files.")
+			exit(1)
+		}
+		s.options.targetDir, _ = filepath.Abs(s.options.targetDir)
+		s.mustLockTarget()
+		if *cleanTemp {
+			removed, err := s.cleanTempFiles(s.options.tempMaxAge)
+			if err != nil {
+				fmt.Println("Error cleaning temporary files:", err)
+				exit(1)
+			}
+			fmt.Printf("Removed %d temporary files.\n", removed)
+		}
+		if *cleanRemoved {
+			if s.options.sourceDir == "" {
+				fmt.Println("Source directory must be specified for --removed.")
+				exit(1)
+			}
+			s.options.sourceDir, _ = filepath.Abs(s.options.sourceDir)
+			s.runCleanRemoved()
+		}
+		return
+	}
 
-	err := filepath.Walk(options.sourceDir, func(sourcePath string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return err
+	if command == "verify" {
+		if s.options.targetDir == "" {
+			fmt.Println("Target directory must be specified.")
+			exit(1)
+		}
+		s.options.targetDir, _ = filepath.Abs(s.options.targetDir)
+		if s.options.sourceDir != "" {
+			s.options.sourceDir, _ = filepath.Abs(s.options.sourceDir)
+		}
+		if *verifyDecode && s.targetKey != nil {
+			fmt.Println("--decode can't check encrypted targets.")
+			exit(1)
 		}
+		if *verifyRequeue {
+			s.mustLockTarget()
+		}
+		s.runVerify(*verifyDecode, *verifyTolerance, *verifyRequeue)
+		return
+	}
 
-		ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(sourcePath)), ".")
-		isAudio := isAudioExtension(ext)
-		isImage := isImageExtension(ext)
+	if command == "stats" {
+		if s.options.targetDir == "" {
+			fmt.Println("Target directory must be specified.")
+			exit(1)
+		}
+		s.options.targetDir, _ = filepath.Abs(s.options.targetDir)
+		s.runStats(*statsWindow)
+		return
+	}
 
-		if !isAudio && !isImage {
-			return nil
+	if command == "decrypt" {
+		if s.options.targetDir == "" || s.targetKey == nil {
+			fmt.Println("Target directory and --encrypt-key must be specified.")
+			exit(1)
 		}
+		s.options.targetDir, _ = filepath.Abs(s.options.targetDir)
+		s.runDecrypt(*decryptOutput)
+		return
+	}
 
-		relPath, _ := filepath.Rel(options.sourceDir, sourcePath)
+	if strings.HasPrefix(command, "db ") {
+		if s.options.targetDir == "" {
+			fmt.Println("Target directory must be specified.")
+			exit(1)
+		}
+		s.options.targetDir, _ = filepath.Abs(s.options.targetDir)
+		if command != "db snapshots" {
+			s.mustLockTarget()
+		}
+		if err := s.runDBCommand(command, *rollbackSteps, *rollbackSnapshot, *mapSource, *mapTarget); err != nil {
+			fmt.Println("Error:", err)
+			exit(1)
+		}
+		return
+	}
 
-		if len(options.excludes) != 0 && shouldExclude(relPath, options.excludes, options.includes) {
-			fmt.Printf("Skipping (excluded): %s\n", relPath)
-			return nil
+	var plan planFile
+	if command == "apply" {
+		var err error
+		if plan, err = loadPlanFile(*planPath); err != nil {
+			fmt.Println("Error loading plan:", err)
+			exit(1)
+		}
+		if s.options.sourceDir == "" {
+			s.options.sourceDir = plan.SourceDir
 		}
+		if s.options.targetDir == "" {
+			s.options.targetDir = plan.TargetDir
+		}
+	}
+
+	if s.options.sourceDir == "" || s.options.targetDir == "" {
+		fmt.Println("Source and target directories must be specified.")
+		flag.Usage()
+		exit(1)
+	}
 
-		targetExt := options.targetAudioExtension
-		ffmpegCmd := options.ffmpegAudioCommand
+	s.options.sourceDir, _ = filepath.Abs(s.options.sourceDir)
+	s.options.targetDir, _ = filepath.Abs(s.options.targetDir)
 
-		if isImage {
-			targetExt = options.targetImageExtension
-			ffmpegCmd = options.ffmpegImageCommand
+	switch command {
+	case "sync", "import", "rebuild-db", "apply":
+		s.mustLockTarget()
+	}
+	if command == "sync" || command == "apply" {
+		s.handleSignals()
+	}
+	s.events = &syncEvents{}
+	if s.options.progressJSON {
+		s.events = progressJSONEvents(json.NewEncoder(os.Stderr))
+	}
+	s.events.ConfirmMassChange = promptMassChange
+	switch command {
+	case "status":
+		s.runStatus()
+	case "import":
+		s.runImport(*importFrom, *importDB, *mapSource, *mapTarget)
+	case "rebuild-db":
+		s.runRebuildDB()
+	case "diff":
+		s.runDiff()
+	case "audit-target":
+		s.runAuditTarget()
+	case "plan":
+		s.runPlan(*planFormat)
+	case "apply":
+		s.runApply(plan)
+	case "scrub":
+		if *scrubFlac != "" {
+			s.runFlacScrub(*scrubFlac)
+		} else {
+			s.runScrub()
+		}
+	default:
+		if *watch {
+			s.runWatch(*watchDelay, *watchPoll)
+		} else {
+			s.runSync()
 		}
+	}
+}
 
-		targetFile := filepath.Join(
-			options.targetDir,
-			strings.TrimSuffix(relPath, filepath.Ext(sourcePath))+"."+targetExt)
-		relTargetPath, _ := filepath.Rel(options.targetDir, targetFile)
+// commandRunner runs a command template for a job, writing its target.
+type commandRunner func(template string, job syncJob) error
 
-		var existingEntry *SyncDBEntry
-		for _, e := range oldDB.Entries {
-			if e.SourcePath == relPath {
-				existingEntry = &e
-				break
+// processJob converts or copies a single source file to its target location.
+// When the primary command fails, the fallback commands are tried in order,
+// unless the run was interrupted.
+// It returns the index of the command variant that succeeded.
+func (s *syncer) processJob(job syncJob, run commandRunner) (int, error) {
+	if err := s.checkTargetPath(job.targetFile); err != nil {
+		return 0, err
+	}
+	if err := s.perms.makeDirs(filepath.Dir(job.targetFile)); err != nil {
+		fmt.Printf("Error creating directory for %s: %v\n", job.relPath, err)
+		return 0, err
+	}
+	if job.command == "" {
+		if err := s.copyFile(job.sourcePath, job.targetFile); err != nil {
+			fmt.Printf("Error copying %s: %v\n", job.relPath, err)
+			if _, hint, _ := classifyFailure(err, ""); hint != "" {
+				fmt.Printf("Hint: %s\n", hint)
 			}
+			return 0, err
 		}
+		return 0, nil
+	}
 
-		sourceInfo, _ := os.Stat(sourcePath)
-		needsProcessing := existingEntry == nil ||
-			existingEntry.Size != sourceInfo.Size() ||
-			existingEntry.Command != ffmpegCmd ||
-			!existingEntry.ModTime.Equal(sourceInfo.ModTime()) ||
-			!fileExists(targetFile)
-
-		if needsProcessing {
-			os.MkdirAll(filepath.Dir(targetFile), 0755)
-			if ffmpegCmd != "" {
-				args, err := parseCommandTemplate(ffmpegCmd, sourcePath, targetFile)
-				if err != nil {
-					fmt.Printf("Error parsing ffmpeg command: %v\n", err)
-					return err
-				}
-				if len(args) == 0 {
-					fmt.Printf("Empty ffmpeg command for %s\n", relPath)
-					return nil
-				}
-				cmd := exec.Command(args[0], args[1:]...)
-				if output, err := cmd.CombinedOutput(); err != nil {
-					fmt.Printf("Error processing %s: %v\nOutput: %s\n", relPath, err, string(output))
-					return err
-				}
-				fmt.Printf("Processed: %s\n", relPath)
-			} else if err := copyFile(sourcePath, targetFile); err != nil {
-				fmt.Printf("Error copying %s: %v\n", relPath, err)
-				return err
-			}
-		} else {
-			fmt.Printf("Skipping (up-to-date): %s\n", relPath)
+	if job.correctionInfo != nil && !job.isImage {
+		run = s.decodingCorrection(run)
+	}
+	variants := append([]string{job.command}, job.fallbacks...)
+	var err error
+	for i, template := range variants {
+		if i > 0 {
+			fmt.Printf("Retrying %s with fallback command %d\n", job.relPath, i)
 		}
+		if err = run(template, job); err == nil {
+			return i, nil
+		}
+		if errors.Is(err, errInterrupted) {
+			// A fallback would only be killed as well.
+			return 0, err
+		}
+	}
+	return 0, err
+}
 
-		newDB.Entries = append(newDB.Entries, SyncDBEntry{
-			SourcePath: relPath,
-			TargetPath: relTargetPath,
-			Size:       sourceInfo.Size(),
-			ModTime:    sourceInfo.ModTime(),
-			Command:    ffmpegCmd,
-		})
-		return nil
-	})
-
+// runCommand runs a single command template for the given job locally. The
+// command writes to a temporary file (see tempPath), which replaces the
+// target only once the command succeeded, so an interrupted conversion never
+// leaves a truncated file behind that later runs would take for complete.
+func (s *syncer) runCommand(template string, job syncJob) error {
+	tmp := s.tempPath(job.targetFile)
+	output, err := s.execTemplate(template, job.sourcePath, tmp)
 	if err != nil {
-		fmt.Println("Error during processing:", err)
-		os.Exit(1)
+		os.Remove(tmp)
+		if s.interrupted() {
+			return errInterrupted
+		}
+		reportCommandFailure(job.relPath, err, string(output))
+		return err
 	}
+	if err := s.renameInto(tmp, job.targetFile); err != nil {
+		os.Remove(tmp)
+		fmt.Printf("Error processing %s: the command didn't write $OUTPUT: %v\n", job.relPath, err)
+		return err
+	}
+	return nil
+}
 
-	newDB.Save(dbPath)
-
-	if options.deleteRemovedFiles {
-		expected := make(map[string]bool)
-		for _, e := range newDB.Entries {
-			expected[e.TargetPath] = true
-		}
+// execTemplate runs a command template with the given input and output paths
+// and returns its combined output.
+func (s *syncer) execTemplate(template, inputPath, outputPath string) ([]byte, error) {
+	return s.execTemplateIn("", template, inputPath, outputPath)
+}
 
-		filepath.Walk(options.targetDir, func(path string, info os.FileInfo, err error) error {
-			if err != nil || info.IsDir() {
-				return err
-			}
-			relPath, _ := filepath.Rel(options.targetDir, path)
-			if relPath == ".syncdb.json" || expected[relPath] {
-				return nil
-			}
-			fmt.Printf("Deleting removed file: %s\n", path)
-			return os.Remove(path)
-		})
+// execTemplateIn is execTemplate with the working directory dir ("" for the
+// current one).
+func (s *syncer) execTemplateIn(dir, template, inputPath, outputPath string) ([]byte, error) {
+	args, err := parseCommandTemplate(template, inputPath, outputPath)
+	if err != nil {
+		fmt.Printf("Error parsing ffmpeg command: %v\n", err)
+		return nil, err
 	}
+	if len(args) == 0 {
+		fmt.Printf("Empty ffmpeg command for %s\n", inputPath)
+		return nil, nil
+	}
+	cmd := exec.CommandContext(s.runCtx, args[0], args[1:]...)
+	cmd.Dir = dir
+	// Don't wait for leftover child processes of a killed command that still
+	// hold on to its output.
+	cmd.WaitDelay = 5 * time.Second
+	return cmd.CombinedOutput()
+}
 
-	fmt.Println("Sync complete!")
+func reportCommandFailure(relPath string, err error, output string) {
+	if _, hint, line := classifyFailure(err, output); hint != "" {
+		fmt.Printf("Error processing %s: %v\nHint: %s\nCaused by: %s\n", relPath, err, hint, line)
+	} else {
+		fmt.Printf("Error processing %s: %v\nOutput: %s\n", relPath, err, output)
+	}
 }
 
 func parseCommandTemplate(template string, inputPath string, outputPath string) ([]string, error) {
@@ -212,7 +990,7 @@ func parseCommandTemplate(template string, inputPath string, outputPath string)
 		arg = strings.ReplaceAll(arg, "$OUTPUT", outputPath)
 		args[i] = arg
 	}
-	return args, nil
+	return withInputFormat(args, inputPath), nil
 }
 
 // splitCommand splits a command string into a slice of arguments, taking into account
@@ -278,8 +1056,8 @@ func splitCommand(cmd string) []string {
 // isAudioExtension checks if the given file extension matches any of the
 // audio file extensions specified in the sourceAudioExtensions slice.
 // The comparison is case-insensitive.
-func isAudioExtension(ext string) bool {
-	for _, e := range options.sourceAudioExtensions {
+func (s *syncer) isAudioExtension(ext string) bool {
+	for _, e := range s.options.sourceAudioExtensions {
 		if strings.EqualFold(ext, e) {
 			return true
 		}
@@ -290,8 +1068,8 @@ func isAudioExtension(ext string) bool {
 // isImageExtension checks if the given file extension matches any of the
 // image file extensions specified in the sourceImageExtensions slice.
 // The comparison is case-insensitive.
-func isImageExtension(ext string) bool {
-	for _, e := range options.sourceImageExtensions {
+func (s *syncer) isImageExtension(ext string) bool {
+	for _, e := range s.options.sourceImageExtensions {
 		if strings.EqualFold(ext, e) {
 			return true
 		}
@@ -299,28 +1077,34 @@ func isImageExtension(ext string) bool {
 	return false
 }
 
+// isSidecarExtension checks if the given file extension matches any of the
+// extensions of files copied as they are (sidecarExtensions).
+// The comparison is case-insensitive.
+func (s *syncer) isSidecarExtension(ext string) bool {
+	for _, e := range s.options.sidecarExtensions {
+		if e != "" && strings.EqualFold(ext, e) {
+			return true
+		}
+	}
+	return false
+}
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return !os.IsNotExist(err)
 }
 
-func copyFile(src, dst string) error {
+func (s *syncer) copyFile(src, dst string) error {
 	in, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer in.Close()
 
-	out, err := os.Create(dst)
-	if err != nil {
+	return s.perms.writeAtomically(dst, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
 		return err
-	}
-	defer out.Close()
-
-	if _, err = io.Copy(out, in); err != nil {
-		return err
-	}
-	return out.Sync()
+	})
 }
 
 func shouldExclude(path string, excludes, includes []string) bool {
@@ -347,16 +1131,3 @@ func shouldExclude(path string, excludes, includes []string) bool {
 
 	return result
 }
-
-func (db *syncDB) Load(path string) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return
-	}
-	json.Unmarshal(data, db)
-}
-
-func (db *syncDB) Save(path string) {
-	data, _ := json.MarshalIndent(db, "", "  ")
-	os.WriteFile(path, data, 0644)
-}
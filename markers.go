@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// syncMarker marks a directory (and everything below it) for syncing
+	// when running with --marked-only.
+	syncMarker = ".sync"
+	// noSyncMarker excludes a directory and everything below it.
+	noSyncMarker = ".nosync"
+)
+
+// markerState tracks which source directories are marked while walking, the
+// .syncignore rules that apply in them and, with --follow-symlinks, the
+// real paths of the directories walked.
+type markerState struct {
+	options *optionsType
+	marked  map[string]bool
+	ignores map[string][]ignoreRule
+	visited map[string]bool
+	// realTarget is the real path of the target, set by the first visit.
+	realTarget string
+}
+
+func newMarkerState(options *optionsType) *markerState {
+	return &markerState{options: options, marked: make(map[string]bool), ignores: make(map[string][]ignoreRule), visited: make(map[string]bool)}
+}
+
+// enterDir is called for every directory during the walk. It returns why
+// the directory should be skipped: it is hidden (see --skip-hidden), it
+// contains a .nosync marker or a .syncignore above it matches it. It returns
+// "" to enter it.
+func (m *markerState) enterDir(dir string) string {
+	if m.options.skipHidden && dir != m.options.sourceDir && hiddenName(filepath.Base(dir)) {
+		return "hidden"
+	}
+	if fileExists(filepath.Join(dir, noSyncMarker)) {
+		return noSyncMarker
+	}
+	rules := m.ignores[filepath.Dir(dir)]
+	if dir != m.options.sourceDir && ignored(rules, dir, true) {
+		return ignoreFileName
+	}
+	if own := readIgnoreFile(dir); len(own) != 0 {
+		rules = append(slices.Clip(rules), own...)
+	}
+	m.ignores[dir] = rules
+	m.marked[dir] = m.marked[filepath.Dir(dir)] || fileExists(filepath.Join(dir, syncMarker))
+	return ""
+}
+
+// enterParents enters the directories from the source root down to the
+// parent of dir, so walking dir on its own sees the same markers as a full
+// walk would. It returns false if one of them is skipped.
+func (m *markerState) enterParents(dir string) bool {
+	rel, err := filepath.Rel(m.options.sourceDir, dir)
+	if err != nil {
+		return false
+	}
+	path := m.options.sourceDir
+	if m.enterDir(path) != "" {
+		return false
+	}
+	parent := filepath.Dir(rel)
+	if parent == "." {
+		return true
+	}
+	for _, part := range strings.Split(parent, string(filepath.Separator)) {
+		path = filepath.Join(path, part)
+		if m.enterDir(path) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// included reports whether a file should be synced according to the markers,
+// .syncignore files and --skip-hidden.
+func (m *markerState) included(path string) bool {
+	dir := filepath.Dir(path)
+	name := filepath.Base(path)
+	if name == ignoreFileName || m.options.skipHidden && hiddenName(name) || ignored(m.ignores[dir], path, false) {
+		return false
+	}
+	return !m.options.markedOnly || m.marked[dir]
+}
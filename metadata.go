@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// ffmpegBinary is the ffmpeg executable used for the tool's own helper
+// commands (hashing, remuxing). User supplied templates name their own binary.
+const ffmpegBinary = "ffmpeg"
+
+// hashAudio hashes the decoded audio streams of a file, so that changes to
+// tags or cover art don't change the result.
+func (s *syncer) hashAudio(path string) (string, error) {
+	args := slices.Concat([]string{"-v", "error"}, inputFormatArgs(path), []string{"-i", path, "-map", "0:a", "-f", "hash", "-hash", "sha256", "-"})
+	cmd := exec.CommandContext(s.runCtx, ffmpegBinary, args...)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	hash := strings.TrimSpace(string(output))
+	if hash == "" {
+		return "", fmt.Errorf("ffmpeg returned no hash for %s", path)
+	}
+	return hash, nil
+}
+
+// recordAudioHashes reports whether audio hashes should be computed and
+// stored in the DB.
+func (s *syncer) recordAudioHashes() bool {
+	return s.options.audioHash || s.options.metadataRefreshThreshold > 0
+}
+
+// detectMetadataOnlyChanges looks for runs where a large part of the library
+// changed at once. That is usually a mass re-tag, so for every changed file
+// whose audio is identical to what was converted last time, the job is
+// downgraded to a metadata refresh of the existing target instead of a full
+// re-encode.
+func (s *syncer) detectMetadataOnlyChanges(jobs []syncJob) {
+	// Encrypted targets can't be remuxed in place.
+	if s.options.metadataRefreshThreshold <= 0 || s.targetKey != nil {
+		return
+	}
+
+	var total int
+	var candidates []int
+	for i, job := range jobs {
+		if job.isImage || job.archive || job.playlist || job.sidecar || job.skipReason != "" {
+			continue
+		}
+		total++
+		if !job.needsProcessing {
+			continue
+		}
+		e := job.existingEntry
+		if e != nil && e.AudioHash != "" && e.Command == job.command && !s.forced(job) &&
+			e.TargetPath == job.relTargetPath && fileExists(job.targetFile) {
+			candidates = append(candidates, i)
+		}
+	}
+	if total == 0 || len(candidates)*100 < total*s.options.metadataRefreshThreshold {
+		return
+	}
+
+	s.planLog("Mass change detected: %d of %d audio files changed, checking whether only their tags changed\n", len(candidates), total)
+	refreshed := 0
+	for _, i := range candidates {
+		job := &jobs[i]
+		hash, err := s.hashAudio(job.sourcePath)
+		if err != nil || hash != job.existingEntry.AudioHash {
+			continue
+		}
+		job.metadataOnly = true
+		job.audioHash = hash
+		refreshed++
+	}
+	s.planLog("%d files have unchanged audio and will only get their metadata refreshed, %d will be re-encoded\n", refreshed, len(candidates)-refreshed)
+}
+
+// refreshMetadata copies the tags of the source into the existing target
+// without re-encoding the audio.
+func (s *syncer) refreshMetadata(job syncJob) error {
+	if err := s.checkTargetPath(job.targetFile); err != nil {
+		return err
+	}
+	tmp := s.tempPath(job.targetFile)
+	args := []string{"-v", "error",
+		"-i", job.targetFile}
+	args = append(append(args, inputFormatArgs(job.sourcePath)...), "-i", job.sourcePath,
+		"-map", "0", "-map_metadata", "1", "-c", "copy")
+	args = append(append(args, s.tagArgs()...), "-y", tmp)
+	cmd := exec.Command(ffmpegBinary, args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		fmt.Printf("Error refreshing metadata of %s: %v\nOutput: %s\n", job.relPath, err, string(output))
+		return err
+	}
+	return s.renameInto(tmp, job.targetFile)
+}
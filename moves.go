@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// detectMoves finds new source files that are a file the DB knows under a
+// path that no longer exists, e.g. after renaming an album folder. Their
+// existing target is moved to the new target path instead of converting the
+// file again (see moveTarget). A match needs the same size and command, and
+// the same SHA-256 if the DB recorded one (--source-hash), or else the same
+// modification time, which renaming and moving keep.
+func (s *syncer) detectMoves(jobs []syncJob, oldDB *syncDB) {
+	if !s.options.detectMoves {
+		return
+	}
+	scanned := make(map[string]bool, len(jobs))
+	for _, job := range jobs {
+		scanned[s.pathKey(job.relPath)] = true
+	}
+	// Entries of vanished sources whose target is still there, by size.
+	candidates := make(map[int64][]*SyncDBEntry)
+	for i := range oldDB.Entries {
+		e := &oldDB.Entries[i]
+		if scanned[s.pathKey(e.SourcePath)] || !e.isOK() || !e.hasTarget() || isGroupedCommand(e.Command) ||
+			e.Command == playlistCommand || fileExists(filepath.Join(s.options.sourceDir, e.SourcePath)) ||
+			!fileExists(filepath.Join(s.options.targetDir, e.TargetPath)) {
+			continue
+		}
+		candidates[e.Size] = append(candidates[e.Size], e)
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	for i := range jobs {
+		job := &jobs[i]
+		if !job.needsProcessing || job.existingEntry != nil || job.archive || job.playlist || s.forced(*job) {
+			continue
+		}
+		list := candidates[job.sourceInfo.Size()]
+		for k, e := range list {
+			if e.Command != job.command || !s.sameSource(job, e) {
+				continue
+			}
+			job.movedFrom = e
+			job.reasonKind, job.reason = reasonMoved, "moved from "+e.SourcePath
+			candidates[job.sourceInfo.Size()] = append(list[:k:k], list[k+1:]...)
+			break
+		}
+	}
+}
+
+// sameSource reports whether the source of job is the file e was recorded
+// for, see detectMoves.
+func (s *syncer) sameSource(job *syncJob, e *SyncDBEntry) bool {
+	if e.SourceHash == "" {
+		return s.sameModTime(e.ModTime, job.sourceInfo.ModTime())
+	}
+	if job.sourceHash == "" {
+		hash, err := hashFile(job.sourcePath)
+		if err != nil {
+			s.planLog("Error hashing %s: %v\n", job.relPath, err)
+			return false
+		}
+		job.sourceHash = hash
+	}
+	return job.sourceHash == e.SourceHash
+}
+
+// moveTarget moves the target of the entry a job was moved from to the
+// target of the job, and takes over what the entry recorded.
+func (s *syncer) moveTarget(job *syncJob) error {
+	from := filepath.Join(s.options.targetDir, job.movedFrom.TargetPath)
+	if err := s.checkTargetPath(from); err != nil {
+		return err
+	}
+	if err := s.checkTargetPath(job.targetFile); err != nil {
+		return err
+	}
+	if from != job.targetFile {
+		if fileExists(job.targetFile) {
+			return fmt.Errorf("%s already exists", job.targetFile)
+		}
+		if err := s.perms.makeDirs(filepath.Dir(job.targetFile)); err != nil {
+			return err
+		}
+		if err := os.Rename(from, job.targetFile); err != nil {
+			return err
+		}
+		if s.options.pruneEmptyDirs {
+			s.pruneEmptyDirs(filepath.Dir(from))
+		}
+	}
+	e := job.movedFrom
+	job.variant, job.audioHash, job.duration = e.Variant, e.AudioHash, e.Duration
+	if job.sourceHash == "" {
+		job.sourceHash = e.SourceHash
+	}
+	if job.audio == nil {
+		job.audio = e.Audio
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// How filesystems count the length of a file name.
+const (
+	// nameUnitBytes counts UTF-8 bytes (ext4, btrfs, XFS, ZFS, APFS).
+	nameUnitBytes = "bytes"
+	// nameUnitUTF16 counts UTF-16 code units (NTFS, exFAT, FAT long file
+	// names, HFS+), so a Japanese character takes one unit instead of three
+	// bytes, and an emoji two.
+	nameUnitUTF16 = "UTF-16 units"
+)
+
+// fsPreset is the file name limit of a known filesystem, for --target-fs.
+type fsPreset struct {
+	maxName int
+	unit    string
+	// windowsNames is set for filesystems that reject the names Windows
+	// does, which turns on --windows-safe-names.
+	windowsNames bool
+}
+
+var fsPresets = map[string]fsPreset{
+	"ext4":  {255, nameUnitBytes, false},
+	"btrfs": {255, nameUnitBytes, false},
+	"xfs":   {255, nameUnitBytes, false},
+	"zfs":   {255, nameUnitBytes, false},
+	"apfs":  {255, nameUnitBytes, false},
+	"hfs+":  {255, nameUnitUTF16, false},
+	"ntfs":  {255, nameUnitUTF16, true},
+	"exfat": {255, nameUnitUTF16, true},
+	"fat32": {255, nameUnitUTF16, true},
+}
+
+// fsPresetNames returns the names of the filesystem presets, sorted.
+func fsPresetNames() []string {
+	names := make([]string, 0, len(fsPresets))
+	for name := range fsPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setTargetFS sets the name limit of the target to the named preset.
+func (s *syncer) setTargetFS(name string) error {
+	preset, ok := fsPresets[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown filesystem %q, use one of %s", name, strings.Join(fsPresetNames(), ", "))
+	}
+	s.targetFSPreset = &preset
+	s.targetCaps.maxNameLength, s.targetCaps.nameUnit = preset.maxName, preset.unit
+	return nil
+}
+
+// tempNameReserve is how much longer than the final name a temporary file
+// name gets (see tempPath), plus room for a collision suffix like " (2)".
+const tempNameReserve = len(tempPrefix) + 10 + 1 + 5
+
+// nameLength returns the length of name in unit.
+func nameLength(name, unit string) int {
+	if unit != nameUnitUTF16 {
+		return len(name)
+	}
+	n := 0
+	for _, r := range name {
+		n += utf16Len(r)
+	}
+	return n
+}
+
+// utf16Len returns the number of UTF-16 code units of r.
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// truncateName shortens name to at most max units, keeping its extension
+// and never cutting a character in half. A shortened name ends in "~" and a
+// hash of the full name, so names that only differ after the cut don't
+// collide.
+func truncateName(name string, max int, unit string) string {
+	if nameLength(name, unit) <= max {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if nameLength(ext, unit) > max/2 {
+		ext = ""
+	}
+	return hashedName(strings.TrimSuffix(name, ext), ext, max, unit, name)
+}
+
+// cutToLength cuts s to at most max units, never cutting a character in
+// half.
+func cutToLength(s string, max int, unit string) string {
+	for s != "" && nameLength(s, unit) > max {
+		_, size := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-size]
+	}
+	return s
+}
+
+// limitNameLengths shortens the components of a target path (relative to
+// the target) that are longer than the target filesystem allows, counted
+// the way the filesystem counts. File names leave room for the temporary
+// name they are written under first.
+func (s *syncer) limitNameLengths(rel string) string {
+	max, unit := s.targetCaps.maxNameLength, s.targetCaps.nameUnit
+	if max <= tempNameReserve {
+		return rel
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i, part := range parts {
+		limit := max
+		if i == len(parts)-1 {
+			limit -= tempNameReserve
+		}
+		parts[i] = truncateName(part, limit, unit)
+	}
+	return strings.Join(parts, string(filepath.Separator))
+}
+
+// minPathLength is the smallest --max-path-length accepted: enough for a
+// shortened directory and file name and the temporary name of the file.
+const minPathLength = 100
+
+// pathFileRoom is how much of --max-path-length is left for the file name
+// when directories are shortened.
+const pathFileRoom = 40 + tempNameReserve
+
+// limitPathLength shortens a target path (relative to the target) that is
+// longer than --max-path-length, counted the way the target filesystem
+// counts. Directories are shortened where they leave too little room for a
+// file name, then the file name is. Shortened names end in "~" and a hash of
+// the path they stand for, so they don't collide. Very deep paths may still
+// be too long, as no name is shortened to less than minHashedName units.
+func (s *syncer) limitPathLength(rel string) string {
+	max, unit := s.options.maxPathLength, s.targetCaps.nameUnit
+	if max == 0 {
+		return rel
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	dirs, name := parts[:len(parts)-1], parts[len(parts)-1]
+
+	// Whether a directory is shortened must not depend on the file name,
+	// or files of one album would end up in different directories.
+	length := 0
+	for i, dir := range dirs {
+		budget := max - pathFileRoom - length
+		if nameLength(dir, unit) > budget {
+			dirs[i] = hashedName(dir, "", budget, unit, filepath.Join(parts[:i+1]...))
+		}
+		length += nameLength(dirs[i], unit) + 1
+	}
+
+	if budget := max - length - tempNameReserve; nameLength(name, unit) > budget {
+		ext := filepath.Ext(name)
+		if nameLength(ext, unit) > budget/2 {
+			ext = ""
+		}
+		name = hashedName(strings.TrimSuffix(name, ext), ext, budget, unit, rel)
+	}
+	return filepath.Join(append(dirs, name)...)
+}
+
+// minHashedName is the shortest name hashedName returns, without the
+// extension: a few characters of the original name and the hash.
+const minHashedName = 16
+
+// hashedName shortens stem so that it fits into max units together with a
+// hash of key and ext.
+func hashedName(stem, ext string, max int, unit, key string) string {
+	if least := minHashedName + nameLength(ext, unit); max < least {
+		max = least
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	suffix := fmt.Sprintf("~%08x", h.Sum32())
+	stem = cutToLength(stem, max-nameLength(suffix+ext, unit), unit)
+	return strings.TrimRight(stem, " .") + suffix + ext
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// overrideExtension is the extension of the files next to a source file
+// (track.flac.smsync) that hold a command to use for that file only, see
+// --command-overrides.
+const overrideExtension = ".smsync"
+
+// commandOverride returns the command template in the override file of the
+// source file at sourcePath, if --command-overrides is set and there is one.
+// Lines starting with # are comments; the first other line is the command.
+func (s *syncer) commandOverride(sourcePath string) (string, bool) {
+	if !s.options.commandOverrides {
+		return "", false
+	}
+	data, err := os.ReadFile(sourcePath + overrideExtension)
+	if err != nil {
+		return "", false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return line, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Values of --oversize-policy. There is no policy splitting a file into
+// parts, since every source has exactly one target in the DB.
+const (
+	oversizeSkip     = "skip"
+	oversizeCompress = "compress"
+	oversizeFail     = "fail"
+)
+
+// lossyExtensions are source formats that grow a lot when decoded to PCM.
+var lossyExtensions = map[string]bool{"mp3": true, "opus": true, "ogg": true, "m4a": true, "aac": true, "wma": true}
+
+// pcmExtensions are uncompressed target formats.
+var pcmExtensions = map[string]bool{"wav": true, "aif": true, "aiff": true}
+
+// parseSize parses a human readable size such as "4GiB", "700M" or "1024".
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+		{"B", 1},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid size %q", s)
+			}
+			return int64(n * float64(u.factor)), nil
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n, nil
+}
+
+// formatSize formats a size in bytes for humans, the inverse of parseSize.
+func formatSize(n int64) string {
+	units := []string{"KiB", "MiB", "GiB", "TiB"}
+	if n < 1<<10 && n > -1<<10 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	unit := ""
+	for _, unit = range units {
+		value /= 1 << 10
+		if value < 1<<10 && value > -1<<10 {
+			break
+		}
+	}
+	return fmt.Sprintf("%.1f %s", value, unit)
+}
+
+// projectedSize guesses how large the output of a job will be. Copies keep the
+// source size; conversions to PCM grow roughly by the compression ratio of the
+// source. Other conversions are assumed not to grow.
+func projectedSize(job syncJob) int64 {
+	size := job.sourceInfo.Size()
+	if job.command == "" || !pcmExtensions[extOf(job.targetFile)] {
+		return size
+	}
+	if lossyExtensions[extOf(job.sourcePath)] {
+		return size * 11
+	}
+	return size * 18 / 10
+}
+
+// applySizeLimits applies the oversize policy to jobs whose projected output
+// would exceed --max-file-size. The compress policy only applies to audio,
+// oversized images are skipped with it.
+func (s *syncer) applySizeLimits(jobs []syncJob) {
+	if s.options.maxFileSize <= 0 {
+		return
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		if job.skipReason != "" || job.archive {
+			continue
+		}
+		// Keep using the compressed command for files that needed it last
+		// time, otherwise they would be reconverted on every run.
+		if e := job.existingEntry; e != nil && !job.isImage && !job.sidecar && s.options.oversizeCommand != "" &&
+			e.Command == s.options.oversizeCommand && e.Size == job.sourceInfo.Size() {
+			s.useOversizeCommand(job)
+			continue
+		}
+		if projectedSize(*job) > s.options.maxFileSize {
+			s.handleOversize(job)
+		}
+	}
+}
+
+// checkOutputSize verifies the real size of a job's output after it has been
+// processed. It returns true if the job was reprocessed or skipped because the
+// output was too large.
+func (s *syncer) checkOutputSize(job *syncJob) bool {
+	if s.options.maxFileSize <= 0 {
+		return false
+	}
+	info, err := os.Stat(job.targetFile)
+	if err != nil || info.Size() <= s.options.maxFileSize {
+		return false
+	}
+	if s.checkTargetPath(job.targetFile) == nil {
+		os.Remove(job.targetFile)
+	}
+	if s.options.oversizePolicy == oversizeFail {
+		job.oversized = true
+		return true
+	}
+	if s.options.oversizePolicy == oversizeCompress && !job.isImage && !job.sidecar && job.command != s.options.oversizeCommand {
+		s.handleOversize(job)
+		return true
+	}
+	job.skipReason = "too large"
+	return true
+}
+
+func (s *syncer) handleOversize(job *syncJob) {
+	if s.options.oversizePolicy == oversizeCompress && s.options.oversizeCommand != "" && !job.isImage && !job.sidecar {
+		s.planLog("Output of %s would exceed the maximum file size, using the oversize command\n", job.relPath)
+		s.useOversizeCommand(job)
+		return
+	}
+	if s.options.oversizePolicy == oversizeFail {
+		s.planLog("Output of %s would exceed the maximum file size\n", job.relPath)
+		job.oversized = true
+		return
+	}
+	job.skipReason = "too large"
+}
+
+// errOversized is the error of a job that fails with --oversize-policy fail.
+func (s *syncer) errOversized() error {
+	return fmt.Errorf("output exceeds the maximum file size of %s", formatSize(s.options.maxFileSize))
+}
+
+func (s *syncer) useOversizeCommand(job *syncJob) {
+	job.command = s.options.oversizeCommand
+	job.fallbacks = nil
+}
+
+func extOf(path string) string {
+	return strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// remuxCommand copies the streams of a file into the container of the target
+// extension without transcoding them.
+const remuxCommand = "ffmpeg -i $INPUT -map 0 -c copy -y $OUTPUT"
+
+// passthroughRule says that audio in codec at no more than maxBitrate (bits
+// per second, 0 for any) is copied to the target instead of transcoded.
+type passthroughRule struct {
+	codec      string
+	maxBitrate int64
+}
+
+// parsePassthroughRule parses a rule like "opus:128k" or "mp3".
+func parsePassthroughRule(s string) (passthroughRule, error) {
+	codec, bitrate, _ := strings.Cut(strings.TrimSpace(s), ":")
+	rule := passthroughRule{codec: strings.ToLower(codec)}
+	if rule.codec == "" {
+		return rule, fmt.Errorf("invalid passthrough rule %q, expected CODEC[:MAXBITRATE]", s)
+	}
+	if bitrate != "" {
+		n, err := parseBitrate(bitrate)
+		if err != nil {
+			return rule, err
+		}
+		rule.maxBitrate = n
+	}
+	return rule, nil
+}
+
+// parseBitrate parses a bitrate like "128k" or "1.4M" in bits per second.
+func parseBitrate(s string) (int64, error) {
+	factor := 1.0
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		factor, s = 1e3, s[:len(s)-1]
+	case strings.HasSuffix(s, "M"):
+		factor, s = 1e6, s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid bitrate %q", s)
+	}
+	return int64(n * factor), nil
+}
+
+// matchPassthrough reports whether audio in codec at bitrate matches one of
+// the --passthrough rules. A rule with a bitrate limit doesn't match if the
+// bitrate is unknown.
+func (s *syncer) matchPassthrough(codec string, bitrate int64) bool {
+	for _, rule := range s.options.passthroughRules {
+		if rule.codec == codec && (rule.maxBitrate == 0 || bitrate > 0 && bitrate <= rule.maxBitrate) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyPassthrough copies (or remuxes, if the extension changes) the audio
+// files that are about to be converted with the normal command instead, if
+// their audio info matches a --passthrough rule. Files whose existing
+// target was made the same way then don't need processing after all.
+// Targets that are up to date are left alone, so adding a rule doesn't redo
+// them.
+func (s *syncer) applyPassthrough(jobs []syncJob) {
+	if len(s.options.passthroughRules) == 0 {
+		return
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		if !job.needsProcessing || job.isImage || job.archive || job.command == "" ||
+			job.command != s.audioCommandFor(extOf(job.sourcePath)) {
+			continue
+		}
+		if job.audio == nil || !s.matchPassthrough(job.audio.Codec, job.audio.BitRate) {
+			continue
+		}
+		job.command, job.fallbacks = remuxCommand, nil
+		if extOf(job.sourcePath) == strings.ToLower(s.options.targetAudioExtension) {
+			job.command = ""
+		}
+		job.needsProcessing = s.needsProcessing(*job) || s.forced(*job)
+		job.reasonKind, job.reason = s.processReason(*job)
+	}
+}
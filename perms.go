@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// targetPerms is how files and directories created in the target are set
+// up, instead of leaving them to the umask (--chmod, --dirmode, --chown).
+type targetPerms struct {
+	fileMode os.FileMode
+	dirMode  os.FileMode
+	// uid and gid are -1 to leave them alone.
+	uid, gid int
+}
+
+// parseMode parses an octal mode like 664 or 2775, including the setuid,
+// setgid and sticky bits. An empty string means 0, leave the mode alone.
+func parseMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 07777 || n&0777 == 0 {
+		return 0, fmt.Errorf("invalid mode %q, expected an octal mode like 0664", s)
+	}
+	mode := os.FileMode(n & 0777)
+	if n&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if n&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if n&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
+// parseOwner parses USER[:GROUP] or :GROUP into a uid and gid (-1 for the
+// parts that aren't given). Names and numeric ids both work.
+func parseOwner(s string) (int, int, error) {
+	uid, gid := -1, -1
+	if s == "" {
+		return uid, gid, nil
+	}
+	if runtime.GOOS == "windows" {
+		return uid, gid, fmt.Errorf("changing the owner isn't supported on Windows")
+	}
+	name, group, _ := strings.Cut(s, ":")
+	if name != "" {
+		id, err := strconv.Atoi(name)
+		if err != nil {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return uid, gid, err
+			}
+			id, _ = strconv.Atoi(u.Uid)
+		}
+		uid = id
+	}
+	if group != "" {
+		id, err := strconv.Atoi(group)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return uid, gid, err
+			}
+			id, _ = strconv.Atoi(g.Gid)
+		}
+		gid = id
+	}
+	return uid, gid, nil
+}
+
+// apply sets the mode (fileMode or dirMode) and owner of path, if they were
+// configured.
+func (p targetPerms) apply(path string, dir bool) error {
+	mode := p.fileMode
+	if dir {
+		mode = p.dirMode
+	}
+	if p.uid != -1 || p.gid != -1 {
+		// Before the chmod, as changing the owner may clear setuid/setgid.
+		if err := os.Chown(path, p.uid, p.gid); err != nil {
+			return err
+		}
+	}
+	if mode != 0 {
+		return os.Chmod(path, mode)
+	}
+	return nil
+}
+
+// makeDirs is os.MkdirAll for the target: the directories it creates get
+// --dirmode and --chown.
+func (p targetPerms) makeDirs(dir string) error {
+	var created []string
+	for d := dir; !fileExists(d); d = filepath.Dir(d) {
+		created = append(created, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i := len(created) - 1; i >= 0; i-- {
+		if err := p.apply(created[i], true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAtomically writes path through a temporary file next to it, which is
+// flushed to disk before it replaces path. There is no point in staging
+// these in --temp-dir, they are written by the program itself.
+func (p targetPerms) writeAtomically(path string, write func(w io.Writer) error) error {
+	if err := p.makeDirs(filepath.Dir(path)); err != nil {
+		return err
+	}
+	tmp := siblingTempPath(path)
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = write(out)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return renameCommit{&p}.commit(tmp, path)
+}
+
+// renameInto moves a finished temporary file from tempPath to path, with the
+// commit strategy of the target.
+func (s *syncer) renameInto(tmp, path string) error {
+	return s.targetCommit.commit(tmp, path)
+}
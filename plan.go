@@ -0,0 +1,591 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// planJobs scans the source and works out what has to happen to every file,
+// without touching the target.
+func (s *syncer) planJobs(oldDB *syncDB) ([]syncJob, error) {
+	var jobs []syncJob
+	var err error
+	if s.options.filesFrom != "" {
+		jobs, err = s.scanFileList(s.options.filesFrom, oldDB)
+	} else {
+		jobs, err = s.scanSource(oldDB)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The scan only looked up the files it found, planning goes through the
+	// whole DB.
+	if err := oldDB.load(); err != nil {
+		return nil, fmt.Errorf("reading DB: %w", err)
+	}
+	s.planScannedJobs(jobs, oldDB)
+	return jobs, nil
+}
+
+// planScannedJobs applies the filters and layout rules to freshly scanned
+// jobs and decides which of them need processing.
+func (s *syncer) planScannedJobs(jobs []syncJob, oldDB *syncDB) {
+	s.applyRatings(jobs)
+	s.applySelection(jobs)
+	s.applyTagFilter(jobs)
+	s.resolveCollisions(jobs)
+	s.applyDirLimits(jobs)
+	s.applySizeLimits(jobs)
+	s.applyEncryption(jobs)
+	s.skipTargetsOfOtherDBs(jobs)
+	s.applySizeBudget(jobs)
+
+	for i := range jobs {
+		if err := s.checkTargetPath(jobs[i].targetFile); err != nil && jobs[i].skipReason == "" {
+			s.planLog("Error: %s: %v\n", jobs[i].relPath, err)
+			jobs[i].skipReason = "target outside of target directory"
+		}
+	}
+
+	s.hashSources(jobs)
+	for i := range jobs {
+		job := &jobs[i]
+		if e := job.existingEntry; e != nil && e.Status == statusQuarantined && job.skipReason == "" && !s.sourceChanged(*job) && !s.forced(*job) {
+			job.skipReason, job.deferred = "quarantined", true
+		}
+		job.needsProcessing = job.skipReason == "" && (s.needsProcessing(*job) || s.refreshArt(*job) || s.forced(*job))
+		if job.needsProcessing && job.unadoptedTarget != "" {
+			// Write a new target where a sync would, rather than converting
+			// into the adopted file with another tool's name.
+			job.relTargetPath, job.unadoptedTarget = job.unadoptedTarget, ""
+			job.targetFile = filepath.Join(s.options.targetDir, job.relTargetPath)
+		}
+		job.reasonKind, job.reason = s.processReason(*job)
+	}
+	s.probeSources(jobs)
+	s.applyPassthrough(jobs)
+	s.detectMoves(jobs, oldDB)
+	s.planArchives(jobs, oldDB)
+	s.detectMetadataOnlyChanges(jobs)
+	s.planThumbnails(jobs)
+	s.planCueSheets(jobs)
+	s.planArtDedupe(jobs)
+	s.planPlaylists(jobs, oldDB)
+	s.deferByReason(jobs)
+}
+
+// scanSource walks the source directory and creates a job for every audio
+// and image file.
+func (s *syncer) scanSource(oldDB *syncDB) ([]syncJob, error) {
+	var jobs []syncJob
+	err := s.walkSource(s.options.sourceDir, newMarkerState(&s.options), oldDB, &jobs)
+	return jobs, err
+}
+
+// scanDirs is like scanSource, but only walks the given directories
+// (relative to the source). Directories that no longer exist are skipped.
+// visited, if not nil, holds the real paths of the directories walked by
+// earlier calls with --follow-symlinks, which aren't walked again.
+func (s *syncer) scanDirs(dirs []string, oldDB *syncDB, visited map[string]bool) ([]syncJob, error) {
+	var jobs []syncJob
+	markers := newMarkerState(&s.options)
+	if visited != nil {
+		markers.visited = visited
+	}
+	for _, dir := range dirs {
+		root := filepath.Join(s.options.sourceDir, dir)
+		if !fileExists(root) || !markers.enterParents(root) {
+			continue
+		}
+		if err := s.walkSource(root, markers, oldDB, &jobs); err != nil {
+			return nil, err
+		}
+	}
+	return jobs, nil
+}
+
+// walkSource walks the source tree below root and appends a job for every
+// audio and image file to jobs.
+func (s *syncer) walkSource(root string, markers *markerState, oldDB *syncDB, jobs *[]syncJob) error {
+	return s.walkSourceFiles(root, markers, func(sourcePath string) {
+		if job, ok := s.newJob(sourcePath, oldDB); ok {
+			*jobs = append(*jobs, job)
+		}
+	})
+}
+
+// walkSourceFiles walks the source tree below root and calls found for
+// every file that isn't skipped by the markers, .syncignore files or
+// --skip-hidden.
+func (s *syncer) walkSourceFiles(root string, markers *markerState, found func(sourcePath string)) error {
+	if s.options.followSymlinks {
+		return s.walkTree(root, resolvePath(root), markers, found)
+	}
+	return s.walkTree(root, root, markers, found)
+}
+
+// walkTree is walkSourceFiles for the tree at realRoot, with paths as if it
+// was at root. The two differ below symlinks followed with
+// --follow-symlinks, whose targets are walked as if they were in place of
+// the link.
+func (s *syncer) walkTree(root, realRoot string, markers *markerState, found func(sourcePath string)) error {
+	return filepath.Walk(realRoot, func(realPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(realRoot, realPath)
+		sourcePath := filepath.Join(root, rel)
+		if s.isInternalPath(sourcePath, s.options.sourceDir) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if s.options.followSymlinks && info.Mode()&os.ModeSymlink != 0 {
+			dir, reason := linkedDir(realPath)
+			if reason != "" {
+				relPath, _ := filepath.Rel(s.options.sourceDir, sourcePath)
+				s.planLog("Skipping (%s): %s\n", reason, relPath)
+				return nil
+			}
+			if dir != "" {
+				return s.walkTree(sourcePath, dir, markers, found)
+			}
+		}
+		if info.IsDir() {
+			reason := markers.enterDir(sourcePath)
+			if reason == "" && s.options.followSymlinks {
+				reason = markers.visit(realPath)
+			}
+			if reason != "" {
+				relPath, _ := filepath.Rel(s.options.sourceDir, sourcePath)
+				s.planLog("Skipping (%s): %s\n", reason, relPath)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !markers.included(sourcePath) {
+			return nil
+		}
+		found(sourcePath)
+		return nil
+	})
+}
+
+// scanFileList creates jobs for the files listed in a file with one path
+// (relative to the source directory) per line, or stdin for "-". Only the
+// listed files are synced, other tools can compute the exact set this way.
+func (s *syncer) scanFileList(listPath string, oldDB *syncDB) ([]syncJob, error) {
+	var data []byte
+	var err error
+	if listPath == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(listPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []syncJob
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sourcePath := filepath.Join(s.options.sourceDir, filepath.FromSlash(line))
+		if !isWithin(sourcePath, s.options.sourceDir) || seen[sourcePath] {
+			s.planLog("Skipping (invalid list entry): %s\n", line)
+			continue
+		}
+		seen[sourcePath] = true
+		info, err := os.Stat(sourcePath)
+		if err != nil || info.IsDir() || s.isInternalPath(sourcePath, s.options.sourceDir) {
+			s.planLog("Skipping (not a source file): %s\n", line)
+			continue
+		}
+		if job, ok := s.newJob(sourcePath, oldDB); ok {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+// unlistedEntries returns the entries of oldDB a --files-from run leaves
+// alone: those of the files that aren't in the list and still exist. Like
+// with apply, they stay in the DB as they are, so their targets are neither
+// deleted nor reported as removed.
+func (s *syncer) unlistedEntries(oldDB *syncDB, jobs []syncJob) []SyncDBEntry {
+	listed := make(map[string]bool, len(jobs))
+	for _, job := range jobs {
+		listed[s.pathKey(job.relPath)] = true
+	}
+	var entries []SyncDBEntry
+	for _, e := range oldDB.Entries {
+		if !listed[s.pathKey(e.SourcePath)] && fileExists(filepath.Join(s.options.sourceDir, e.SourcePath)) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// newJob creates the job for a single source file. It returns false if the
+// file is neither audio nor an image, nor packed into an archive, nor a
+// playlist or sidecar file to copy.
+func (s *syncer) newJob(sourcePath string, oldDB *syncDB) (syncJob, bool) {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(sourcePath)), ".")
+	isAudio := s.isAudioExtension(ext)
+	isImage := s.isImageExtension(ext)
+	relPath, _ := filepath.Rel(s.options.sourceDir, sourcePath)
+	archived := s.isArchived(relPath)
+	audiobook := !archived && isAudio && s.isAudiobook(relPath)
+	playlist := !archived && s.isPlaylist(relPath)
+	sidecar := !archived && !playlist && !isAudio && !isImage && s.isSidecarExtension(ext)
+
+	if !isAudio && !isImage && !archived && !playlist && !sidecar {
+		return syncJob{}, false
+	}
+	if strings.EqualFold(filepath.Ext(sourcePath), overrideExtension) || isDirConfig(sourcePath) {
+		return syncJob{}, false
+	}
+	if strings.EqualFold(filepath.Ext(sourcePath), correctionExtension) {
+		// Part of its .wv source, never synced on its own.
+		if isOrphanedCorrection(sourcePath) {
+			relPath, _ := filepath.Rel(s.options.sourceDir, sourcePath)
+			s.planLog("Skipping (correction file without .wv): %s\n", relPath)
+		}
+		return syncJob{}, false
+	}
+
+	targetExt := s.options.targetAudioExtension
+	ffmpegCmd := s.audioCommandFor(ext)
+	fallbacks := s.options.ffmpegAudioFallbacks
+
+	if isImage {
+		targetExt = s.options.targetImageExtension
+		ffmpegCmd = s.options.ffmpegImageCommand
+		fallbacks = s.options.ffmpegImageFallbacks
+	}
+	if dc := s.dirConfigFor(sourcePath); dc != nil {
+		command, ext := dc.audioCommand, dc.audioExt
+		if isImage {
+			command, ext = dc.imageCommand, dc.imageExt
+		}
+		if command != "" {
+			ffmpegCmd, fallbacks = command, nil
+		}
+		if ext != "" {
+			targetExt = ext
+		}
+	}
+	if override, ok := s.commandOverride(sourcePath); ok {
+		ffmpegCmd, fallbacks = override, nil
+	}
+
+	targetFile := filepath.Join(s.options.targetDir, s.targetRelPath(relPath, targetExt))
+	if archived {
+		ffmpegCmd, fallbacks = archiveCommand, nil
+		targetFile = filepath.Join(s.options.targetDir, s.archiveRelPath(relPath))
+	}
+	if audiobook {
+		ffmpegCmd, fallbacks = s.audiobookCommand(), nil
+		targetFile = filepath.Join(s.options.targetDir, s.audiobookRelPath(relPath))
+	}
+	if sidecar {
+		ffmpegCmd, fallbacks = "", nil
+		targetFile = filepath.Join(s.options.targetDir, s.targetRelPath(relPath, strings.TrimPrefix(filepath.Ext(relPath), ".")))
+	}
+	if playlist {
+		ffmpegCmd, fallbacks = playlistCommand, nil
+		targetFile = filepath.Join(s.options.targetDir, s.targetRelPath(relPath, strings.TrimPrefix(filepath.Ext(relPath), ".")))
+	}
+	relTargetPath, _ := filepath.Rel(s.options.targetDir, targetFile)
+	if s.options.fatSafeNames || s.options.windowsSafeNames {
+		relTargetPath = s.safeTargetPath(relTargetPath)
+	}
+	relTargetPath = s.limitNameLengths(relTargetPath)
+	fullTargetPath := ""
+	if short := s.limitPathLength(relTargetPath); short != relTargetPath {
+		fullTargetPath, relTargetPath = relTargetPath, short
+	}
+	targetFile = filepath.Join(s.options.targetDir, relTargetPath)
+
+	existingEntry := oldDB.find(s.pathKey, relPath)
+	unadoptedTarget := ""
+	if existingEntry != nil && existingEntry.TargetPath != relTargetPath && s.targetKey == nil &&
+		s.pathKey(existingEntry.TargetPath) == s.pathKey(relTargetPath) {
+		// Only the case or the Unicode form of the name changed, keep the
+		// existing target instead of converting the file again.
+		relTargetPath = existingEntry.TargetPath
+		targetFile = filepath.Join(s.options.targetDir, relTargetPath)
+	} else if existingEntry != nil && existingEntry.Adopted && s.targetKey == nil &&
+		sameStem(existingEntry.TargetPath, relTargetPath) {
+		unadoptedTarget = relTargetPath
+		relTargetPath = existingEntry.TargetPath
+		targetFile = filepath.Join(s.options.targetDir, relTargetPath)
+	}
+
+	sourceInfo, _ := os.Stat(sourcePath)
+
+	job := syncJob{
+		sourcePath:      sourcePath,
+		relPath:         relPath,
+		targetFile:      targetFile,
+		relTargetPath:   relTargetPath,
+		fullTargetPath:  fullTargetPath,
+		unadoptedTarget: unadoptedTarget,
+		command:         ffmpegCmd,
+		fallbacks:       fallbacks,
+		isImage:         isImage,
+		archive:         archived || audiobook,
+		playlist:        playlist,
+		sidecar:         sidecar,
+		sourceInfo:      sourceInfo,
+		mtimeWindow:     s.options.mtimeWindow,
+		existingEntry:   existingEntry,
+	}
+	if existingEntry != nil && existingEntry.Status == statusFailed {
+		job.attempts = existingEntry.Attempts
+	}
+	if isAudio {
+		job.findCorrection()
+	}
+	if len(s.options.excludes) != 0 && shouldExclude(relPath, s.options.excludes, s.options.includes) {
+		job.skipReason, job.filtered = "excluded", true
+	}
+	if s.globFiltered(relPath) {
+		// Keep what was synced before, like a deferred file.
+		job.skipReason, job.filtered, job.deferred = "excluded", true, true
+	}
+	return job, true
+}
+
+// audioCommandFor returns the command template for audio files with the
+// given source extension.
+func (s *syncer) audioCommandFor(ext string) string {
+	if cmd, ok := s.options.ffmpegAudioFor[ext]; ok {
+		return cmd
+	}
+	return s.options.ffmpegAudioCommand
+}
+
+// planLog prints progress messages from the planning phase, unless the
+// current command only wants to show the result of the plan.
+func (s *syncer) planLog(format string, args ...any) {
+	if !s.options.quietPlan {
+		fmt.Printf(format, args...)
+	}
+}
+
+// syncJob describes a single source file found during the scan, along with
+// where it should end up in the target and whether it has to be (re)processed.
+type syncJob struct {
+	sourcePath    string
+	relPath       string
+	targetFile    string
+	relTargetPath string
+	// unadoptedTarget is set when relTargetPath is an adopted target (see
+	// SyncDBEntry.Adopted), to the target path a sync would use instead.
+	unadoptedTarget string
+	// fullTargetPath is the target path before --max-path-length shortened
+	// it, if it did.
+	fullTargetPath string
+	command        string
+	fallbacks      []string
+	isImage        bool
+	// archive is set when the file is packed into its album's archive, or
+	// merged into its audiobook, instead of being converted on its own.
+	archive bool
+	// playlist is set for playlists translated with --playlists, which are
+	// written after all other jobs using playlistTargets, the target of
+	// every synced source by its pathKey.
+	playlist        bool
+	playlistTargets map[string]string
+	// sidecar is set for extra files like lyrics or cue sheets that are
+	// copied as they are (--sidecar-extensions).
+	sidecar    bool
+	sourceInfo os.FileInfo
+	// correctionInfo describes the WavPack correction file of the source,
+	// if it has one (see correctionFile).
+	correctionInfo os.FileInfo
+	// mtimeWindow is the --mtime-window the modification times of the
+	// entry are rounded to.
+	mtimeWindow     time.Duration
+	existingEntry   *SyncDBEntry
+	needsProcessing bool
+	// reason is why the job needs processing and reasonKind the kind of
+	// reason, see processReason.
+	reason     string
+	reasonKind string
+	// dedupeOf is the image of this run with the same content and command
+	// whose target this one gets (--dedupe-art).
+	dedupeOf *syncJob
+	// movedFrom is the DB entry of the file under its old path if the
+	// source was moved there (--detect-moves).
+	movedFrom *SyncDBEntry
+	// deferred is set together with skipReason when --only-reason,
+	// --skip-reason or a glob filter left the job for a later run, keeping
+	// its DB entry.
+	deferred bool
+	// skipReason is set when the job is left out of this run on purpose.
+	skipReason string
+	// oversized is set with --oversize-policy fail when the output of the
+	// job is, or is projected to be, larger than --max-file-size. Running
+	// the job then fails.
+	oversized bool
+	// metadataOnly is set when only the tags of the source changed, so the
+	// existing target just needs its metadata refreshed.
+	metadataOnly bool
+	audioHash    string
+	sourceHash   string
+	// audio is the probed audio info of the source, if recorded.
+	audio *AudioInfo
+	// tags are the tags of the source --filter uses, if it is given.
+	tags map[string]string
+	// filtered is set together with skipReason when an include/exclude style
+	// filter dropped the file, as opposed to a policy like the size limit.
+	filtered bool
+	// thumbnail is where the thumbnail of the file is rendered to (relative
+	// to the target) with thumbnailCommand, if thumbnails are enabled.
+	// needsThumbnail is set when it has to be rendered in this run.
+	thumbnail        string
+	thumbnailCommand string
+	needsThumbnail   bool
+	// cueSheet is where the cue sheet of the file is written to (relative
+	// to the target) with --cue-sheets. needsCue is set when the source has
+	// to be checked for chapters in this run.
+	cueSheet string
+	needsCue bool
+
+	// Results of processing, recorded in the DB entry.
+	variant     int
+	attempts    int
+	duration    time.Duration
+	lastError   string
+	thumbnailOK bool
+	cueOK       bool
+	noChapters  bool
+}
+
+// keepExisting carries the results of the previous run over for a job that
+// doesn't need processing.
+func (job *syncJob) keepExisting() {
+	e := job.existingEntry
+	job.variant = e.Variant
+	job.audioHash = e.AudioHash
+	job.sourceHash = e.SourceHash
+	job.attempts = e.Attempts
+	job.duration = e.Duration
+	job.thumbnailOK = job.thumbnail != "" && !job.needsThumbnail
+	job.cueOK = job.cueSheet != "" && !job.needsCue && e.Cue == job.cueSheet
+	job.noChapters = job.cueSheet != "" && !job.needsCue && e.NoChapters
+	if job.audio == nil {
+		job.audio = e.Audio
+	}
+}
+
+// entry returns the DB entry for the job with the given status.
+func (job *syncJob) entry(status string) SyncDBEntry {
+	if job.deferred && job.existingEntry != nil {
+		return *job.existingEntry
+	}
+	e := SyncDBEntry{
+		SourcePath:     job.relPath,
+		TargetPath:     job.relTargetPath,
+		FullTargetPath: job.fullTargetPath,
+		Size:           job.sourceInfo.Size(),
+		ModTime:        normalizeModTime(job.sourceInfo.ModTime(), job.mtimeWindow),
+		Command:        job.command,
+		Variant:        job.variant,
+		AudioHash:      job.audioHash,
+		SourceHash:     job.sourceHash,
+		Status:         status,
+		LastError:      job.lastError,
+		Attempts:       job.attempts,
+		Duration:       job.duration,
+		Audio:          job.audio,
+		Tags:           job.tags,
+		Adopted:        job.unadoptedTarget != "",
+	}
+	if job.thumbnailOK {
+		e.Thumbnail, e.ThumbnailCommand = job.thumbnail, job.thumbnailCommand
+	}
+	if job.cueOK {
+		e.Cue = job.cueSheet
+	}
+	e.NoChapters = job.noChapters
+	if job.correctionInfo != nil {
+		modTime := normalizeModTime(job.correctionInfo.ModTime(), job.mtimeWindow)
+		e.CorrectionSize, e.CorrectionModTime = job.correctionInfo.Size(), &modTime
+	}
+	if status == statusSkipped {
+		e.TargetPath, e.FullTargetPath = "", ""
+		e.LastError = job.skipReason
+	}
+	return e
+}
+
+// failedEntry returns the DB entry for a job that failed. A file failing for
+// the --quarantine-after time in a row is quarantined instead.
+func (s *syncer) failedEntry(job *syncJob) SyncDBEntry {
+	if s.options.quarantineAfter > 0 && job.attempts >= s.options.quarantineAfter {
+		return job.entry(statusQuarantined)
+	}
+	return job.entry(statusFailed)
+}
+
+// pendingEntry returns the DB entry for a job that was planned but not run
+// because the sync was aborted.
+func (job *syncJob) pendingEntry() SyncDBEntry {
+	switch {
+	case job.skipReason != "":
+		return job.entry(statusSkipped)
+	case !job.needsProcessing:
+		job.keepExisting()
+		return job.entry(statusOK)
+	default:
+		return job.entry(statusPending)
+	}
+}
+
+// refreshArt reports whether a job is an image forced to be converted again
+// by --refresh-art.
+func (s *syncer) refreshArt(job syncJob) bool {
+	return s.options.refreshArt && job.isImage && !job.archive
+}
+
+// needsProcessing reports whether the target of a job is missing or out of
+// date compared to what the DB recorded for the previous run.
+func (s *syncer) needsProcessing(job syncJob) bool {
+	e := job.existingEntry
+	return s.sourceChanged(job) ||
+		e.Command != job.command ||
+		e.TargetPath != job.relTargetPath ||
+		!e.isOK() ||
+		!fileExists(job.targetFile)
+}
+
+// sourceChanged reports whether the source file differs from what the DB
+// recorded for it. If the content of the source was hashed during planning
+// (--checksum), the hashes decide instead of the modification time.
+func (s *syncer) sourceChanged(job syncJob) bool {
+	e := job.existingEntry
+	if e == nil || e.Size != job.sourceInfo.Size() || s.correctionChanged(job, e) {
+		return true
+	}
+	if job.sourceHash != "" && e.SourceHash != "" {
+		return job.sourceHash != e.SourceHash
+	}
+	return !s.sameModTime(e.ModTime, job.sourceInfo.ModTime())
+}
+
+// sameStem reports whether two paths are the same apart from case and the
+// extension.
+func sameStem(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, filepath.Ext(a)), strings.TrimSuffix(b, filepath.Ext(b)))
+}
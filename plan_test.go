@@ -0,0 +1,200 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSyncer makes a source with the given files and an empty target,
+// and returns a syncer for them that converts audio to .opus and images to
+// .jpg by copying them with cp.
+func newTestSyncer(t *testing.T, files ...string) *syncer {
+	t.Helper()
+	if _, err := exec.LookPath("cp"); err != nil {
+		t.Skip("cp not found")
+	}
+	s := newSyncer()
+	s.options = optionsType{
+		sourceDir:             t.TempDir(),
+		targetDir:             t.TempDir(),
+		targetAudioExtension:  "opus",
+		targetImageExtension:  "jpg",
+		sourceAudioExtensions: []string{"flac", "mp3"},
+		sourceImageExtensions: []string{"jpg", "png"},
+		ffmpegAudioCommand:    "cp $INPUT $OUTPUT",
+		ffmpegImageCommand:    "cp $INPUT $OUTPUT",
+		skipHidden:            true,
+		quietPlan:             true,
+	}
+	for _, f := range files {
+		writeTestFile(t, filepath.Join(s.options.sourceDir, filepath.FromSlash(f)), f)
+	}
+	return s
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// jobsByPath returns the jobs by their source path, with forward slashes.
+func jobsByPath(jobs []syncJob) map[string]syncJob {
+	byPath := make(map[string]syncJob)
+	for _, job := range jobs {
+		byPath[filepath.ToSlash(job.relPath)] = job
+	}
+	return byPath
+}
+
+func TestPlanJobsNewSource(t *testing.T) {
+	s := newTestSyncer(t, "A/01.flac", "A/02.mp3", "A/cover.png", "A/notes.txt", ".hidden/01.flac")
+
+	jobs, err := s.planJobs(&syncDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byPath := jobsByPath(jobs)
+	want := map[string]string{"A/01.flac": "A/01.opus", "A/02.mp3": "A/02.opus", "A/cover.png": "A/cover.jpg"}
+	if len(byPath) != len(want) {
+		t.Errorf("got jobs for %d files, want %d", len(byPath), len(want))
+	}
+	for source, target := range want {
+		job, ok := byPath[source]
+		if !ok {
+			t.Errorf("no job for %s", source)
+			continue
+		}
+		if got := filepath.ToSlash(job.relTargetPath); got != target {
+			t.Errorf("%s goes to %s, want %s", source, got, target)
+		}
+		if !job.needsProcessing || job.reasonKind != reasonNew {
+			t.Errorf("%s: needsProcessing %v, reason %q, want a new file to process", source, job.needsProcessing, job.reasonKind)
+		}
+	}
+}
+
+func TestPlanJobsChangedSource(t *testing.T) {
+	s := newTestSyncer(t, "A/01.flac", "A/02.flac")
+	jobs, err := s.planJobs(&syncDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both were synced before.
+	var db syncDB
+	for i := range jobs {
+		writeTestFile(t, jobs[i].targetFile, jobs[i].relPath)
+		db.Entries = append(db.Entries, jobs[i].entry(statusOK))
+	}
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(s.options.sourceDir, "A", "02.flac"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err = s.planJobs(&db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byPath := jobsByPath(jobs)
+	if job := byPath["A/01.flac"]; job.needsProcessing {
+		t.Errorf("unchanged A/01.flac needs processing (%s)", job.reason)
+	}
+	if job := byPath["A/02.flac"]; !job.needsProcessing || job.reasonKind != reasonSourceChanged {
+		t.Errorf("A/02.flac: needsProcessing %v, reason %q, want a changed file to process", job.needsProcessing, job.reasonKind)
+	}
+}
+
+func TestPlanJobsMTimeWindow(t *testing.T) {
+	s := newTestSyncer(t, "A/01.flac")
+	s.options.mtimeWindow = 2 * time.Second
+	jobs, err := s.planJobs(&syncDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := jobs[0].entry(statusOK)
+	if !e.ModTime.Equal(e.ModTime.Truncate(2 * time.Second)) {
+		t.Errorf("entry has modification time %v, want it rounded to the window", e.ModTime)
+	}
+}
+
+func TestPlanJobsLongNames(t *testing.T) {
+	long := strings.Repeat("Very Long Album Name ", 4)
+	s := newTestSyncer(t, long+"Disc 1/01.flac", long+"Disc 1/02.flac", long+"Disc 2/01.flac", "A/"+long+"Part 1.flac", "A/"+long+"Part 2.flac")
+	s.targetCaps.maxNameLength = 60
+
+	jobs, err := s.planJobs(&syncDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := make(map[string]string)
+	dirs := make(map[string]string)
+	for _, job := range jobs {
+		target := filepath.ToSlash(job.relTargetPath)
+		for _, part := range strings.Split(target, "/") {
+			if len(part) > 60 {
+				t.Errorf("%s: %s is longer than the limit", job.relPath, part)
+			}
+		}
+		if other, ok := targets[target]; ok {
+			t.Errorf("%s and %s both go to %s", job.relPath, other, target)
+		}
+		targets[target] = job.relPath
+		dirs[filepath.ToSlash(filepath.Dir(job.relPath))] = filepath.ToSlash(filepath.Dir(target))
+	}
+	if dirs[long+"Disc 1"] == dirs[long+"Disc 2"] {
+		t.Errorf("both discs go to %s", dirs[long+"Disc 1"])
+	}
+}
+
+func TestDiffLinesExcludeGlob(t *testing.T) {
+	s := newTestSyncer(t, "A/01.flac", "Demos/01.flac", "Demos/02.flac")
+	jobs, err := s.planJobs(&syncDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var db syncDB
+	for i := range jobs {
+		writeTestFile(t, jobs[i].targetFile, jobs[i].relPath)
+		db.Entries = append(db.Entries, jobs[i].entry(statusOK))
+	}
+	glob, err := compileGlob("Demos/**")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.options.excludeGlobs = append(s.options.excludeGlobs, glob)
+
+	jobs, err = s.planJobs(&db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, planned := s.diffLines(&db, jobs)
+	if len(lines) != 0 {
+		t.Errorf("got changes %q, want none", lines)
+	}
+	if a := s.buildSummary(&db, planned, jobs).albums[s.pathKey("Demos")]; a != nil && a.removed != 0 {
+		t.Errorf("the summary removes %d files of the excluded album", a.removed)
+	}
+
+	// The target of an excluded source that is gone is kept as well.
+	if err := os.Remove(filepath.Join(s.options.sourceDir, "Demos", "02.flac")); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err = s.planJobs(&db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines, _ := s.diffLines(&db, jobs); len(lines) != 0 {
+		t.Errorf("got changes %q after removing an excluded source, want none", lines)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Actions in an exported plan.
+const (
+	actionConvert         = "convert"
+	actionCopy            = "copy"
+	actionArchive         = "archive"
+	actionMerge           = "merge"
+	actionPlaylist        = "playlist"
+	actionRefreshMetadata = "refresh-metadata"
+	actionKeep            = "keep"
+	actionSkip            = "skip"
+	actionDelete          = "delete"
+	actionMove            = "move"
+)
+
+// planFile is the JSON document written by "plan --format json" and read by
+// "apply --plan". External schedulers can split the actions across machines
+// and apply each part separately. schema/plan.schema.json describes it and
+// has to be kept in step.
+type planFile struct {
+	Version   int          `json:"version"`
+	CreatedAt time.Time    `json:"createdAt"`
+	SourceDir string       `json:"sourceDir"`
+	TargetDir string       `json:"targetDir"`
+	Actions   []planAction `json:"actions"`
+}
+
+type planAction struct {
+	Action     string   `json:"action"`
+	SourcePath string   `json:"sourcePath,omitempty"`
+	TargetPath string   `json:"targetPath,omitempty"`
+	Image      bool     `json:"image,omitempty"`
+	Sidecar    bool     `json:"sidecar,omitempty"`
+	Command    string   `json:"command,omitempty"`
+	Fallbacks  []string `json:"fallbacks,omitempty"`
+	Reason     string   `json:"reason,omitempty"`
+	// From is the source path a moved file had before, for move actions.
+	From string `json:"from,omitempty"`
+	Size int64  `json:"size,omitempty"`
+}
+
+const planVersion = 1
+
+// buildPlanFile turns the planned jobs into an exportable plan. With
+// --delete-removed, targets of sources that disappeared become delete actions.
+func (s *syncer) buildPlanFile(jobs []syncJob, oldDB *syncDB) planFile {
+	p := planFile{
+		Version:   planVersion,
+		CreatedAt: time.Now(),
+		SourceDir: s.options.sourceDir,
+		TargetDir: s.options.targetDir,
+	}
+	seen := make(map[string]bool)
+	for _, job := range jobs {
+		seen[s.pathKey(job.relPath)] = true
+		a := planAction{
+			SourcePath: job.relPath,
+			TargetPath: job.relTargetPath,
+			Image:      job.isImage,
+			Sidecar:    job.sidecar,
+			Command:    job.command,
+			Fallbacks:  job.fallbacks,
+			Size:       job.sourceInfo.Size(),
+		}
+		switch {
+		case job.skipReason != "":
+			a.Action, a.Reason = actionSkip, job.skipReason
+		case !job.needsProcessing:
+			a.Action = actionKeep
+		case job.movedFrom != nil:
+			a.Action, a.From = actionMove, job.movedFrom.SourcePath
+		case job.metadataOnly:
+			a.Action = actionRefreshMetadata
+		case job.playlist:
+			a.Action = actionPlaylist
+		case job.archive && isAudiobookCommand(job.command):
+			a.Action = actionMerge
+		case job.archive:
+			a.Action = actionArchive
+		case job.command == "":
+			a.Action = actionCopy
+		default:
+			a.Action = actionConvert
+		}
+		if job.skipReason == "" && job.needsProcessing {
+			a.Reason = job.reason
+		}
+		p.Actions = append(p.Actions, a)
+	}
+	if s.options.deleteRemovedFiles {
+		for _, e := range oldDB.Entries {
+			_, owned := s.ownedByOtherDB(e.TargetPath)
+			if e.hasTarget() && !seen[s.pathKey(e.SourcePath)] && !s.globFiltered(e.TargetPath) && !owned {
+				p.Actions = append(p.Actions, planAction{Action: actionDelete, SourcePath: e.SourcePath, TargetPath: e.TargetPath, Reason: "source removed"})
+			}
+		}
+	}
+	return p
+}
+
+// runPlan prints the plan for the current options without executing it.
+func (s *syncer) runPlan(format string) {
+	s.options.quietPlan = true
+
+	var oldDB syncDB
+	s.loadDB(&oldDB, s.syncDBPath())
+	jobs, err := s.planJobs(&oldDB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error during planning:", err)
+		exit(1)
+	}
+	p := s.buildPlanFile(jobs, &oldDB)
+
+	switch format {
+	case "json":
+		data, _ := json.MarshalIndent(p, "", "  ")
+		fmt.Println(string(data))
+	case "text":
+		for _, a := range p.Actions {
+			fmt.Println(a.text())
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown plan format:", format)
+		exit(1)
+	}
+}
+
+// text describes the action in a line of the text format of the plan.
+func (a planAction) text() string {
+	if a.Reason != "" {
+		return fmt.Sprintf("%-16s %s (%s)", a.Action, a.SourcePath, a.Reason)
+	}
+	return fmt.Sprintf("%-16s %s", a.Action, a.SourcePath)
+}
+
+// loadPlanFile reads a plan written by "plan --format json".
+func loadPlanFile(path string) (planFile, error) {
+	var p planFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, err
+	}
+	if p.Version != planVersion {
+		return p, fmt.Errorf("unsupported plan version %d", p.Version)
+	}
+	return p, nil
+}
+
+// runApply executes the actions of a plan and merges the results into the
+// DB. Entries for sources not mentioned in the plan are left untouched, so
+// several parts of one plan can be applied one after another.
+func (s *syncer) runApply(p planFile) {
+	s.pingHealthcheckStart()
+	if err := s.prepareTarget(); err != nil {
+		fmt.Println("Error:", err)
+		exit(1)
+	}
+
+	dbPath := s.syncDBPath()
+	var oldDB syncDB
+	s.loadDB(&oldDB, dbPath)
+
+	var jobs []syncJob
+	var deletes []planAction
+	touched := make(map[string]bool)
+	for _, a := range p.Actions {
+		touched[s.pathKey(a.SourcePath)] = true
+		if a.Action == actionDelete {
+			deletes = append(deletes, a)
+			continue
+		}
+		job, err := s.jobFromAction(a, oldDB.find(s.pathKey, a.SourcePath))
+		if err == nil && a.Action == actionMove {
+			if job.movedFrom = oldDB.find(s.pathKey, a.From); job.movedFrom == nil {
+				err = fmt.Errorf("nothing to move, %s is not in the DB", a.From)
+			}
+		}
+		if err != nil {
+			fmt.Printf("Skipping %s: %v\n", a.SourcePath, err)
+			touched[s.pathKey(a.SourcePath)] = false
+			continue
+		}
+		if a.Action == actionMove {
+			touched[s.pathKey(a.From)] = true
+		}
+		jobs = append(jobs, job)
+	}
+	s.planPlaylists(jobs, &oldDB)
+
+	entries, err := s.executeJobs(jobs)
+	var newDB syncDB
+	for _, e := range oldDB.Entries {
+		if !touched[s.pathKey(e.SourcePath)] {
+			newDB.Entries = append(newDB.Entries, e)
+		}
+	}
+	newDB.Entries = append(newDB.Entries, entries...)
+	if err != nil {
+		s.saveDB(&newDB, dbPath)
+		fmt.Println("Error during processing:", err)
+		s.reportRunEnd(&oldDB, &newDB, jobs, err)
+		exit(exitStatus(err))
+	}
+
+	for _, a := range deletes {
+		path := filepath.Join(s.options.targetDir, a.TargetPath)
+		if err := s.checkTargetPath(path); err != nil {
+			fmt.Println("Error:", err)
+			continue
+		}
+		if err := s.removeTarget(path); err != nil && !os.IsNotExist(err) {
+			fmt.Println("Error deleting file:", err)
+		}
+	}
+
+	if err := s.snapshotDB(dbPath, s.options.dbSnapshots); err != nil {
+		fmt.Println("Error creating DB snapshot:", err)
+	}
+	s.saveDB(&newDB, dbPath)
+	summary := s.buildSummary(&oldDB, &newDB, jobs)
+	summary.Print()
+	s.reportRunEnd(&oldDB, &newDB, jobs, nil)
+	summary.exitOnFailures()
+	fmt.Println("Apply complete!")
+}
+
+// jobFromAction recreates the job for a plan action.
+func (s *syncer) jobFromAction(a planAction, existing *SyncDBEntry) (syncJob, error) {
+	job := syncJob{
+		sourcePath:    filepath.Join(s.options.sourceDir, a.SourcePath),
+		relPath:       a.SourcePath,
+		targetFile:    filepath.Join(s.options.targetDir, a.TargetPath),
+		relTargetPath: a.TargetPath,
+		command:       a.Command,
+		fallbacks:     a.Fallbacks,
+		isImage:       a.Image,
+		sidecar:       a.Sidecar,
+		mtimeWindow:   s.options.mtimeWindow,
+		existingEntry: existing,
+	}
+	if !isWithin(job.sourcePath, s.options.sourceDir) {
+		return job, fmt.Errorf("source outside of the source directory")
+	}
+	info, err := os.Stat(job.sourcePath)
+	if err != nil {
+		return job, err
+	}
+	job.sourceInfo = info
+	job.findCorrection()
+	if existing != nil && existing.Status == statusFailed {
+		job.attempts = existing.Attempts
+	}
+
+	switch a.Action {
+	case actionSkip:
+		job.skipReason = a.Reason
+	case actionKeep:
+		if existing == nil {
+			return job, fmt.Errorf("nothing to keep, the file is not in the DB")
+		}
+	case actionRefreshMetadata:
+		if existing == nil {
+			return job, fmt.Errorf("cannot refresh metadata, the file is not in the DB")
+		}
+		job.needsProcessing, job.metadataOnly = true, true
+		job.audioHash = existing.AudioHash
+	case actionCopy, actionConvert, actionMove:
+		job.needsProcessing = true
+	case actionArchive, actionMerge:
+		job.needsProcessing, job.archive = true, true
+	case actionPlaylist:
+		job.needsProcessing, job.playlist = true, true
+	default:
+		return job, fmt.Errorf("unknown action %q", a.Action)
+	}
+	return job, nil
+}
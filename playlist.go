@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// playlistCommand is recorded as the command of playlists translated with
+// --playlists.
+const playlistCommand = "playlist"
+
+// Values of --playlist-paths and --playlist-separator.
+const (
+	playlistPathsRelative      = "relative"
+	playlistPathsAbsolute      = "absolute"
+	playlistSeparatorSlash     = "slash"
+	playlistSeparatorBackslash = "backslash"
+)
+
+// playlistExtensions are the playlist formats --playlists translates.
+var playlistExtensions = map[string]bool{"m3u": true, "m3u8": true}
+
+// isPlaylist reports whether the file at relPath (relative to the source) is
+// a playlist to translate.
+func (s *syncer) isPlaylist(relPath string) bool {
+	return s.options.playlists && playlistExtensions[extOf(relPath)]
+}
+
+// planPlaylists decides which playlists need to be written again: those
+// whose translation differs from what is in the target, given where the
+// files they list will end up. Files outside of the scanned ones are looked
+// up in the DB, so partial syncs (--watch, --files-from) keep them.
+func (s *syncer) planPlaylists(jobs []syncJob, oldDB *syncDB) {
+	if !s.options.playlists {
+		return
+	}
+	targets := make(map[string]string)
+	for _, e := range oldDB.Entries {
+		if e.isOK() && e.TargetPath != "" && !isGroupedCommand(e.Command) && e.Command != playlistCommand {
+			targets[s.pathKey(e.SourcePath)] = e.TargetPath
+		}
+	}
+	for _, job := range jobs {
+		key := s.pathKey(job.relPath)
+		delete(targets, key)
+		if job.skipReason == "" && !job.archive && !job.playlist {
+			targets[key] = job.relTargetPath
+		}
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		if !job.playlist || job.skipReason != "" {
+			continue
+		}
+		job.playlistTargets = targets
+		if job.needsProcessing {
+			continue
+		}
+		content, err := s.translatePlaylist(*job)
+		if err != nil {
+			job.needsProcessing = true
+			job.reasonKind, job.reason = reasonPlaylistChanged, err.Error()
+			continue
+		}
+		current, err := os.ReadFile(job.targetFile)
+		switch {
+		case err != nil:
+			job.needsProcessing = true
+			job.reasonKind, job.reason = reasonTargetMissing, "target missing"
+		case !bytes.Equal(current, content):
+			job.needsProcessing = true
+			job.reasonKind, job.reason = reasonPlaylistChanged, "changed: playlist entries"
+		}
+	}
+}
+
+// translatePlaylist returns the playlist of job rewritten for the target:
+// every entry points at the target of the listed file, relative to the
+// playlist's place in the target. Entries of files that aren't synced are
+// dropped together with their #EXTINF line, URLs and other comments are kept
+// as they are.
+func (s *syncer) translatePlaylist(job syncJob) ([]byte, error) {
+	data, err := os.ReadFile(job.sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	// Keep a byte order mark, some players need it to read .m3u8 as UTF-8.
+	bom := []byte("\ufeff")
+	hasBOM := bytes.HasPrefix(data, bom)
+	data = bytes.TrimPrefix(data, bom)
+	newline := "\n"
+	if bytes.Contains(data, []byte("\r\n")) {
+		newline = "\r\n"
+	}
+	sourceDir := filepath.Dir(job.relPath)
+	targetDir := filepath.Dir(job.relTargetPath)
+
+	var out []string
+	var extinf []string
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\r\n"), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		entry := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(entry, "#EXTINF"):
+			extinf = append(extinf, line)
+		case entry == "" || strings.HasPrefix(entry, "#"):
+			out = append(out, line)
+		default:
+			if translated, ok := s.translatePlaylistEntry(entry, sourceDir, targetDir, job.playlistTargets); ok {
+				out = append(append(out, extinf...), translated)
+			}
+			extinf = nil
+		}
+	}
+	content := []byte(strings.Join(out, newline) + newline)
+	if hasBOM {
+		content = append(bom, content...)
+	}
+	return content, nil
+}
+
+// translatePlaylistEntry returns the path entry of a playlist in sourceDir
+// should have in the copy in targetDir (both relative to their roots), or
+// false if it doesn't point at a synced file. Windows separators and file://
+// URLs are understood, other URLs are kept.
+func (s *syncer) translatePlaylistEntry(entry, sourceDir, targetDir string, targets map[string]string) (string, bool) {
+	if !strings.HasPrefix(entry, "file://") && strings.Contains(entry, "://") {
+		return entry, true
+	}
+	rel, ok := s.playlistEntrySource(entry, filepath.Join(s.options.sourceDir, sourceDir))
+	if !ok {
+		return "", false
+	}
+	target, ok := targets[s.pathKey(rel)]
+	if !ok {
+		return "", false
+	}
+	return s.playlistEntryPath(target, targetDir)
+}
+
+// playlistEntrySource returns the path (relative to the source) of the file
+// a path entry of a playlist in dir points at, or false if it is a URL or
+// outside the source.
+func (s *syncer) playlistEntrySource(entry, dir string) (string, bool) {
+	if strings.HasPrefix(entry, "file://") {
+		u, err := url.Parse(entry)
+		if err != nil {
+			return "", false
+		}
+		entry = u.Path
+	} else if strings.Contains(entry, "://") {
+		return "", false
+	}
+	path := filepath.FromSlash(strings.ReplaceAll(entry, `\`, "/"))
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	rel, err := filepath.Rel(s.options.sourceDir, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", false
+	}
+	return rel, true
+}
+
+// playlistEntryPath returns how a playlist in targetDir refers to target
+// (both relative to the target): relative to the playlist, or with
+// --playlist-paths absolute below --playlist-root, for head units that only
+// understand absolute paths. --playlist-separator picks the separator.
+func (s *syncer) playlistEntryPath(target, targetDir string) (string, bool) {
+	var entry string
+	if s.options.playlistPaths == playlistPathsAbsolute {
+		root := strings.TrimSuffix(strings.ReplaceAll(s.options.playlistRoot, `\`, "/"), "/")
+		entry = root + "/" + filepath.ToSlash(target)
+	} else {
+		rel, err := filepath.Rel(targetDir, target)
+		if err != nil {
+			return "", false
+		}
+		entry = filepath.ToSlash(rel)
+	}
+	if s.options.playlistSeparator == playlistSeparatorBackslash {
+		entry = strings.ReplaceAll(entry, "/", `\`)
+	}
+	return entry, true
+}
+
+// writePlaylist writes the translated playlist of job to the target.
+func (s *syncer) writePlaylist(job syncJob) error {
+	content, err := s.translatePlaylist(job)
+	if err != nil {
+		return err
+	}
+	if err := s.checkTargetPath(job.targetFile); err != nil {
+		return err
+	}
+	return s.perms.writeAtomically(job.targetFile, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// encodingPreset is a named audio pipeline for --preset: a command template
+// and the extension of its output.
+type encodingPreset struct {
+	ext     string
+	command string
+}
+
+// presets are the built-in --preset pipelines. They keep the tags and drop
+// embedded cover art, which some players choke on in these containers; the
+// album's cover images are synced as separate files anyway.
+var presets = map[string]encodingPreset{
+	"opus-96":  {"opus", "ffmpeg -nostdin -loglevel error -i $INPUT -map 0:a -map_metadata 0 -c:a libopus -b:a 96k -vbr on -y $OUTPUT"},
+	"opus-128": {"opus", "ffmpeg -nostdin -loglevel error -i $INPUT -map 0:a -map_metadata 0 -c:a libopus -b:a 128k -vbr on -y $OUTPUT"},
+	"opus-192": {"opus", "ffmpeg -nostdin -loglevel error -i $INPUT -map 0:a -map_metadata 0 -c:a libopus -b:a 192k -vbr on -y $OUTPUT"},
+	"aac-256":  {"m4a", "ffmpeg -nostdin -loglevel error -i $INPUT -map 0:a -map_metadata 0 -c:a aac -b:a 256k -movflags +faststart -y $OUTPUT"},
+	"mp3-v0":   {"mp3", "ffmpeg -nostdin -loglevel error -i $INPUT -map 0:a -map_metadata 0 -c:a libmp3lame -q:a 0 -id3v2_version 3 -y $OUTPUT"},
+	"mp3-320":  {"mp3", "ffmpeg -nostdin -loglevel error -i $INPUT -map 0:a -map_metadata 0 -c:a libmp3lame -b:a 320k -id3v2_version 3 -y $OUTPUT"},
+}
+
+// presetNames returns the names of the presets, sorted.
+func presetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyPreset sets the audio command and target extension from the named
+// preset, except for the ones given explicitly (on the command line or in
+// the config file).
+func (s *syncer) applyPreset(name string, commandSet, extSet bool) error {
+	preset, ok := presets[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown preset %q, use one of %s", name, strings.Join(presetNames(), ", "))
+	}
+	if !commandSet {
+		s.options.ffmpegAudioCommand = preset.command
+	}
+	if !extSet {
+		s.options.targetAudioExtension = preset.ext
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// previewExt is the extension of --preview clips, which are always Opus.
+const previewExt = "opus"
+
+// previewCommand returns the audio command template for --preview: a clip
+// of duration starting at start into the track, loudness normalized so
+// clips of different masters play at a similar volume, as low bitrate Opus.
+// Tags are kept, cover art is dropped to keep the clips small.
+func previewCommand(start, duration time.Duration, bitrate string) string {
+	cmd := "ffmpeg -nostdin -loglevel error"
+	if start > 0 {
+		cmd += fmt.Sprintf(" -ss %.3f", start.Seconds())
+	}
+	return cmd + fmt.Sprintf(" -i $INPUT -t %.3f -vn -map_metadata 0 -af loudnorm -c:a libopus -b:a %s $OUTPUT",
+		duration.Seconds(), bitrate)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fsCaps describes the quirks of the target filesystem as found by probing.
+type fsCaps struct {
+	caseSensitive bool
+	// maxNameLength is the longest file name, counted in nameUnit.
+	maxNameLength int
+	nameUnit      string
+	invalidChars  string
+	symlinks      bool
+	// mtimeResolution is how precisely the target stores modification
+	// times, for comparing the times of targets with those of sources.
+	mtimeResolution time.Duration
+	// maxFileSize is 0 if there is no known limit.
+	maxFileSize int64
+}
+
+// probeChars are the characters that are commonly invalid on non-POSIX
+// filesystems.
+const probeChars = `?:*"<>|\`
+
+// probeTarget finds out the capabilities of the filesystem dir lives on by
+// creating (and removing) a few harmless test files. The test files use the
+// temporary file prefix, so they get cleaned up even if we crash here.
+func probeTarget(dir string) (fsCaps, error) {
+	caps := fsCaps{mtimeResolution: time.Nanosecond}
+	probe := func(name string) string {
+		return filepath.Join(dir, tempPrefix+"probe-"+name)
+	}
+	create := func(path string) bool {
+		f, err := os.Create(path)
+		if err != nil {
+			return false
+		}
+		f.Close()
+		return true
+	}
+
+	base := probe("case")
+	if !create(base) {
+		return caps, fmt.Errorf("target is not writable")
+	}
+	defer os.Remove(base)
+	_, err := os.Stat(probe("CASE"))
+	caps.caseSensitive = err != nil
+
+	// Find the longest file name the filesystem accepts, in bytes.
+	lo, hi := len(filepath.Base(probe(""))), 1024
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		path := probe(strings.Repeat("x", mid-len(filepath.Base(probe("")))))
+		if create(path) {
+			os.Remove(path)
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	caps.maxNameLength, caps.nameUnit = lo, nameUnitBytes
+
+	// A name of that many two-byte characters is too long in bytes, but
+	// fits if the filesystem counts UTF-16 units (or characters).
+	prefix := len(filepath.Base(probe("")))
+	if lo > prefix {
+		path := probe(strings.Repeat("é", lo-prefix))
+		if create(path) {
+			os.Remove(path)
+			caps.nameUnit = nameUnitUTF16
+		}
+	}
+
+	for _, c := range probeChars {
+		path := probe("char" + string(c))
+		if create(path) && fileExists(path) {
+			os.Remove(path)
+		} else {
+			caps.invalidChars += string(c)
+		}
+	}
+
+	link := probe("link")
+	if os.Symlink(base, link) == nil {
+		caps.symlinks = true
+		os.Remove(link)
+	}
+
+	// Set an odd number of seconds with a fractional part and see what is
+	// left after reading it back.
+	want := time.Date(2001, 1, 1, 0, 0, 1, 123456789, time.UTC)
+	if os.Chtimes(base, want, want) == nil {
+		if info, err := os.Stat(base); err == nil {
+			got := info.ModTime().UTC()
+			switch {
+			case got.Equal(want):
+				caps.mtimeResolution = time.Nanosecond
+			case got.Second()%2 == 0:
+				caps.mtimeResolution = 2 * time.Second
+			case got.Nanosecond() == 0:
+				caps.mtimeResolution = time.Second
+			default:
+				caps.mtimeResolution = time.Microsecond
+			}
+		}
+	}
+
+	caps.maxFileSize = fsMaxFileSize(dir)
+	return caps, nil
+}
+
+func (c fsCaps) String() string {
+	var parts []string
+	if c.caseSensitive {
+		parts = append(parts, "case-sensitive")
+	} else {
+		parts = append(parts, "case-insensitive")
+	}
+	parts = append(parts, fmt.Sprintf("max name %d %s", c.maxNameLength, c.nameUnit))
+	if c.invalidChars != "" {
+		parts = append(parts, fmt.Sprintf("invalid characters %s", c.invalidChars))
+	}
+	if !c.symlinks {
+		parts = append(parts, "no symlinks")
+	}
+	parts = append(parts, fmt.Sprintf("%s timestamps", c.mtimeResolution))
+	if c.maxFileSize > 0 {
+		parts = append(parts, fmt.Sprintf("max file size %d bytes", c.maxFileSize))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// applyTargetCaps enables the limits matching the probed filesystem for every
+// option the user didn't set explicitly.
+func (s *syncer) applyTargetCaps(caps fsCaps, isSet func(name string) bool) {
+	if s.targetFSPreset != nil {
+		caps.maxNameLength, caps.nameUnit = s.targetFSPreset.maxName, s.targetFSPreset.unit
+	}
+	s.targetCaps = caps
+	if caps.invalidChars != "" && !isSet("fat-safe-names") {
+		s.options.fatSafeNames = true
+	}
+	if caps.maxFileSize > 0 && !isSet("max-file-size") {
+		s.options.maxFileSize = caps.maxFileSize
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "syscall"
+
+// Filesystem magic numbers from statfs(2).
+const (
+	msdosSuperMagic = 0x4d44
+)
+
+// fsMaxFileSize returns the maximum file size of the filesystem dir is on, or
+// 0 if it is unknown or practically unlimited.
+func fsMaxFileSize(dir string) int64 {
+	var st syscall.Statfs_t
+	if syscall.Statfs(dir, &st) != nil {
+		return 0
+	}
+	if st.Type == msdosSuperMagic {
+		return 1<<32 - 1
+	}
+	return 0
+}
+
+// fsSpace returns the size of the filesystem dir is on and the space left
+// on it for unprivileged users, in bytes.
+func fsSpace(dir string) (total, free int64, ok bool) {
+	var st syscall.Statfs_t
+	if syscall.Statfs(dir, &st) != nil {
+		return 0, 0, false
+	}
+	return int64(st.Blocks) * int64(st.Bsize), int64(st.Bavail) * int64(st.Bsize), true
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+// fsMaxFileSize returns the maximum file size of the filesystem dir is on, or
+// 0 if it is unknown or practically unlimited.
+func fsMaxFileSize(dir string) int64 {
+	return 0
+}
+
+// fsSpace returns the size of the filesystem dir is on and the space left
+// on it for unprivileged users, in bytes.
+func fsSpace(dir string) (total, free int64, ok bool) {
+	return 0, 0, false
+}
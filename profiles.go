@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// profilesKey is the config file key of the named device profiles, each a
+// table of options applied with --profile NAME:
+//
+//	source = "/music"
+//
+//	[profiles.phone]
+//	target = "/mnt/phone/Music"
+//	preset = "opus-96"
+//	exclude = ["^Audiobooks/"]
+//
+//	[profiles.car]
+//	target = "/media/usb"
+//	preset = "mp3-320"
+//	fat-safe-names = true
+const profilesKey = "profiles"
+
+// parseProfiles takes the profiles out of the values of a config file.
+func parseProfiles(values map[string]any) (map[string]map[string]any, error) {
+	raw, ok := values[profilesKey]
+	if !ok {
+		return nil, nil
+	}
+	delete(values, profilesKey)
+	tables, ok := toStringMap(raw)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a table of profiles", profilesKey)
+	}
+	profiles := make(map[string]map[string]any, len(tables))
+	for name, item := range tables {
+		table, ok := toStringMap(item)
+		if !ok {
+			return nil, fmt.Errorf("profile %q must be a table", name)
+		}
+		for key := range table {
+			if key == targetsKey || commandLineOnlyFlags[key] {
+				return nil, fmt.Errorf("profile %q: option %q can't be set in a profile", name, key)
+			}
+		}
+		profiles[name] = table
+	}
+	return profiles, nil
+}
+
+// profileNames returns the names of the profiles, sorted.
+func profileNames(profiles map[string]map[string]any) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectProfile merges the values of the profile called name over the
+// common values of the config file.
+func selectProfile(profiles map[string]map[string]any, name string, values map[string]any) error {
+	profile, ok := profiles[name]
+	if !ok {
+		if len(profiles) == 0 {
+			return fmt.Errorf("--profile needs profiles in the config file")
+		}
+		return fmt.Errorf("no profile called %q, the config has %s", name, strings.Join(profileNames(profiles), ", "))
+	}
+	for key, v := range profile {
+		values[key] = v
+	}
+	return nil
+}
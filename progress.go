@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// progressTracker keeps track of how much of the planned work has been done.
+// Work is weighted per job rather than counted per file, so that a two hour
+// live recording moves the progress (and ETA) a lot more than a short skit.
+//
+// When stdout is a terminal, it also keeps a status line at the bottom with
+// a progress bar, the file count, throughput, ETA and the file being
+// processed. Otherwise only the per-file lines are printed.
+type progressTracker struct {
+	mu          sync.Mutex
+	totalWeight int64
+	doneWeight  int64
+	totalFiles  int
+	doneFiles   int
+	start       time.Time
+	running     []string
+
+	bar  bool
+	stop chan struct{}
+
+	// events, if set, gets the progress as it happens, with mu held.
+	events *syncEvents
+}
+
+// syncEvents are the callbacks a run reports its progress to, for programs
+// driving it (like a GUI) rather than people reading the output. Any of
+// them may be nil. They are called one at a time, from the goroutines
+// running the jobs, so they should return quickly.
+type syncEvents struct {
+	// Start is called before the first job runs.
+	Start func(p syncProgress)
+	// Begin is called when the file at path (relative to the source)
+	// starts processing.
+	Begin func(path string, p syncProgress)
+	// Done is called when the file at path was processed, with why it
+	// failed if it did.
+	Done func(path string, err error, p syncProgress)
+	// Log is called with every line of output about the files.
+	Log func(line string, p syncProgress)
+	// End is called once all jobs ran, or the run was interrupted.
+	End func(p syncProgress)
+	// ConfirmMassChange is asked whether to go on with a run that would
+	// process more files than --max-changes allows, before any are.
+	// Without it, such a run fails with errTooManyChanges.
+	ConfirmMassChange func(files, limit int) bool
+}
+
+// syncProgress is how far the jobs of a run got.
+type syncProgress struct {
+	DoneFiles int
+	Files     int
+	Percent   float64
+	ETA       time.Duration
+}
+
+// progressEvent is a syncEvents callback as a JSON line of --progress-json.
+// Event is the name of the callback in lower case.
+type progressEvent struct {
+	Event     string  `json:"event"`
+	Path      string  `json:"path,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	Message   string  `json:"message,omitempty"`
+	DoneFiles int     `json:"done_files"`
+	Files     int     `json:"files"`
+	Percent   float64 `json:"percent"`
+	ETA       float64 `json:"eta_seconds"`
+}
+
+func (s *syncer) newProgressTracker(jobs []syncJob) *progressTracker {
+	p := &progressTracker{start: time.Now()}
+	for _, job := range jobs {
+		if job.needsProcessing || job.needsThumbnail || job.needsCue {
+			p.totalWeight += jobWeight(job)
+			p.totalFiles++
+		}
+	}
+	p.events = s.events
+	return p
+}
+
+// progressJSONEvents returns the callbacks that write the events to enc as
+// JSON lines, for --progress-json.
+func progressJSONEvents(enc *json.Encoder) *syncEvents {
+	return progressEvents(func(e progressEvent) { enc.Encode(e) })
+}
+
+// progressEvents returns the callbacks that pass the events to emit as
+// progressEvents.
+func progressEvents(emit func(e progressEvent)) *syncEvents {
+	write := func(e progressEvent, p syncProgress) {
+		e.DoneFiles, e.Files = p.DoneFiles, p.Files
+		e.Percent, e.ETA = p.Percent, p.ETA.Seconds()
+		emit(e)
+	}
+	return &syncEvents{
+		Start: func(p syncProgress) { write(progressEvent{Event: "start"}, p) },
+		Begin: func(path string, p syncProgress) { write(progressEvent{Event: "begin", Path: path}, p) },
+		Done: func(path string, err error, p syncProgress) {
+			e := progressEvent{Event: "done", Path: path}
+			if err != nil {
+				e.Error = err.Error()
+			}
+			write(e, p)
+		},
+		Log: func(line string, p syncProgress) { write(progressEvent{Event: "log", Message: line}, p) },
+		End: func(p syncProgress) { write(progressEvent{Event: "end"}, p) },
+	}
+}
+
+// progress returns how far the jobs got. The caller holds mu.
+func (p *progressTracker) progress() syncProgress {
+	return syncProgress{DoneFiles: p.doneFiles, Files: p.totalFiles, Percent: p.percent(), ETA: p.eta()}
+}
+
+// jobWeight returns how expensive a job is expected to be relative to others.
+// The source size is used as a proxy for the duration of the file.
+func jobWeight(job syncJob) int64 {
+	if job.sourceInfo == nil || job.sourceInfo.Size() <= 0 {
+		return 1
+	}
+	return job.sourceInfo.Size()
+}
+
+// StartBar shows the status line if stdout is a terminal and keeps it
+// updated until StopBar is called.
+func (p *progressTracker) StartBar() {
+	if p.events != nil && p.events.Start != nil {
+		p.mu.Lock()
+		p.events.Start(p.progress())
+		p.mu.Unlock()
+	}
+	if !isTerminal(os.Stdout) || p.totalFiles == 0 {
+		return
+	}
+	p.bar = true
+	p.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.mu.Lock()
+				p.drawBar()
+				p.mu.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopBar removes the status line.
+func (p *progressTracker) StopBar() {
+	if p.events != nil && p.events.End != nil {
+		p.mu.Lock()
+		p.events.End(p.progress())
+		p.mu.Unlock()
+	}
+	if !p.bar {
+		return
+	}
+	close(p.stop)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bar = false
+	fmt.Print("\r\033[K")
+}
+
+// Begin marks a job as being processed.
+func (p *progressTracker) Begin(job syncJob) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running = append(p.running, job.relPath)
+	if p.events != nil && p.events.Begin != nil {
+		p.events.Begin(job.relPath, p.progress())
+	}
+	p.drawBar()
+}
+
+// Advance marks a job as done, err is why it failed.
+func (p *progressTracker) Advance(job syncJob, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.doneWeight += jobWeight(job)
+	p.doneFiles++
+	for i, rel := range p.running {
+		if rel == job.relPath {
+			p.running = append(p.running[:i], p.running[i+1:]...)
+			break
+		}
+	}
+	if p.events != nil && p.events.Done != nil {
+		p.events.Done(job.relPath, err, p.progress())
+	}
+}
+
+// Logf prints a line above the status line.
+func (p *progressTracker) Logf(format string, args ...any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bar {
+		fmt.Print("\r\033[K")
+	}
+	fmt.Printf(format, args...)
+	if p.events != nil && p.events.Log != nil {
+		p.events.Log(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"), p.progress())
+	}
+	p.drawBar()
+}
+
+// percent returns the weighted completion percentage.
+func (p *progressTracker) percent() float64 {
+	if p.totalWeight == 0 {
+		return 100
+	}
+	return float64(p.doneWeight) / float64(p.totalWeight) * 100
+}
+
+// eta estimates the remaining time based on the weighted throughput so far.
+func (p *progressTracker) eta() time.Duration {
+	if p.doneWeight == 0 {
+		return 0
+	}
+	elapsed := time.Since(p.start)
+	remaining := p.totalWeight - p.doneWeight
+	return time.Duration(float64(elapsed) / float64(p.doneWeight) * float64(remaining)).Round(time.Second)
+}
+
+// drawBar redraws the status line. The cursor is left at the start of the
+// line, so output we don't control overwrites the bar instead of being
+// appended to it.
+func (p *progressTracker) drawBar() {
+	if !p.bar {
+		return
+	}
+	width, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width < 40 {
+		width = 80
+	}
+
+	const barWidth = 20
+	filled := int(p.percent() / 100 * barWidth)
+	rate := float64(p.doneWeight) / time.Since(p.start).Seconds() / (1 << 20)
+	line := fmt.Sprintf("[%s%s] %d/%d files %5.1f%% %.1f MB/s ETA %s",
+		strings.Repeat("#", filled), strings.Repeat(".", barWidth-filled),
+		p.doneFiles, p.totalFiles, p.percent(), rate, p.eta())
+	if len(p.running) > 0 {
+		line += " " + p.running[0]
+		if len(p.running) > 1 {
+			line += fmt.Sprintf(" (+%d)", len(p.running)-1)
+		}
+	}
+	if runes := []rune(line); len(runes) > width-1 {
+		line = string(runes[:width-1])
+	}
+	fmt.Printf("\r\033[K%s\r", line)
+}
+
+func (p *progressTracker) String() string {
+	return fmt.Sprintf("[%5.1f%%, ETA %s]", p.percent(), p.eta())
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ratingEntry is the selection info for a file or directory from the external
+// ratings file.
+type ratingEntry struct {
+	Rating  float64 `json:"rating"`
+	Include *bool   `json:"include,omitempty"`
+}
+
+// loadRatings reads a ratings file. JSON files map relative paths to either a
+// number (the rating), a boolean (include or not) or an object with "rating"
+// and "include" fields. CSV files have a path column and a rating or
+// true/false column, with an optional header line.
+func (s *syncer) loadRatings(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	s.ratings = make(map[string]ratingEntry)
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return s.parseRatingsCSV(string(data))
+	}
+	return s.parseRatingsJSON(data)
+}
+
+func (s *syncer) parseRatingsJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for p, v := range raw {
+		var entry ratingEntry
+		var b bool
+		var n float64
+		switch {
+		case json.Unmarshal(v, &n) == nil:
+			entry.Rating = n
+		case json.Unmarshal(v, &b) == nil:
+			entry.Include = &b
+		default:
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("invalid entry for %q: %v", p, err)
+			}
+		}
+		s.ratings[filepath.Clean(filepath.FromSlash(p))] = entry
+	}
+	return nil
+}
+
+func (s *syncer) parseRatingsCSV(data string) error {
+	r := csv.NewReader(strings.NewReader(data))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return err
+	}
+	for i, rec := range records {
+		if len(rec) < 2 {
+			return fmt.Errorf("line %d: expected path and rating", i+1)
+		}
+		value := strings.TrimSpace(rec[1])
+		var entry ratingEntry
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			entry.Rating = n
+		} else if b, err := strconv.ParseBool(value); err == nil {
+			entry.Include = &b
+		} else if i == 0 {
+			continue // header
+		} else {
+			return fmt.Errorf("line %d: invalid rating %q", i+1, value)
+		}
+		s.ratings[filepath.Clean(filepath.FromSlash(strings.TrimSpace(rec[0])))] = entry
+	}
+	return nil
+}
+
+// lookupRating finds the entry for a path, falling back to the closest parent
+// directory that has one.
+func (s *syncer) lookupRating(relPath string) (ratingEntry, bool) {
+	for p := relPath; p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+		if e, ok := s.ratings[p]; ok {
+			return e, true
+		}
+	}
+	return ratingEntry{}, false
+}
+
+// ratingIncludes reports whether the ratings file selects a file.
+func (s *syncer) ratingIncludes(relPath string) bool {
+	e, ok := s.lookupRating(relPath)
+	if ok && e.Include != nil {
+		return *e.Include
+	}
+	return e.Rating >= s.options.minRating
+}
+
+// applyRatings filters the jobs by the ratings file. Images and sidecar files
+// without their own entry are kept as long as an audio file in the same
+// directory is selected, so album art follows the music. Playlists without their own entry are
+// always kept.
+func (s *syncer) applyRatings(jobs []syncJob) {
+	if s.ratings == nil {
+		return
+	}
+
+	selectedDirs := make(map[string]bool)
+	for _, job := range jobs {
+		if !job.isImage && !job.playlist && !job.sidecar && s.ratingIncludes(job.relPath) {
+			selectedDirs[filepath.Dir(job.relPath)] = true
+		}
+	}
+
+	for i := range jobs {
+		job := &jobs[i]
+		if job.skipReason != "" {
+			continue
+		}
+		include := s.ratingIncludes(job.relPath)
+		if _, ok := s.ratings[job.relPath]; !ok {
+			if job.isImage || job.sidecar {
+				include = selectedDirs[filepath.Dir(job.relPath)]
+			} else if job.playlist {
+				// The playlist only lists what is selected anyway.
+				include = true
+			}
+		}
+		if !include {
+			job.skipReason, job.filtered = "not selected", true
+		}
+	}
+}
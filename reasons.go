@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Kinds of reasons for processing a file, for --only-reason and
+// --skip-reason.
+const (
+	reasonNew               = "new"
+	reasonSourceChanged     = "source-changed"
+	reasonCommandChanged    = "command-changed"
+	reasonTargetPathChanged = "target-path-changed"
+	reasonRetry             = "retry"
+	reasonTargetMissing     = "target-missing"
+	reasonRefreshArt        = "refresh-art"
+	reasonArchiveChanged    = "archive-changed"
+	reasonPlaylistChanged   = "playlist-changed"
+	reasonMoved             = "moved"
+	reasonForced            = "forced"
+)
+
+var reasonKinds = []string{
+	reasonNew, reasonSourceChanged, reasonCommandChanged, reasonTargetPathChanged, reasonRetry,
+	reasonTargetMissing, reasonRefreshArt, reasonArchiveChanged, reasonPlaylistChanged, reasonMoved,
+	reasonForced,
+}
+
+// checkReasonKinds returns an error if one of kinds is not a reason kind.
+func checkReasonKinds(kinds []string) error {
+	for _, kind := range kinds {
+		if !slices.Contains(reasonKinds, kind) {
+			return fmt.Errorf("unknown reason %q, use one of %s", kind, strings.Join(reasonKinds, ", "))
+		}
+	}
+	return nil
+}
+
+// processReason returns the kind of reason a job needs processing for and a
+// description for the output of plan and diff, or "" if it doesn't.
+func (s *syncer) processReason(job syncJob) (string, string) {
+	e := job.existingEntry
+	switch {
+	case !job.needsProcessing:
+		return "", ""
+	case e == nil:
+		return reasonNew, "new"
+	case e.Size != job.sourceInfo.Size():
+		return reasonSourceChanged, fmt.Sprintf("changed: size %d→%d", e.Size, job.sourceInfo.Size())
+	case s.sourceChanged(job) && job.sourceHash != "" && e.SourceHash != "":
+		return reasonSourceChanged, "changed: content"
+	case s.sourceChanged(job):
+		return reasonSourceChanged, "changed: modification time"
+	case e.Command != job.command:
+		return reasonCommandChanged, "changed: command"
+	case e.TargetPath != job.relTargetPath:
+		return reasonTargetPathChanged, "changed: target path, was " + e.TargetPath
+	case !e.isOK():
+		return reasonRetry, "retry: " + e.Status
+	case !fileExists(job.targetFile):
+		return reasonTargetMissing, "target missing"
+	case s.refreshArt(job):
+		return reasonRefreshArt, "--refresh-art"
+	case s.forced(job):
+		return reasonForced, "forced"
+	}
+	return "", ""
+}
+
+// deferByReason leaves the jobs whose reason for processing is excluded by
+// --only-reason or --skip-reason for a later run: they are skipped and keep
+// their DB entry (and target) as they are, so the next run sees the same
+// change again.
+func (s *syncer) deferByReason(jobs []syncJob) {
+	if len(s.options.onlyReasons) == 0 && len(s.options.skipReasons) == 0 {
+		return
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		if !job.needsProcessing || job.reasonKind == "" {
+			continue
+		}
+		if len(s.options.onlyReasons) > 0 && !slices.Contains(s.options.onlyReasons, job.reasonKind) ||
+			slices.Contains(s.options.skipReasons, job.reasonKind) {
+			job.needsProcessing, job.deferred = false, true
+			job.skipReason = "deferred: " + job.reasonKind
+		}
+	}
+}
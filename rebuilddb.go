@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// runRebuildDB replaces the DB with one reconstructed from the target, for
+// when .syncdb.json was lost or corrupted and the next sync would otherwise
+// convert everything again. Every source is paired with the file in the
+// target it maps to (or one with the same path apart from case and
+// extension, see findTargetByStem), and the pair is recorded as up to date
+// with the current command if the target looks sane: not empty, not older
+// than its source, and for audio one that ffprobe can read an audio stream
+// with a duration from. Sources without a sane target are left out and
+// converted by the next sync. Archives and playlists are cheap to redo and
+// left out as well. The DB being replaced is kept as a snapshot.
+func (s *syncer) runRebuildDB() {
+	if s.targetKey != nil {
+		fmt.Println("rebuild-db can't check encrypted targets.")
+		exit(1)
+	}
+	// The target paths and timestamps have to be judged the way the sync
+	// that wrote them did.
+	if err := s.probeTargetFS(); err != nil {
+		fmt.Println("Error:", err)
+		exit(1)
+	}
+	s.options.quietPlan = true
+	jobs, err := s.planJobs(&syncDB{})
+	if err != nil {
+		fmt.Println("Error during planning:", err)
+		exit(1)
+	}
+
+	var newDB syncDB
+	missing, rejected := 0, 0
+	for _, job := range jobs {
+		if job.skipReason != "" || job.archive || job.playlist {
+			continue
+		}
+		adopted := false
+		if !fileExists(job.targetFile) {
+			rel, ok := s.findTargetByStem(job)
+			if !ok {
+				missing++
+				continue
+			}
+			job.relTargetPath, adopted = rel, true
+		}
+		if err := s.checkRebuiltTarget(job); err != nil {
+			fmt.Printf("Leaving out %s: %v\n", job.relPath, err)
+			rejected++
+			continue
+		}
+		e := job.entry(statusOK)
+		e.Adopted = adopted
+		newDB.Entries = append(newDB.Entries, e)
+	}
+
+	dbPath := s.syncDBPath()
+	if err := s.snapshotDB(dbPath, s.options.dbSnapshots); err != nil {
+		fmt.Println("Error creating DB snapshot:", err)
+	}
+	s.saveDB(&newDB, dbPath)
+	fmt.Printf("Rebuilt the DB with %d entries, %d sources have no target and %d were left out.\n", len(newDB.Entries), missing, rejected)
+}
+
+// checkRebuiltTarget reports why the target paired with job by rebuild-db
+// can't be trusted to be a finished conversion of its source.
+func (s *syncer) checkRebuiltTarget(job syncJob) error {
+	path := filepath.Join(s.options.targetDir, job.relTargetPath)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("target is empty")
+	}
+	// The target may have stored its time rounded down, e.g. to 2s on FAT.
+	if info.ModTime().Add(s.targetCaps.mtimeResolution).Before(job.sourceInfo.ModTime()) {
+		return fmt.Errorf("target is older than the source")
+	}
+	if job.isImage || job.sidecar {
+		return nil
+	}
+	audio, err := s.probeAudio(path)
+	if err != nil {
+		return err
+	}
+	if audio.Duration <= 0 {
+		return fmt.Errorf("target has no duration, it may be truncated")
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// albumChange counts what happened to the files of a single album directory
+// (usually Artist/Album) during a run.
+type albumChange struct {
+	album   string
+	added   int
+	updated int
+	removed int
+	// existed and remains tell whether the album was in the DB before and
+	// after the run, which is what decides if it counts as added or removed.
+	existed bool
+	remains bool
+}
+
+// syncSummary groups the changes of a run by album.
+type syncSummary struct {
+	albums  map[string]*albumChange
+	skipped []syncJob
+	failed  []SyncDBEntry
+	// collator sorts the albums, see --sort-locale.
+	collator *nameCollator
+}
+
+// exitPartialFailure is the exit status of a run that completed, but
+// couldn't process some files.
+const exitPartialFailure = 3
+
+// albumOf returns the album key for a relative source path.
+func albumOf(relPath string) string {
+	return filepath.Dir(relPath)
+}
+
+func (s *syncer) buildSummary(oldDB, newDB *syncDB, jobs []syncJob) *syncSummary {
+	sum := &syncSummary{albums: make(map[string]*albumChange), collator: s.pathCollator}
+	get := func(relPath string) *albumChange {
+		album := albumOf(relPath)
+		a, ok := sum.albums[s.pathKey(album)]
+		if !ok {
+			a = &albumChange{album: album}
+			sum.albums[s.pathKey(album)] = a
+		}
+		return a
+	}
+
+	current := make(map[string]bool)
+	failed := make(map[string]bool)
+	for _, e := range newDB.Entries {
+		// Files quarantined by this run failed in it, those quarantined
+		// before weren't tried.
+		if e.Status == statusQuarantined {
+			if old := oldDB.find(s.pathKey, e.SourcePath); old == nil || old.Status != statusQuarantined {
+				sum.failed = append(sum.failed, e)
+			}
+		}
+		if e.Status == statusFailed {
+			sum.failed = append(sum.failed, e)
+		}
+		if e.failed() {
+			// The file is still in the source, but its target wasn't
+			// written. Only a target of an earlier run keeps the album.
+			current[s.pathKey(e.SourcePath)] = true
+			failed[s.pathKey(e.SourcePath)] = true
+			if old := oldDB.find(s.pathKey, e.SourcePath); old != nil && old.hasTarget() && !old.failed() {
+				get(e.SourcePath).remains = true
+			}
+			continue
+		}
+		if e.hasTarget() {
+			current[s.pathKey(e.SourcePath)] = true
+			get(e.SourcePath).remains = true
+		}
+	}
+	for _, job := range jobs {
+		if job.skipReason != "" && !job.filtered {
+			current[s.pathKey(job.relPath)] = true
+		}
+	}
+	for _, e := range oldDB.Entries {
+		if !e.hasTarget() || e.failed() {
+			continue
+		}
+		a := get(e.SourcePath)
+		a.existed = true
+		if !current[s.pathKey(e.SourcePath)] {
+			a.removed++
+		}
+	}
+	for _, job := range jobs {
+		if job.skipReason != "" {
+			if !job.filtered {
+				sum.skipped = append(sum.skipped, job)
+			}
+			continue
+		}
+		if !job.needsProcessing || failed[s.pathKey(job.relPath)] {
+			continue
+		}
+		if e := job.existingEntry; e == nil || !e.hasTarget() || e.failed() {
+			get(job.relPath).added++
+		} else {
+			get(job.relPath).updated++
+		}
+	}
+	return sum
+}
+
+func (s *syncSummary) sorted(filter func(a *albumChange) bool) []*albumChange {
+	var out []*albumChange
+	for _, a := range s.albums {
+		if filter(a) {
+			out = append(out, a)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return s.collator.Less(out[i].album, out[j].album) })
+	return out
+}
+
+// Print writes the per-album summary to stdout.
+func (s *syncSummary) Print() {
+	s.Write(os.Stdout)
+}
+
+// Write writes the per-album summary to w.
+func (s *syncSummary) Write(w io.Writer) {
+	added := s.sorted(func(a *albumChange) bool { return !a.existed && a.remains })
+	removed := s.sorted(func(a *albumChange) bool { return a.existed && !a.remains })
+	updated := s.sorted(func(a *albumChange) bool {
+		return a.existed && a.remains && (a.added+a.updated+a.removed) > 0
+	})
+
+	fmt.Fprintf(w, "Summary: %d albums added, %d updated, %d removed\n", len(added), len(updated), len(removed))
+	writeAlbums(w, "Added", added)
+	writeAlbums(w, "Updated", updated)
+	writeAlbums(w, "Removed", removed)
+
+	if len(s.skipped) > 0 {
+		sort.Slice(s.skipped, func(i, j int) bool { return s.collator.Less(s.skipped[i].relPath, s.skipped[j].relPath) })
+		fmt.Fprintf(w, "Skipped %d files:\n", len(s.skipped))
+		for _, job := range s.skipped {
+			fmt.Fprintf(w, "  %s (%s)\n", job.relPath, job.skipReason)
+		}
+	}
+	if len(s.failed) > 0 {
+		sort.Slice(s.failed, func(i, j int) bool { return s.collator.Less(s.failed[i].SourcePath, s.failed[j].SourcePath) })
+		fmt.Fprintf(w, "Failed %d files:\n", len(s.failed))
+		for _, e := range s.failed {
+			if e.Status == statusQuarantined {
+				fmt.Fprintf(w, "  %s: %s (quarantined after %d attempts)\n", e.SourcePath, e.LastError, e.Attempts)
+			} else {
+				fmt.Fprintf(w, "  %s: %s\n", e.SourcePath, e.LastError)
+			}
+		}
+	}
+}
+
+// exitOnFailures ends a run that completed with failed files with
+// exitPartialFailure.
+func (s *syncSummary) exitOnFailures() {
+	if len(s.failed) > 0 {
+		fmt.Printf("Sync complete, but %d files failed.\n", len(s.failed))
+		exit(exitPartialFailure)
+	}
+}
+
+func writeAlbums(w io.Writer, title string, albums []*albumChange) {
+	if len(albums) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s:\n", title)
+	for _, a := range albums {
+		fmt.Fprintf(w, "  %s (%s)\n", a.album, a.describe())
+	}
+}
+
+func (a *albumChange) describe() string {
+	var parts []string
+	if a.added > 0 {
+		parts = append(parts, fmt.Sprintf("%d new", a.added))
+	}
+	if a.updated > 0 {
+		parts = append(parts, fmt.Sprintf("%d updated", a.updated))
+	}
+	if a.removed > 0 {
+		parts = append(parts, fmt.Sprintf("%d removed", a.removed))
+	}
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// runReport describes the outcome of a run: the error it failed with and the
+// per-album summary, which lists the failed files. newDB and jobs are nil if
+// the run failed before anything was processed. It also reports whether
+// anything failed.
+func (s *syncer) runReport(oldDB, newDB *syncDB, jobs []syncJob, runErr error) (string, bool) {
+	var body bytes.Buffer
+	failed := runErr != nil
+	if runErr != nil {
+		fmt.Fprintf(&body, "Error: %v\n\n", runErr)
+	}
+	if newDB == nil {
+		return body.String(), failed
+	}
+	summary := s.buildSummary(oldDB, newDB, jobs)
+	summary.Write(&body)
+	return body.String(), failed || len(summary.failed) > 0
+}
+
+// reportRunEnd sends the report of a finished run to everything configured
+// to receive it. Problems delivering it are printed but don't change the
+// outcome of the run.
+func (s *syncer) reportRunEnd(oldDB, newDB *syncDB, jobs []syncJob, runErr error) {
+	if s.options.smtpServer == "" && s.options.healthcheckURL == "" {
+		return
+	}
+	body, failed := s.runReport(oldDB, newDB, jobs, runErr)
+	s.pingHealthcheck(failed, body)
+	s.mailReport(failed, body)
+}
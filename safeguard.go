@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// errTooManyChanges is returned when a run would process more files than
+// --max-changes allows and that wasn't confirmed.
+var errTooManyChanges = errors.New("too many changes, not confirmed")
+
+// confirmMassChange checks the number of files that need processing against
+// --max-changes. A mass re-tag or a tweaked command template can easily touch
+// the whole library, so above the limit the run has to be confirmed (through
+// the ConfirmMassChange event, or with --yes) before anything is converted.
+// It returns false if the run should be aborted. With --batch-dirs,
+// confirmed carries the answer over the batches of the run, so it asks at
+// most once per run; it is nil for a run planned at once.
+func (s *syncer) confirmMassChange(jobs []syncJob, confirmed *bool) bool {
+	if s.options.maxChanges <= 0 || s.options.assumeYes || confirmed != nil && *confirmed {
+		return true
+	}
+	count := 0
+	for _, job := range jobs {
+		if job.needsProcessing && !job.metadataOnly {
+			count++
+		}
+	}
+	if count <= s.options.maxChanges {
+		return true
+	}
+
+	fmt.Printf("Mass change detected: %d files would be processed (limit %d).\n", count, s.options.maxChanges)
+	yes := s.events != nil && s.events.ConfirmMassChange != nil && s.events.ConfirmMassChange(count, s.options.maxChanges)
+	if confirmed != nil {
+		*confirmed = yes
+	}
+	return yes
+}
+
+// promptMassChange asks on the terminal whether to go on with a mass change,
+// for the ConfirmMassChange event of the command line. Without a terminal to
+// ask on, it refuses.
+func promptMassChange(files, limit int) bool {
+	if !isTerminal(os.Stdin) {
+		fmt.Println("Refusing to continue without confirmation, pass --yes to process them anyway.")
+		return false
+	}
+	fmt.Print("Continue? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// rateLimiter spaces out jobs so no more than a given number start per minute.
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute <= 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{interval: time.Minute / time.Duration(perMinute)}
+}
+
+// Wait blocks until the next job is allowed to start.
+func (r *rateLimiter) Wait() {
+	if r.interval == 0 {
+		return
+	}
+	if d := time.Until(r.next); d > 0 {
+		time.Sleep(d)
+	}
+	r.next = time.Now().Add(r.interval)
+}
+
+// deletableTypes returns the extensions (lower case, without the dot) of
+// the files --delete-removed may delete from the target without
+// --deep-clean: those the configuration writes, and those of the targets
+// the DBs record (passthrough copies, archives, audiobooks, ...). A DB lost
+// and rebuilt, or pointed at the wrong target, then can't take the user's
+// documents, photos or music in other formats with it, only files of the
+// types we write. The extensions of the sources don't count: an .mp3 the
+// configuration doesn't write may well be music put on the device by hand.
+func (s *syncer) deletableTypes(dbs ...*syncDB) map[string]bool {
+	written := []string{s.options.targetAudioExtension, s.options.targetImageExtension, checksumMD5, checksumFFP}
+	if s.options.playlists {
+		written = append(written, slices.Collect(maps.Keys(playlistExtensions))...)
+	}
+	if len(s.options.archives) != 0 {
+		written = append(written, extOf(archiveExt))
+	}
+	if len(s.options.audiobooks) != 0 {
+		written = append(written, s.options.audiobookFormat)
+	}
+	if s.options.cueSheets {
+		written = append(written, "cue")
+	}
+	if s.targetKey != nil {
+		written = append(written, extOf(encryptedExt))
+	}
+	types := make(map[string]bool)
+	for _, list := range [][]string{s.options.sidecarExtensions, written} {
+		for _, ext := range list {
+			if ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), ".")); ext != "" {
+				types[ext] = true
+			}
+		}
+	}
+	for _, db := range dbs {
+		if db == nil {
+			continue
+		}
+		for _, e := range db.Entries {
+			for _, rel := range []string{e.TargetPath, e.Thumbnail, e.Cue} {
+				if rel != "" {
+					types[extOf(rel)] = true
+				}
+			}
+		}
+	}
+	return types
+}
+
+// deletableType reports whether --delete-removed may delete an untracked
+// file at relPath in the target: with --deep-clean any file, otherwise only
+// those of the types.
+func (s *syncer) deletableType(relPath string, types map[string]bool) bool {
+	return s.options.deepClean || types[extOf(relPath)]
+}
+
+// reportKeptTypes tells about the untracked files --delete-removed left in
+// the target because of their type, by extension.
+func reportKeptTypes(kept map[string]int) {
+	if len(kept) == 0 {
+		return
+	}
+	var parts []string
+	total := 0
+	for ext, n := range kept {
+		total += n
+		if ext == "" {
+			ext = "no extension"
+		} else {
+			ext = "." + ext
+		}
+		parts = append(parts, fmt.Sprintf("%d %s", n, ext))
+	}
+	sort.Strings(parts)
+	fmt.Printf("Kept %d untracked files in the target that aren't of a type this sync writes (%s), pass --deep-clean to delete them too.\n", total, strings.Join(parts, ", "))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupDeleteTarget makes a target directory with the given files and a
+// syncer pointed at it, configured to write .opus and .jpg targets.
+func setupDeleteTarget(t *testing.T, files ...string) (*syncer, string) {
+	t.Helper()
+	dir := t.TempDir()
+	s := newSyncer()
+	s.options = optionsType{
+		sourceDir:             filepath.Join(t.TempDir(), "source"),
+		targetDir:             dir,
+		targetAudioExtension:  "opus",
+		targetImageExtension:  "jpg",
+		sourceAudioExtensions: []string{"flac", "mp3", "m4a"},
+		sourceImageExtensions: []string{"jpg", "png"},
+		skipHidden:            true,
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(f), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s, dir
+}
+
+// checkFiles fails the test unless the files listed in kept exist in dir and
+// those in deleted don't.
+func checkFiles(t *testing.T, dir string, kept, deleted []string) {
+	t.Helper()
+	for _, f := range kept {
+		if !fileExists(filepath.Join(dir, filepath.FromSlash(f))) {
+			t.Errorf("%s was deleted, want it kept", f)
+		}
+	}
+	for _, f := range deleted {
+		if fileExists(filepath.Join(dir, filepath.FromSlash(f))) {
+			t.Errorf("%s was kept, want it deleted", f)
+		}
+	}
+}
+
+func entriesFor(targets ...string) *syncDB {
+	db := &syncDB{}
+	for _, target := range targets {
+		db.Entries = append(db.Entries, SyncDBEntry{SourcePath: target + ".flac", TargetPath: filepath.FromSlash(target), Status: statusOK})
+	}
+	return db
+}
+
+func TestDeleteUnexpectedTargetsLostDB(t *testing.T) {
+	s, dir := setupDeleteTarget(t,
+		"Artist/Album/01.opus", "Artist/Album/cover.jpg",
+		"Artist/Album/01.flac", "Artist/Album/02.mp3", "Other/track.m4a",
+		"notes.txt", "Photos/holiday.png")
+
+	// The DB was lost: neither the old nor the new one knows any file.
+	deleted := s.deleteUnexpectedTargets(&syncDB{}, &syncDB{})
+
+	checkFiles(t, dir,
+		[]string{"Artist/Album/01.flac", "Artist/Album/02.mp3", "Other/track.m4a", "notes.txt", "Photos/holiday.png"},
+		[]string{"Artist/Album/01.opus", "Artist/Album/cover.jpg"})
+	if deleted != 2 {
+		t.Errorf("deleted %d files, want 2", deleted)
+	}
+}
+
+func TestDeleteUnexpectedTargetsRebuiltDB(t *testing.T) {
+	s, dir := setupDeleteTarget(t,
+		"A/01.opus", "A/02.opus", "A/02.mp3", "A/booklet.pdf")
+
+	// A rebuilt DB only knows 01, 02 is stale.
+	newDB := entriesFor("A/01.opus")
+	s.deleteUnexpectedTargets(newDB, &syncDB{})
+
+	checkFiles(t, dir, []string{"A/01.opus", "A/02.mp3", "A/booklet.pdf"}, []string{"A/02.opus"})
+}
+
+func TestDeleteUnexpectedTargetsRecordedTypes(t *testing.T) {
+	s, dir := setupDeleteTarget(t, "A/01.mp3", "B/01.mp3")
+
+	// A/01.mp3 was a passthrough copy recorded in the old DB, so .mp3 is a
+	// type this sync writes; both are untracked now.
+	s.deleteUnexpectedTargets(&syncDB{}, entriesFor("A/01.mp3"))
+
+	checkFiles(t, dir, nil, []string{"A/01.mp3", "B/01.mp3"})
+}
+
+func TestDeleteUnexpectedTargetsDeepClean(t *testing.T) {
+	s, dir := setupDeleteTarget(t, "A/01.opus", "A/01.flac", "notes.txt")
+	s.options.deepClean = true
+
+	s.deleteUnexpectedTargets(&syncDB{}, &syncDB{})
+
+	checkFiles(t, dir, nil, []string{"A/01.opus", "A/01.flac", "notes.txt"})
+}
+
+func TestDeleteUnexpectedTargetsKeepsInternalAndHidden(t *testing.T) {
+	s, dir := setupDeleteTarget(t, dbFileName, lastSyncFileName, ".hidden/01.opus", "A/01.opus")
+
+	s.deleteUnexpectedTargets(entriesFor("A/01.opus"), &syncDB{})
+
+	checkFiles(t, dir, []string{dbFileName, lastSyncFileName, ".hidden/01.opus", "A/01.opus"}, nil)
+}
+
+func TestDeletableTypes(t *testing.T) {
+	s, _ := setupDeleteTarget(t)
+	s.options.sidecarExtensions = []string{"lrc"}
+
+	types := s.deletableTypes(entriesFor("A/01.m4a"))
+
+	for _, ext := range []string{"opus", "jpg", "lrc", "m4a", checksumMD5} {
+		if !types[ext] {
+			t.Errorf("%s isn't deletable, want it to be", ext)
+		}
+	}
+	for _, ext := range []string{"flac", "mp3", "png", "m3u", "txt"} {
+		if types[ext] {
+			t.Errorf("%s is deletable, want it kept", ext)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	flag "github.com/spf13/pflag"
+)
+
+// planSchema is the JSON Schema of the plan file, also published as
+// schema/plan.schema.json.
+//
+//go:embed schema/plan.schema.json
+var planSchema []byte
+
+// configSchemaID identifies the config schema, published as
+// schema/config.schema.json.
+const configSchemaID = "https://github.com/hexahigh/SimpleMusicSync/schema/config.schema.json"
+
+// commandLineOnlyFlags are the flags that can't be set from a config file.
+var commandLineOnlyFlags = map[string]bool{"config": true, "trust-config": true, "options-json": true, "only-target": true, "profile": true}
+
+// configSchema returns the JSON Schema of config files (and --options-json),
+// made from the flags so it can't fall behind them.
+func configSchema() map[string]any {
+	properties := make(map[string]any)
+	profileProperties := make(map[string]any)
+	targetProperties := map[string]any{
+		"name": map[string]any{"description": "Name of the target for --only-target and messages (default: its target directory)", "type": "string"},
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if commandLineOnlyFlags[f.Name] {
+			return
+		}
+		properties[f.Name] = flagSchema(f)
+		profileProperties[f.Name] = flagSchema(f)
+		if !sharedSourceOptions[f.Name] {
+			targetProperties[f.Name] = flagSchema(f)
+		}
+	})
+	properties[targetsKey] = map[string]any{
+		"description": "Targets synced in one run, each with the options that differ for it",
+		"type":        "array",
+		"items": map[string]any{
+			"type":                 "object",
+			"properties":           targetProperties,
+			"required":             []string{"target"},
+			"additionalProperties": false,
+		},
+	}
+	properties[profilesKey] = map[string]any{
+		"description": "Named device profiles for --profile, each with the options it sets",
+		"type":        "object",
+		"additionalProperties": map[string]any{
+			"type":                 "object",
+			"properties":           profileProperties,
+			"additionalProperties": false,
+		},
+	}
+	return map[string]any{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"$id":                  configSchemaID,
+		"title":                "SimpleMusicSync config",
+		"description":          "Options for --config (TOML or YAML) and --options-json, named like the flags without the dashes.",
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// flagSchema describes the values a flag takes in a config file. Flags that
+// can be used multiple times take a list or a single value.
+func flagSchema(f *flag.Flag) map[string]any {
+	s := map[string]any{"description": f.Usage}
+	switch f.Value.Type() {
+	case "bool":
+		s["type"] = "boolean"
+		if v, err := strconv.ParseBool(f.DefValue); err == nil {
+			s["default"] = v
+		}
+	case "int", "int64", "uint", "uint64":
+		s["type"] = "integer"
+		if v, err := strconv.ParseInt(f.DefValue, 10, 64); err == nil {
+			s["default"] = v
+		}
+	case "float64":
+		s["type"] = "number"
+		if v, err := strconv.ParseFloat(f.DefValue, 64); err == nil {
+			s["default"] = v
+		}
+	case "duration":
+		s["type"] = "string"
+		s["pattern"] = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$|^0$`
+		s["default"] = f.DefValue
+	case "stringArray", "stringSlice", "strings":
+		s["oneOf"] = []any{
+			map[string]any{"type": "string"},
+			map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		}
+	default:
+		s["type"] = "string"
+		if f.DefValue != "" {
+			s["default"] = f.DefValue
+		}
+	}
+	return s
+}
+
+// runSchema prints the JSON Schema of the config file or the plan.
+func runSchema(kind string) {
+	switch kind {
+	case "config":
+		data, _ := json.MarshalIndent(configSchema(), "", "  ")
+		fmt.Println(string(data))
+	case "plan":
+		os.Stdout.Write(planSchema)
+	}
+}
+
+// runConfigValidate checks a config file without running anything: that it
+// parses, names only known options, gives them valid values and, for a file
+// inside the source directory, sets only what such a file may set. All
+// problems are listed, not just the first.
+func runConfigValidate(path string) {
+	if path == "" {
+		fmt.Println("config validate needs --config.")
+		exit(2)
+	}
+	values, err := readConfigValues(path)
+	if err != nil {
+		fmt.Printf("%s: %v\n", path, err)
+		exit(1)
+	}
+	profiles, err := parseProfiles(values)
+	if err != nil {
+		fmt.Printf("%s: %v\n", path, err)
+		exit(1)
+	}
+	targets, err := parseTargets(values)
+	if err != nil {
+		fmt.Printf("%s: %v\n", path, err)
+		exit(1)
+	}
+	// Whether the file is trusted depends on the common source.
+	check := configCheck(path, values)
+	problems := checkConfigValues(path, "", values, check)
+	for _, name := range profileNames(profiles) {
+		problems += checkConfigValues(path, fmt.Sprintf("profile %q: ", name), profiles[name], check)
+	}
+	for _, t := range targets {
+		problems += checkConfigValues(path, fmt.Sprintf("target %q: ", t.name), t.values, check)
+	}
+	if problems > 0 {
+		exit(1)
+	}
+	fmt.Printf("%s is valid (%d options, %d profiles, %d targets).\n", path, len(values), len(profiles), len(targets))
+}
+
+// checkConfigValues prints the problems of the options in values, prefixed
+// with where they are, and returns how many there are.
+func checkConfigValues(path, where string, values map[string]any, check func(name string) error) int {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	problems := 0
+	for _, name := range names {
+		err := check(name)
+		if err == nil && flag.Lookup(name) == nil {
+			err = fmt.Errorf("unknown option %q", name)
+		}
+		if err == nil {
+			// Setting the flag is the only full check of a value, and
+			// harmless as nothing runs afterwards.
+			err = setOption(name, values[name])
+		}
+		if err != nil {
+			fmt.Printf("%s: %s%v\n", path, where, err)
+			problems++
+		}
+	}
+	return problems
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// corruptionReason is the skip reason of sources --checksum found changed
+// while their size and modification time weren't.
+const corruptionReason = "suspected corruption"
+
+// hashFile returns the SHA-256 of a file's content in hex.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recordSourceHash hashes the source of a job for scrub, --checksum and
+// --verify-before-reprocess, unless it still has the hash from an earlier
+// run.
+func (s *syncer) recordSourceHash(job *syncJob) {
+	if !(s.options.sourceHash || s.options.checksum || s.options.verifyBeforeReprocess || s.options.dedupeArt != "" && job.isImage) || job.sourceHash != "" {
+		return
+	}
+	hash, err := hashFile(job.sourcePath)
+	if err != nil {
+		fmt.Printf("Error hashing %s: %v\n", job.relPath, err)
+		return
+	}
+	job.sourceHash = hash
+}
+
+// hashSources hashes the sources for --checksum change detection. Only files
+// whose size is unchanged and that have a recorded hash to compare with are
+// hashed; everything else is decided without reading the file. With
+// --verify-before-reprocess, only files whose modification time changed are
+// hashed, so a file that was merely touched (e.g. restored from a backup) is
+// kept and just gets its new modification time recorded.
+//
+// A file whose content changed while its size and modification time didn't
+// is most likely rotting rather than edited, as scrub would report it. It
+// is left alone, keeping its target and recorded hash, instead of spreading
+// the damage to the target and losing the hash scrub compares with.
+func (s *syncer) hashSources(jobs []syncJob) {
+	if !s.options.checksum && !s.options.verifyBeforeReprocess {
+		return
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		e := job.existingEntry
+		if job.skipReason != "" || e == nil || e.SourceHash == "" || e.Size != job.sourceInfo.Size() {
+			continue
+		}
+		if !s.options.checksum && s.sameModTime(e.ModTime, job.sourceInfo.ModTime()) {
+			continue
+		}
+		hash, err := hashFile(job.sourcePath)
+		if err != nil {
+			s.planLog("Error hashing %s: %v\n", job.relPath, err)
+			continue
+		}
+		if s.options.checksum && hash != e.SourceHash && s.sameModTime(e.ModTime, job.sourceInfo.ModTime()) {
+			s.planLog("CORRUPTED: %s (content changed, size and modification time didn't), keeping the target; touch the file if the change is intended\n", job.relPath)
+			job.skipReason, job.deferred = corruptionReason, true
+			continue
+		}
+		job.sourceHash = hash
+	}
+}
+
+// runScrub re-reads every source with a recorded hash. A file whose hash
+// changed while its size and modification time didn't was modified behind
+// our back, most likely by bit rot. Files that changed the regular way are
+// left to the next sync. Nothing is written.
+func (s *syncer) runScrub() {
+	var db syncDB
+	s.loadDB(&db, s.syncDBPath())
+
+	var checked, corrupted, changed, missing, unhashed int
+	for _, e := range db.Entries {
+		if e.SourceHash == "" {
+			unhashed++
+			continue
+		}
+		path := filepath.Join(s.options.sourceDir, e.SourcePath)
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Printf("Missing: %s\n", e.SourcePath)
+			missing++
+			continue
+		}
+		if info.Size() != e.Size || !s.sameModTime(e.ModTime, info.ModTime()) {
+			changed++
+			continue
+		}
+		hash, err := hashFile(path)
+		if err != nil {
+			fmt.Printf("Error reading %s: %v\n", e.SourcePath, err)
+			corrupted++
+			continue
+		}
+		checked++
+		if hash != e.SourceHash {
+			fmt.Printf("CORRUPTED: %s (content changed, size and modification time didn't)\n", e.SourcePath)
+			corrupted++
+		}
+	}
+
+	fmt.Printf("Scrubbed %d files: %d corrupted, %d changed since the last sync, %d missing, %d without a recorded hash\n",
+		checked, corrupted, changed, missing, unhashed)
+	if unhashed > 0 {
+		fmt.Println("Run a sync with --source-hash to record hashes for the remaining files.")
+	}
+	if corrupted > 0 {
+		exit(1)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unselectedReason is the skip reason of files outside all --select rules.
+const unselectedReason = "not in selection"
+
+// Kinds of --select rules.
+const (
+	selectAdded    = "added"
+	selectPlaylist = "playlist"
+	selectRating   = "rating"
+)
+
+// selectionRule is one --select rule: files modified within the last
+// maxAge, listed in the playlist at path, or rated at least minRating in
+// --ratings-file.
+type selectionRule struct {
+	kind      string
+	maxAge    time.Duration
+	path      string
+	minRating float64
+}
+
+// parseSelectionRule parses a rule like "added:90d", "playlist:Best.m3u"
+// or "rating:4".
+func parseSelectionRule(s string) (selectionRule, error) {
+	kind, value, _ := strings.Cut(strings.TrimSpace(s), ":")
+	rule := selectionRule{kind: strings.ToLower(kind)}
+	if value == "" {
+		return rule, fmt.Errorf("invalid selection rule %q, expected added:AGE, playlist:FILE or rating:MIN", s)
+	}
+	var err error
+	switch rule.kind {
+	case selectAdded:
+		rule.maxAge, err = parseAge(value)
+	case selectPlaylist:
+		rule.path = value
+	case selectRating:
+		rule.minRating, err = strconv.ParseFloat(value, 64)
+	default:
+		err = fmt.Errorf("unknown selection rule %q, use added, playlist or rating", kind)
+	}
+	return rule, err
+}
+
+// parseAge parses an age like "90d", "2w" or any time.ParseDuration value.
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			days, err := strconv.ParseFloat(n, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid age %q", s)
+			}
+			return time.Duration(days * float64(unit)), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return d, nil
+}
+
+// applySelection keeps only the files at least one --select rule picks,
+// evaluated afresh every run. Like with --ratings-file, images and sidecar
+// files follow the music of their directory, and playlists are kept. Files
+// that fall out of the selection are skipped, and their targets pruned (see
+// pruneUnselected).
+func (s *syncer) applySelection(jobs []syncJob) {
+	if len(s.options.selectRules) == 0 {
+		return
+	}
+	var paths []string
+	for _, rule := range s.options.selectRules {
+		if rule.kind == selectPlaylist {
+			paths = append(paths, rule.path)
+		}
+	}
+	listed, err := s.playlistFiles(paths)
+	if err != nil {
+		s.planLog("Error reading --select playlist: %v\n", err)
+	}
+
+	now := time.Now()
+	selected := func(job syncJob) bool {
+		for _, rule := range s.options.selectRules {
+			switch rule.kind {
+			case selectAdded:
+				if now.Sub(job.sourceInfo.ModTime()) <= rule.maxAge {
+					return true
+				}
+			case selectPlaylist:
+				if listed[s.pathKey(job.relPath)] {
+					return true
+				}
+			case selectRating:
+				if s.ratingOf(job.relPath) >= rule.minRating {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	selectedDirs := make(map[string]bool)
+	for i := range jobs {
+		job := &jobs[i]
+		if job.skipReason != "" || job.isImage || job.sidecar || job.playlist {
+			continue
+		}
+		if selected(*job) {
+			selectedDirs[filepath.Dir(job.relPath)] = true
+		} else {
+			job.skipReason, job.filtered = unselectedReason, true
+		}
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		if job.skipReason == "" && (job.isImage || job.sidecar) && !selectedDirs[filepath.Dir(job.relPath)] {
+			job.skipReason, job.filtered = unselectedReason, true
+		}
+	}
+}
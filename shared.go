@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// namedDBPrefix starts the file names of the DBs of --db-name, which lets
+// several machines sync their own sources into one target, each with a DB
+// of its own.
+const namedDBPrefix = ".syncdb-"
+
+// dbOwnerName is how the DB with the given file name is called in messages.
+func dbOwnerName(fileName string) string {
+	name := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	if name == strings.TrimSuffix(dbFileName, filepath.Ext(dbFileName)) {
+		return "the shared DB"
+	}
+	return "DB " + strings.TrimPrefix(name, namedDBPrefix)
+}
+
+// ownedByOtherDB returns the name of the other DB in the target that records
+// the target path rel (relative to the target), if there is one. Files of
+// other DBs are never overwritten or deleted, so machines with their own DB
+// (--db-name) don't undo each other's work. The other DBs are read once, as
+// they were when the run started; the target lock keeps them from changing
+// during it.
+func (s *syncer) ownedByOtherDB(rel string) (string, bool) {
+	s.otherDBsOnce.Do(func() {
+		s.otherDBOwners = make(map[string]string)
+		own := s.syncDBPath()
+		entries, _ := os.ReadDir(s.options.targetDir)
+		for _, entry := range entries {
+			name := entry.Name()
+			ext := filepath.Ext(name)
+			isDB := name == dbFileName || name == sqliteDBFileName ||
+				strings.HasPrefix(name, namedDBPrefix) && (ext == filepath.Ext(dbFileName) || ext == filepath.Ext(sqliteDBFileName))
+			path := filepath.Join(s.options.targetDir, name)
+			if !isDB || path == own || path == otherBackendPath(own) {
+				continue
+			}
+			var db syncDB
+			if err := s.readDB(&db, path); err != nil {
+				continue
+			}
+			for _, e := range db.Entries {
+				for _, target := range []string{e.TargetPath, e.Thumbnail, e.Cue} {
+					if target != "" {
+						s.otherDBOwners[s.pathKey(target)] = dbOwnerName(name)
+					}
+				}
+			}
+		}
+	})
+	owner, ok := s.otherDBOwners[s.pathKey(rel)]
+	return owner, ok
+}
+
+// skipTargetsOfOtherDBs skips the jobs whose target another DB in the target
+// records, instead of overwriting the other machine's file.
+func (s *syncer) skipTargetsOfOtherDBs(jobs []syncJob) {
+	for i := range jobs {
+		job := &jobs[i]
+		if job.skipReason != "" {
+			continue
+		}
+		if owner, ok := s.ownedByOtherDB(job.relTargetPath); ok {
+			s.planLog("Conflict: the target of %s belongs to %s\n", job.relPath, owner)
+			job.skipReason = "target belongs to " + owner
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// statsFileName keeps the size of the target after every sync, for the
+// growth trend shown by stats.
+const statsFileName = ".syncstats.json"
+
+// maxStatsSamples bounds the stats file, the oldest samples are dropped.
+const maxStatsSamples = 1000
+
+// statsSample is the state of the target after a sync.
+type statsSample struct {
+	Time  time.Time `json:"time"`
+	Size  int64     `json:"size"`
+	Files int       `json:"files"`
+	// Total and Free describe the filesystem of the target, if known.
+	Total int64 `json:"total,omitempty"`
+	Free  int64 `json:"free,omitempty"`
+}
+
+func (s *syncer) loadStats() ([]statsSample, error) {
+	data, err := os.ReadFile(filepath.Join(s.options.targetDir, statsFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var samples []statsSample
+	return samples, json.Unmarshal(data, &samples)
+}
+
+// recordTargetStats adds the current size of the target to the stats file.
+func (s *syncer) recordTargetStats() error {
+	sample := statsSample{Time: time.Now().UTC().Truncate(time.Second)}
+	err := filepath.WalkDir(s.options.targetDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if s.isInternalPath(path, s.options.targetDir) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			sample.Size += info.Size()
+			sample.Files++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sample.Total, sample.Free, _ = fsSpace(s.options.targetDir)
+
+	samples, err := s.loadStats()
+	if err != nil {
+		return err
+	}
+	samples = append(samples, sample)
+	if len(samples) > maxStatsSamples {
+		samples = samples[len(samples)-maxStatsSamples:]
+	}
+	data, _ := json.MarshalIndent(samples, "", "  ")
+	return s.perms.writeAtomically(filepath.Join(s.options.targetDir, statsFileName), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// growthRate fits a line through the sizes of samples (least squares) and
+// returns its slope in bytes per day. It returns false for fewer than two
+// samples or when they were all taken at once.
+func growthRate(samples []statsSample) (float64, bool) {
+	if len(samples) < 2 {
+		return 0, false
+	}
+	start := samples[0].Time
+	var n, sumX, sumY, sumXY, sumXX float64
+	for _, s := range samples {
+		x := s.Time.Sub(start).Hours() / 24
+		y := float64(s.Size)
+		n++
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, false
+	}
+	return (n*sumXY - sumX*sumY) / denominator, true
+}
+
+// runStats prints the recorded sizes of the target, how fast it grew within
+// window and, if the free space is known, when it is projected to be full.
+func (s *syncer) runStats(window time.Duration) {
+	samples, err := s.loadStats()
+	if err != nil {
+		fmt.Println("Error loading stats:", err)
+		exit(1)
+	}
+	if len(samples) == 0 {
+		fmt.Println("No stats recorded yet, they are recorded at the end of every sync.")
+		return
+	}
+
+	fmt.Println("Size of the target after recent syncs:")
+	recent := samples[max(0, len(samples)-10):]
+	for _, sample := range recent {
+		fmt.Printf("  %s  %10s  %6d files\n", sample.Time.Local().Format(time.DateTime), formatSize(sample.Size), sample.Files)
+	}
+
+	last := samples[len(samples)-1]
+	var inWindow []statsSample
+	for _, sample := range samples {
+		if last.Time.Sub(sample.Time) <= window {
+			inWindow = append(inWindow, sample)
+		}
+	}
+	rate, ok := growthRate(inWindow)
+	if !ok {
+		fmt.Println("Not enough syncs to tell the growth yet.")
+	} else {
+		days := last.Time.Sub(inWindow[0].Time).Hours() / 24
+		fmt.Printf("Growth: %s per day over the last %.0f days\n", formatSize(int64(rate)), days)
+	}
+	if last.Total == 0 {
+		fmt.Println("The free space of the target is unknown on this platform.")
+		return
+	}
+	used := last.Total - last.Free
+	fmt.Printf("Free: %s of %s (%.0f%% used)\n", formatSize(last.Free), formatSize(last.Total), float64(used)*100/float64(last.Total))
+	if ok && rate > 0 {
+		full := last.Time.Add(time.Duration(float64(last.Free) / rate * 24 * float64(time.Hour)))
+		fmt.Printf("Projected full: %s (in %.0f days)\n", full.Local().Format(time.DateOnly), time.Until(full).Hours()/24)
+	}
+}
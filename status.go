@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runStatus plans a sync and prints an overview of the pending work.
+func (s *syncer) runStatus() {
+	s.options.quietPlan = true
+
+	var oldDB syncDB
+	s.loadDB(&oldDB, s.syncDBPath())
+	jobs, err := s.planJobs(&oldDB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error during planning:", err)
+		exit(1)
+	}
+
+	var upToDate, added, changed, retries, refresh, skipped int
+	var failed []syncJob
+	seen := make(map[string]bool)
+	for _, job := range jobs {
+		seen[s.pathKey(job.relPath)] = true
+		e := job.existingEntry
+		if e != nil && (e.Status == statusFailed || e.Status == statusQuarantined) {
+			failed = append(failed, job)
+		}
+		switch {
+		case job.filtered:
+		case job.skipReason != "":
+			skipped++
+		case !job.needsProcessing:
+			upToDate++
+		case job.metadataOnly:
+			refresh++
+		case e == nil || !e.hasTarget():
+			added++
+		case e.Status == statusFailed || e.Status == statusPending:
+			retries++
+		default:
+			changed++
+		}
+	}
+	removed := 0
+	for _, e := range oldDB.Entries {
+		if e.hasTarget() && !seen[s.pathKey(e.SourcePath)] {
+			removed++
+		}
+	}
+
+	fmt.Printf("Up to date:         %d files\n", upToDate)
+	fmt.Printf("To process:         %d files (%d new, %d changed, %d retries)\n", added+changed+retries, added, changed, retries)
+	if refresh > 0 {
+		fmt.Printf("Metadata refreshes: %d files\n", refresh)
+	}
+	fmt.Printf("Removed sources:    %d files\n", removed)
+	fmt.Printf("Skipped:            %d files\n", skipped)
+	if len(failed) > 0 {
+		fmt.Printf("Failed last time:   %d files\n", len(failed))
+		for _, job := range failed {
+			e := job.existingEntry
+			if e.Status == statusQuarantined {
+				fmt.Printf("  %s: %s (%d attempts, quarantined)\n", job.relPath, e.LastError, e.Attempts)
+			} else {
+				fmt.Printf("  %s: %s (%d attempts)\n", job.relPath, e.LastError, e.Attempts)
+			}
+		}
+	}
+}
+
+// runVerify checks the target against the DB: every successfully processed
+// file must exist and not be empty. Files in the target that aren't in the
+// DB are listed too, but only missing or empty targets count as failures.
+//
+// With decode, audio targets are also decoded completely to find truncated
+// or corrupt files, and their duration is compared with the source's, which
+// counts as a failure when they differ by more than tolerance. With
+// requeue, the entries of failed targets are marked as failed in the DB, so
+// the next sync converts them again.
+func (s *syncer) runVerify(decode bool, tolerance time.Duration, requeue bool) {
+	dbPath := s.syncDBPath()
+	var db syncDB
+	s.loadDB(&db, dbPath)
+
+	expected := make(map[string]bool)
+	var checked, missing, empty, corrupt, unexpected int
+	var requeued []int
+	for i, e := range db.Entries {
+		if !e.hasTarget() || !e.isOK() {
+			continue
+		}
+		failed := false
+		for _, rel := range []string{e.TargetPath, e.Thumbnail, e.Cue} {
+			if rel == "" || expected[rel] {
+				continue
+			}
+			expected[rel] = true
+			checked++
+			info, err := os.Stat(filepath.Join(s.options.targetDir, rel))
+			switch {
+			case err != nil:
+				fmt.Printf("Missing: %s\n", rel)
+				missing++
+				failed = failed || rel == e.TargetPath
+			case info.Size() == 0:
+				fmt.Printf("Empty: %s\n", rel)
+				empty++
+				failed = failed || rel == e.TargetPath
+			case decode && rel == e.TargetPath && s.isDecodable(e):
+				if err := s.decodeTarget(e, tolerance); err != nil {
+					fmt.Printf("Corrupt: %s: %v\n", rel, err)
+					corrupt++
+					failed = true
+				}
+			}
+		}
+		if failed && requeue {
+			requeued = append(requeued, i)
+		}
+	}
+
+	checksums := s.checksumDirs(&db)
+	err := filepath.Walk(s.options.targetDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if s.isInternalPath(path, s.options.targetDir) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(s.options.targetDir, path)
+		if !info.IsDir() && !expected[rel] && !s.isChecksumFile(checksums, rel) {
+			fmt.Printf("Unexpected: %s\n", rel)
+			unexpected++
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println("Error walking target:", err)
+		exit(1)
+	}
+
+	if len(requeued) > 0 {
+		for _, i := range requeued {
+			db.Entries[i].Status = statusFailed
+			db.Entries[i].LastError = "verify: target is missing or corrupt"
+		}
+		if err := s.snapshotDB(dbPath, s.options.dbSnapshots); err != nil {
+			fmt.Println("Error creating DB snapshot:", err)
+		}
+		s.saveDB(&db, dbPath)
+		fmt.Printf("Marked %d files to be converted again by the next sync.\n", len(requeued))
+	}
+
+	if decode {
+		fmt.Printf("Verified %d targets: %d missing, %d empty, %d corrupt, %d unexpected files\n", checked, missing, empty, corrupt, unexpected)
+	} else {
+		fmt.Printf("Verified %d targets: %d missing, %d empty, %d unexpected files\n", checked, missing, empty, unexpected)
+	}
+	if missing+empty+corrupt > 0 {
+		exit(1)
+	}
+}
+
+// isDecodable reports whether verify --decode checks the target of e: the
+// audio files converted or copied one to one. Archives, audiobooks and
+// playlists combine several sources.
+func (s *syncer) isDecodable(e SyncDBEntry) bool {
+	ext := strings.TrimPrefix(filepath.Ext(e.SourcePath), ".")
+	return s.isAudioExtension(ext) && e.Command != archiveCommand && e.Command != playlistCommand && !isAudiobookCommand(e.Command)
+}
+
+// decodeTarget decodes the target of e with ffmpeg, which reports truncated
+// and corrupt audio as errors, and compares its duration with the source's.
+// The source's duration is taken from the DB if --audio-info recorded it,
+// and probed if the source directory is given. Commands that cut the audio,
+// like --preview, are not compared.
+func (s *syncer) decodeTarget(e SyncDBEntry, tolerance time.Duration) error {
+	path := filepath.Join(s.options.targetDir, e.TargetPath)
+	output, err := exec.CommandContext(s.runCtx, ffmpegBinary, "-nostdin", "-v", "error",
+		"-i", path, "-map", "0:a", "-f", "null", "-").CombinedOutput()
+	if msg, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n"); msg != "" {
+		return errors.New(msg)
+	} else if err != nil {
+		return err
+	}
+
+	for _, arg := range splitCommand(e.Command) {
+		if arg == "-t" || arg == "-to" || arg == "-ss" {
+			return nil
+		}
+	}
+	var want time.Duration
+	if e.Audio != nil {
+		want = e.Audio.Duration
+	} else if s.options.sourceDir != "" {
+		if info, err := s.probeAudio(filepath.Join(s.options.sourceDir, e.SourcePath)); err == nil {
+			want = info.Duration
+		}
+	}
+	if want <= 0 {
+		return nil
+	}
+	info, err := s.probeAudio(path)
+	if err != nil {
+		return err
+	}
+	if diff := info.Duration - want; diff > tolerance || -diff > tolerance {
+		return fmt.Errorf("lasts %s, the source %s", info.Duration.Round(time.Millisecond), want.Round(time.Millisecond))
+	}
+	return nil
+}
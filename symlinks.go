@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// linkedDir returns the real path of the directory the symlink at link (a
+// real path) points to, for --follow-symlinks to walk it. It returns why
+// the link isn't followed if it is broken or points at one of its own
+// parents. Links to files return neither, they are synced like files.
+func linkedDir(link string) (string, string) {
+	real, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return "", "broken symlink"
+	}
+	info, err := os.Stat(real)
+	if err != nil || !info.IsDir() {
+		return "", ""
+	}
+	if isWithin(link, real) {
+		return "", "symlink loop"
+	}
+	return real, ""
+}
+
+// isDirLink reports whether path is a symlink to a directory.
+func isDirLink(path string) bool {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	info, err = os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// visit records that the directory at the real path dir is walked, with
+// --follow-symlinks. It returns why the directory should be skipped: it was
+// walked before under another path, or it is the target (which a link may
+// lead into, unlike the source tree itself).
+func (m *markerState) visit(dir string) string {
+	if m.realTarget == "" {
+		m.realTarget = resolvePath(m.options.targetDir)
+	}
+	if dir == m.realTarget {
+		return "target directory"
+	}
+	if m.visited[dir] {
+		return "already visited"
+	}
+	m.visited[dir] = true
+	return ""
+}
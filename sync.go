@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// runSync runs a full sync from the source to the target directory.
+func (s *syncer) runSync() {
+	summary, err := s.sync(s.runCtx, s.events)
+	if err != nil {
+		fmt.Println("Error during processing:", err)
+		exit(exitStatus(err))
+	}
+	summary.Print()
+	summary.exitOnFailures()
+	fmt.Println("Sync complete!")
+}
+
+// sync runs a full sync from the source to the target directory, the way
+// the sync command does short of printing the summary, for programs that
+// drive runs themselves. The progress of the jobs goes to events, if not
+// nil. Cancelling ctx stops the run like SIGINT does: running commands are
+// killed, what completed is saved, and errInterrupted returned. Files that
+// failed are listed in the summary rather than making it an error. The
+// caller holds the target lock (see lockTarget).
+func (s *syncer) sync(ctx context.Context, events *syncEvents) (*syncSummary, error) {
+	s.runCtx, s.events = ctx, events
+	s.pingHealthcheckStart()
+	if err := s.prepareTarget(); err != nil {
+		s.reportRunEnd(&syncDB{}, nil, nil, err)
+		return nil, err
+	}
+
+	dbPath := s.syncDBPath()
+	var oldDB syncDB
+	if err := s.openDB(&oldDB, dbPath); err != nil {
+		err = fmt.Errorf("reading DB %s: %w", dbPath, err)
+		s.reportRunEnd(&oldDB, nil, nil, err)
+		return nil, err
+	}
+	defer oldDB.close()
+
+	var newDB syncDB
+	var jobs []syncJob
+	if s.options.batchDirs > 0 && s.options.filesFrom == "" {
+		var err error
+		if newDB.Entries, jobs, err = s.syncInBatches(&oldDB, dbPath); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		jobs, err = s.planJobs(&oldDB)
+		if err != nil {
+			s.reportRunEnd(&oldDB, nil, nil, err)
+			return nil, err
+		}
+
+		if !s.confirmMassChange(jobs, nil) {
+			s.reportRunEnd(&oldDB, nil, nil, errTooManyChanges)
+			return nil, errTooManyChanges
+		}
+
+		s.pruneUnselected(jobs)
+		newDB.Entries, err = s.executeJobs(jobs)
+		if s.options.filesFrom != "" {
+			newDB.Entries = append(newDB.Entries, s.unlistedEntries(&oldDB, jobs)...)
+		}
+		if err != nil {
+			s.saveDB(&newDB, dbPath)
+			s.reportRunEnd(&oldDB, &newDB, jobs, err)
+			return nil, err
+		}
+	}
+
+	if err := s.snapshotDB(dbPath, s.options.dbSnapshots); err != nil {
+		fmt.Println("Error creating DB snapshot:", err)
+	}
+	s.saveDB(&newDB, dbPath)
+
+	if s.options.deleteRemovedFiles {
+		s.deleteUnexpectedTargets(&newDB, &oldDB)
+	}
+	return s.finishRun(&oldDB, &newDB, jobs), nil
+}
+
+// finishRun does the bookkeeping of a run that completed, once newDB is
+// saved and removed files are deleted: it writes the checksums, records
+// the target stats, reports the run to the healthcheck and by mail, and
+// writes the last sync marker unless files failed. It returns the summary
+// of the run.
+func (s *syncer) finishRun(oldDB, newDB *syncDB, jobs []syncJob) *syncSummary {
+	s.writeChecksums(newDB)
+	if err := s.recordTargetStats(); err != nil {
+		fmt.Println("Error recording target stats:", err)
+	}
+
+	summary := s.buildSummary(oldDB, newDB, jobs)
+	s.reportRunEnd(oldDB, newDB, jobs, nil)
+	if len(summary.failed) == 0 {
+		if err := s.writeLastSyncMarker(newDB, summary); err != nil {
+			fmt.Println("Error writing the last sync marker:", err)
+		}
+	}
+	return summary
+}
+
+// deleteUnexpectedTargets deletes every file in the target that doesn't
+// belong to an entry of db, and returns how many were deleted. Hidden files
+// (see --skip-hidden) are only deleted if oldDB records them, those of the
+// device (.Trashes, .Spotlight-V100, ...) are left alone, and so are files
+// of types we don't write unless --deep-clean is given (see deletableTypes).
+func (s *syncer) deleteUnexpectedTargets(db, oldDB *syncDB) int {
+	deleted := 0
+	checksums := s.checksumDirs(db)
+	types := s.deletableTypes(db, oldDB)
+	kept := make(map[string]int)
+	filepath.Walk(s.options.targetDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if s.isInternalPath(path, s.options.targetDir) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, _ := filepath.Rel(s.options.targetDir, path)
+		if db.findTarget(relPath) != nil || s.globFiltered(relPath) || s.isChecksumFile(checksums, relPath) {
+			return nil
+		}
+		if s.hiddenSkipped(relPath) && oldDB.findTarget(relPath) == nil {
+			return nil
+		}
+		if _, ok := s.ownedByOtherDB(relPath); ok {
+			return nil
+		}
+		if !s.deletableType(relPath, types) {
+			kept[extOf(relPath)]++
+			return nil
+		}
+		if err := s.checkTargetPath(path); err != nil {
+			return err
+		}
+		if err := s.removeTarget(path); err != nil {
+			return err
+		}
+		deleted++
+		return nil
+	})
+	reportKeptTypes(kept)
+	return deleted
+}
+
+// runCleanRemoved deletes what sync --delete-removed would, without syncing
+// anything: the targets of sources that no longer exist, and files in the
+// target that no source maps to. Entries of removed sources are dropped from
+// the DB.
+func (s *syncer) runCleanRemoved() {
+	dbPath := s.syncDBPath()
+	var oldDB syncDB
+	// Without the DB every file in the target would look unexpected.
+	if err := s.openExistingDB(&oldDB, dbPath); err != nil {
+		fmt.Printf("Error reading DB %s, nothing was cleaned: %v\n", dbPath, err)
+		exit(1)
+	}
+
+	var newDB syncDB
+	for _, e := range oldDB.Entries {
+		if fileExists(filepath.Join(s.options.sourceDir, e.SourcePath)) {
+			newDB.Entries = append(newDB.Entries, e)
+		}
+	}
+	if err := s.snapshotDB(dbPath, s.options.dbSnapshots); err != nil {
+		fmt.Println("Error creating DB snapshot:", err)
+	}
+	s.saveDB(&newDB, dbPath)
+
+	deleted := s.deleteUnexpectedTargets(&newDB, &oldDB)
+	fmt.Printf("Dropped %d entries of removed sources, deleted %d files.\n", len(oldDB.Entries)-len(newDB.Entries), deleted)
+}
+
+// executeJobs processes the planned jobs and returns the DB entries
+// describing the result, in the order of the jobs. Jobs are spread over the
+// processing slots returned by jobRunners. A job that fails gets a failed
+// entry and the others still run. With --fail-fast, or once the run is
+// interrupted, no further jobs are started and the jobs that didn't run yet
+// get pending entries, so they can be saved and retried later.
+func (s *syncer) executeJobs(jobs []syncJob) ([]SyncDBEntry, error) {
+	progress := s.newProgressTracker(jobs)
+	limiter := newRateLimiter(s.options.rateLimit)
+	entries := make([]SyncDBEntry, len(jobs))
+	done := make([]bool, len(jobs))
+	if s.targetKey != nil {
+		var err error
+		if s.stagingRoot, err = os.MkdirTemp("", "smsenc-"); err != nil {
+			for i := range jobs {
+				entries[i] = jobs[i].pendingEntry()
+			}
+			return entries, fmt.Errorf("creating staging directory: %w", err)
+		}
+		defer func() {
+			os.RemoveAll(s.stagingRoot)
+			s.stagingRoot = ""
+		}()
+	}
+
+	var queue, playlists, dedupes []int
+	var archiveTargets []string
+	archives := make(map[string][]int)
+	for i := range jobs {
+		job := &jobs[i]
+		switch {
+		case job.skipReason != "":
+			progress.Logf("Skipping (%s): %s\n", job.skipReason, job.relPath)
+			entries[i], done[i] = job.entry(statusSkipped), true
+		case !job.needsProcessing && !job.needsThumbnail && !job.needsCue:
+			job.keepExisting()
+			progress.Logf("Skipping (up-to-date): %s\n", job.relPath)
+			s.recordSourceHash(job)
+			entries[i], done[i] = job.entry(statusOK), true
+		case job.playlist:
+			playlists = append(playlists, i)
+		case job.dedupeOf != nil:
+			dedupes = append(dedupes, i)
+		case job.archive:
+			if archives[job.targetFile] == nil {
+				archiveTargets = append(archiveTargets, job.targetFile)
+			}
+			archives[job.targetFile] = append(archives[job.targetFile], i)
+		default:
+			queue = append(queue, i)
+		}
+	}
+
+	progress.StartBar()
+	defer progress.StopBar()
+
+	var mu sync.Mutex
+	var firstErr error
+	for _, target := range archiveTargets {
+		if s.interrupted() {
+			firstErr = errInterrupted
+			break
+		}
+		err := s.runArchive(jobs, archives[target], entries, done, progress)
+		if err != nil && (s.options.failFast || errors.Is(err, errInterrupted)) {
+			firstErr = err
+			break
+		}
+	}
+	var wg sync.WaitGroup
+	work := make(chan int)
+	for _, run := range s.jobRunners() {
+		wg.Add(1)
+		go func(run commandRunner) {
+			defer wg.Done()
+			for i := range work {
+				job := &jobs[i]
+				progress.Begin(*job)
+				err := s.runJob(job, run)
+
+				mu.Lock()
+				progress.Advance(*job, err)
+				switch {
+				case err != nil && s.interrupted():
+					// Not the file's fault, so it doesn't count as an attempt.
+					if job.needsProcessing {
+						job.attempts--
+					}
+					progress.Logf("Interrupted: %s\n", job.relPath)
+					entries[i] = job.pendingEntry()
+					if firstErr == nil {
+						firstErr = errInterrupted
+					}
+				case err != nil:
+					job.lastError = err.Error()
+					entries[i] = s.failedEntry(job)
+					if s.options.failFast && firstErr == nil {
+						firstErr = err
+					}
+				case job.skipReason != "":
+					progress.Logf("Skipping (%s): %s\n", job.skipReason, job.relPath)
+					entries[i] = job.entry(statusSkipped)
+				default:
+					switch {
+					case !job.needsProcessing:
+						if job.thumbnailOK {
+							progress.Logf("%s Rendered thumbnail: %s\n", progress, job.relPath)
+						}
+					case job.metadataOnly:
+						progress.Logf("%s Refreshed metadata: %s\n", progress, job.relPath)
+					case job.movedFrom != nil:
+						progress.Logf("%s Moved: %s (from %s)\n", progress, job.relPath, job.movedFrom.SourcePath)
+					case job.variant > 0:
+						progress.Logf("%s Processed: %s (fallback %d)\n", progress, job.relPath, job.variant)
+					default:
+						progress.Logf("%s Processed: %s\n", progress, job.relPath)
+					}
+					entries[i] = job.entry(statusOK)
+				}
+				done[i] = true
+				mu.Unlock()
+			}
+		}(run)
+	}
+
+	for _, i := range queue {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		if s.interrupted() {
+			mu.Lock()
+			firstErr = errInterrupted
+			mu.Unlock()
+			break
+		}
+		if !jobs[i].metadataOnly {
+			limiter.Wait()
+		}
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr == nil && len(dedupes) != 0 {
+		firstErr = s.runDedupes(jobs, dedupes, entries, done, progress)
+	}
+	if firstErr == nil && len(playlists) != 0 {
+		firstErr = s.runPlaylists(jobs, playlists, entries, done, progress)
+	}
+	if firstErr != nil {
+		for i := range jobs {
+			if !done[i] {
+				entries[i] = jobs[i].pendingEntry()
+			}
+		}
+	}
+	return entries, firstErr
+}
+
+// runPlaylists writes the playlists at indexes once all other jobs ran, so
+// they only list files that were synced successfully.
+func (s *syncer) runPlaylists(jobs []syncJob, indexes []int, entries []SyncDBEntry, done []bool, progress *progressTracker) error {
+	targets := jobs[indexes[0]].playlistTargets
+	for i, e := range entries {
+		if done[i] && !e.isOK() {
+			delete(targets, s.pathKey(jobs[i].relPath))
+		}
+	}
+	for _, i := range indexes {
+		if s.interrupted() {
+			return errInterrupted
+		}
+		job := &jobs[i]
+		progress.Begin(*job)
+		job.attempts++
+		start := time.Now()
+		err := s.writePlaylist(*job)
+		job.duration = time.Since(start)
+		progress.Advance(*job, err)
+		done[i] = true
+		if err != nil {
+			progress.Logf("Error translating playlist %s: %v\n", job.relPath, err)
+			job.lastError = err.Error()
+			entries[i] = s.failedEntry(job)
+			if s.options.failFast {
+				return err
+			}
+			continue
+		}
+		s.recordSourceHash(job)
+		progress.Logf("%s Translated playlist: %s\n", progress, job.relPath)
+		entries[i] = job.entry(statusOK)
+	}
+	return nil
+}
+
+// runArchive builds the archive shared by the jobs at indexes and records
+// the result for each of them.
+func (s *syncer) runArchive(jobs []syncJob, indexes []int, entries []SyncDBEntry, done []bool, progress *progressTracker) error {
+	members := make([]*syncJob, len(indexes))
+	for k, i := range indexes {
+		members[k] = &jobs[i]
+	}
+	progress.Begin(*members[0])
+	start := time.Now()
+	build, verb := s.buildArchive, "Archived"
+	if isAudiobookCommand(members[0].command) {
+		build, verb = s.buildAudiobook, "Merged"
+	}
+	err := build(members)
+	if err != nil && s.interrupted() {
+		for _, i := range indexes {
+			entries[i], done[i] = jobs[i].pendingEntry(), true
+		}
+		return errInterrupted
+	}
+	for _, job := range members {
+		job.attempts++
+		job.duration = time.Since(start)
+		progress.Advance(*job, err)
+		if err == nil {
+			s.recordSourceHash(job)
+		}
+	}
+	for k, i := range indexes {
+		if err != nil {
+			members[k].lastError = err.Error()
+			entries[i] = s.failedEntry(members[k])
+		} else {
+			entries[i] = members[k].entry(statusOK)
+		}
+		done[i] = true
+	}
+	if err != nil {
+		progress.Logf("Error building %s: %v\n", members[0].relTargetPath, err)
+		return err
+	}
+	progress.Logf("%s %s: %s (%d files)\n", progress, verb, members[0].relTargetPath, len(members))
+	return nil
+}
+
+// runJob converts, copies or refreshes a single job using the given runner.
+func (s *syncer) runJob(job *syncJob, run commandRunner) error {
+	if !job.needsProcessing {
+		// Only the thumbnail or the cue sheet needs writing.
+		job.keepExisting()
+		s.writeCueSheet(job)
+		if err := s.renderThumbnail(job, run); err != nil && s.interrupted() {
+			return err
+		}
+		return nil
+	}
+
+	var err error
+	job.attempts++
+	start := time.Now()
+	if job.movedFrom != nil {
+		if err = s.moveTarget(job); err == nil {
+			job.duration = time.Since(start)
+			return nil
+		}
+		fmt.Printf("Error moving the target of %s, converting it again: %v\n", job.relPath, err)
+		job.movedFrom = nil
+	}
+	switch {
+	case job.oversized:
+		err = s.errOversized()
+	case job.metadataOnly:
+		job.variant = job.existingEntry.Variant
+		err = s.refreshMetadata(*job)
+	default:
+		err = s.withEncryption(job, func() error {
+			var err error
+			job.variant, err = s.processJob(*job, run)
+			if err == nil && s.checkOutputSize(job) {
+				switch {
+				case job.oversized:
+					err = s.errOversized()
+				case job.skipReason == "":
+					job.variant, err = s.processJob(*job, run)
+				}
+			}
+			return err
+		})
+	}
+	job.duration = time.Since(start)
+	if err != nil || job.skipReason != "" {
+		return err
+	}
+
+	if s.options.xattrs {
+		if err := copyXattrs(job.sourcePath, job.targetFile); err != nil {
+			fmt.Printf("Error copying extended attributes of %s: %v\n", job.relPath, err)
+		}
+	}
+	if s.recordAudioHashes() && !job.isImage && !job.sidecar && !job.metadataOnly {
+		if job.audioHash, err = s.hashAudio(job.sourcePath); err != nil {
+			fmt.Printf("Error hashing audio of %s: %v\n", job.relPath, err)
+		}
+	}
+	s.recordSourceHash(job)
+	s.writeCueSheet(job)
+	if err := s.renderThumbnail(job, run); err != nil && s.interrupted() {
+		return err
+	}
+	return nil
+}
+
+// prepareTarget creates the target directory, removes stale temporary files
+// and old trash, sets up --temp-dir and probes the target filesystem.
+func (s *syncer) prepareTarget() error {
+	if err := s.perms.makeDirs(s.options.targetDir); err != nil {
+		return fmt.Errorf("creating target directory: %w", err)
+	}
+
+	if _, err := s.cleanTempFiles(s.options.tempMaxAge); err != nil {
+		fmt.Println("Error cleaning temporary files:", err)
+	}
+	if err := s.emptyTrash(s.options.trashRetention); err != nil {
+		fmt.Println("Error emptying trash:", err)
+	}
+	if err := s.setupTempDir(); err != nil {
+		return fmt.Errorf("setting up temp directory: %w", err)
+	}
+	return s.probeTargetFS()
+}
+
+// probeTargetFS probes the target filesystem unless --probe-target is off,
+// and applies what it found.
+func (s *syncer) probeTargetFS() error {
+	if !s.options.probeTarget {
+		return nil
+	}
+	caps, err := probeTarget(s.options.targetDir)
+	if err != nil {
+		return fmt.Errorf("probing target filesystem: %w", err)
+	}
+	s.applyTargetCaps(caps, flag.CommandLine.Changed)
+	fmt.Println("Target filesystem:", s.targetCaps)
+	return nil
+}
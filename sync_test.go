@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// checkTargets fails the test unless every job with an OK entry has a
+// target with the content of its source.
+func checkTargets(t *testing.T, jobs []syncJob, entries []SyncDBEntry) {
+	t.Helper()
+	for i, e := range entries {
+		if e.Status != statusOK {
+			t.Errorf("%s: status %s, want %s", e.SourcePath, e.Status, statusOK)
+			continue
+		}
+		data, err := os.ReadFile(jobs[i].targetFile)
+		if err != nil {
+			t.Errorf("%s: %v", e.SourcePath, err)
+			continue
+		}
+		if string(data) != filepath.ToSlash(e.SourcePath) {
+			t.Errorf("%s: target holds %q", e.SourcePath, data)
+		}
+	}
+}
+
+// manyFiles returns n album tracks with covers, spread over a few albums.
+func manyFiles(n int) []string {
+	var files []string
+	for i := 0; i < n; i++ {
+		album := fmt.Sprintf("Artist/Album %d", i%5)
+		files = append(files, fmt.Sprintf("%s/%02d.flac", album, i))
+		if i < 5 {
+			files = append(files, album+"/cover.png")
+		}
+	}
+	return files
+}
+
+func TestExecuteJobsWorkers(t *testing.T) {
+	s := newTestSyncer(t, manyFiles(40)...)
+	const token = "secret"
+	for range 3 {
+		mux := http.NewServeMux()
+		mux.HandleFunc(workerPath, newSyncer().handleConvert(token, []string{"cp"}))
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		// Two jobs at once on each.
+		s.options.workers = append(s.options.workers, server.URL, server.URL)
+	}
+	s.options.workerToken = token
+
+	jobs, err := s.planJobs(&syncDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := s.executeJobs(jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 45 {
+		t.Fatalf("got %d entries, want 45", len(entries))
+	}
+	checkTargets(t, jobs, entries)
+
+	// A second run finds everything up to date.
+	jobs, err = s.planJobs(&syncDB{Entries: entries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range jobs {
+		if job.needsProcessing {
+			t.Errorf("%s needs processing again (%s)", job.relPath, job.reason)
+		}
+	}
+}
+
+func TestExecuteJobsFailure(t *testing.T) {
+	s := newTestSyncer(t, "A/01.flac", "A/02.flac", "A/cover.png")
+	// cp without a destination fails.
+	s.options.ffmpegImageCommand = "cp $INPUT"
+	s.options.quarantineAfter = 2
+
+	var db syncDB
+	for attempt := 1; attempt <= 2; attempt++ {
+		jobs, err := s.planJobs(&db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := s.executeJobs(jobs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db = syncDB{Entries: entries}
+
+		for i, e := range entries {
+			switch {
+			case !jobs[i].isImage:
+				if e.Status != statusOK {
+					t.Errorf("attempt %d: %s has status %s, want %s", attempt, e.SourcePath, e.Status, statusOK)
+				}
+			case attempt == 1 && e.Status != statusFailed, attempt == 2 && e.Status != statusQuarantined:
+				t.Errorf("attempt %d: %s has status %s", attempt, e.SourcePath, e.Status)
+			case fileExists(jobs[i].targetFile):
+				t.Errorf("attempt %d: the failed %s left a target", attempt, e.SourcePath)
+			}
+		}
+	}
+}
+
+func TestSyncEvents(t *testing.T) {
+	s := newTestSyncer(t, manyFiles(10)...)
+
+	var mu sync.Mutex
+	started, ended := 0, 0
+	begun := make(map[string]bool)
+	var done []string
+	var last syncProgress
+	events := &syncEvents{
+		Start: func(p syncProgress) { started++ },
+		Begin: func(path string, p syncProgress) {
+			mu.Lock()
+			defer mu.Unlock()
+			begun[filepath.ToSlash(path)] = true
+		},
+		Done: func(path string, err error, p syncProgress) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				t.Errorf("%s failed: %v", path, err)
+			}
+			done = append(done, filepath.ToSlash(path))
+			last = p
+		},
+		End: func(p syncProgress) { ended++ },
+	}
+	summary, err := s.sync(context.Background(), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if started != 1 || ended != 1 {
+		t.Errorf("got %d start and %d end events, want one of each", started, ended)
+	}
+	if len(begun) != 15 || len(done) != 15 {
+		t.Errorf("got %d files begun and %d done, want 15", len(begun), len(done))
+	}
+	if last.DoneFiles != 15 || last.Files != 15 || last.Percent != 100 {
+		t.Errorf("progress after the last file is %+v, want all 15 files done", last)
+	}
+	if len(summary.albums) != 5 || len(summary.failed) != 0 {
+		t.Errorf("summary has %d albums and %d failures, want 5 albums added", len(summary.albums), len(summary.failed))
+	}
+}
+
+func TestSyncCancelled(t *testing.T) {
+	s := newTestSyncer(t, "A/01.flac", "A/02.flac")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := s.sync(ctx, nil)
+
+	if !errors.Is(err, errInterrupted) {
+		t.Fatalf("got error %v, want %v", err, errInterrupted)
+	}
+	checkFiles(t, s.options.targetDir, nil, []string{"A/01.opus", "A/02.opus"})
+	var db syncDB
+	if err := s.openDB(&db, s.syncDBPath()); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Entries) != 2 {
+		t.Fatalf("the DB has %d entries, want 2", len(db.Entries))
+	}
+	for _, e := range db.Entries {
+		if e.Status != statusPending {
+			t.Errorf("%s has status %s, want %s", e.SourcePath, e.Status, statusPending)
+		}
+	}
+}
+
+func TestSyncInBatchesCollisions(t *testing.T) {
+	// With one level, A/B/01.flac is flattened onto the target of the next
+	// batch's "A - B/01.flac".
+	s := newTestSyncer(t, "A/B/01.flac", "A - B/01.flac")
+	s.options.flatten = 1
+	s.options.batchDirs = 1
+
+	if _, err := s.sync(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, s.options.targetDir, []string{"A - B/01.opus", "A - B/01 (2).opus"}, nil)
+	var db syncDB
+	if err := s.openDB(&db, s.syncDBPath()); err != nil {
+		t.Fatal(err)
+	}
+	targets := make(map[string]bool)
+	for _, e := range db.Entries {
+		if targets[e.TargetPath] {
+			t.Errorf("%s and another source share the target %s", e.SourcePath, e.TargetPath)
+		}
+		targets[e.TargetPath] = true
+	}
+}
+
+func TestSummaryFailures(t *testing.T) {
+	s := newTestSyncer(t, "A/01.flac", "A/cover.png", "B/cover.png")
+	// cp without a destination fails.
+	s.options.ffmpegImageCommand = "cp $INPUT"
+
+	jobs, err := s.planJobs(&syncDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := s.executeJobs(jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := s.buildSummary(&syncDB{}, &syncDB{Entries: entries}, jobs)
+
+	if len(sum.failed) != 2 {
+		t.Errorf("got %d failures, want 2", len(sum.failed))
+	}
+	if a := sum.albums[s.pathKey("A")]; a == nil || a.added != 1 || !a.remains {
+		t.Errorf("album A is %+v, want it added with one file", a)
+	}
+	if a := sum.albums[s.pathKey("B")]; a != nil && (a.added != 0 || a.remains) {
+		t.Errorf("album B is %+v, want it not added", a)
+	}
+}
+
+func TestProcessJobInterrupted(t *testing.T) {
+	s := newTestSyncer(t, "A/01.flac")
+	s.options.ffmpegAudioFallbacks = []string{"cp $INPUT $OUTPUT"}
+	jobs, err := s.planJobs(&syncDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	_, err = s.processJob(jobs[0], func(template string, job syncJob) error {
+		calls++
+		return errInterrupted
+	})
+
+	if !errors.Is(err, errInterrupted) {
+		t.Errorf("got error %v, want %v", err, errInterrupted)
+	}
+	if calls != 1 {
+		t.Errorf("ran %d commands, want no fallbacks after an interruption", calls)
+	}
+}
+
+func TestSyncMassChange(t *testing.T) {
+	s := newTestSyncer(t, "A/01.flac", "A/02.flac")
+	s.options.maxChanges = 1
+
+	_, err := s.sync(context.Background(), nil)
+	if !errors.Is(err, errTooManyChanges) {
+		t.Fatalf("got error %v, want %v", err, errTooManyChanges)
+	}
+	checkFiles(t, s.options.targetDir, nil, []string{"A/01.opus", "A/02.opus"})
+
+	var asked []int
+	events := &syncEvents{ConfirmMassChange: func(files, limit int) bool {
+		asked = append(asked, files, limit)
+		return true
+	}}
+	if _, err := s.sync(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+	if len(asked) != 2 || asked[0] != 2 || asked[1] != 1 {
+		t.Errorf("asked about %v, want 2 files over a limit of 1", asked)
+	}
+	checkFiles(t, s.options.targetDir, []string{"A/01.opus", "A/02.opus"}, nil)
+}
+
+func TestSyncOversizeFail(t *testing.T) {
+	s := newTestSyncer(t, "A/01.flac", "A/long track.flac")
+	s.options.maxFileSize = 10
+	s.options.oversizePolicy = oversizeFail
+
+	summary, err := s.sync(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(summary.failed) != 1 || summary.failed[0].SourcePath != filepath.FromSlash("A/long track.flac") {
+		t.Errorf("got failures %v, want A/long track.flac", summary.failed)
+	}
+	checkFiles(t, s.options.targetDir, []string{"A/01.opus"}, []string{"A/long track.opus"})
+}
+
+func TestAddPending(t *testing.T) {
+	pending := make(map[string]bool)
+	for i := range maxPendingDirs {
+		addPending(pending, fmt.Sprintf("Artist/Album %d", i))
+	}
+	if len(pending) != maxPendingDirs {
+		t.Fatalf("got %d pending directories, want %d", len(pending), maxPendingDirs)
+	}
+
+	addPending(pending, "Artist/One more")
+	addPending(pending, "Artist/And another")
+
+	if len(pending) != 1 || !pending["."] {
+		t.Errorf("got %d pending directories, want a rescan of the whole source", len(pending))
+	}
+}
+
+func TestSyncDirsFinishesRun(t *testing.T) {
+	s := newTestSyncer(t, "A/01.flac", "B/01.flac")
+	if _, err := s.sync(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	marker := filepath.Join(s.options.targetDir, lastSyncFileName)
+	if err := os.Remove(marker); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(s.options.sourceDir, "B", "02.flac"), "B/02.flac")
+
+	if err := s.syncDirs([]string{"B"}); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, s.options.targetDir, []string{"A/01.opus", "B/01.opus", "B/02.opus", lastSyncFileName}, nil)
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+type SyncDBEntry struct {
+	SourcePath string `json:"sourcePath"`
+	TargetPath string `json:"targetPath"`
+	// FullTargetPath is the target path TargetPath was shortened from by
+	// --max-path-length, if it was.
+	FullTargetPath string    `json:"fullTargetPath,omitempty"`
+	Size           int64     `json:"size"`
+	ModTime        time.Time `json:"modTime"`
+	Command        string    `json:"command"`
+	// Variant is the index of the command variant that produced the target:
+	// 0 for the primary command, 1 and up for the fallbacks in order.
+	Variant int `json:"variant,omitempty"`
+	// AudioHash is a hash of the decoded audio of the source, used to tell
+	// tag-only changes apart from real ones.
+	AudioHash string `json:"audioHash,omitempty"`
+	// SourceHash is a SHA-256 of the source file as it was when it was
+	// processed, used by scrub to detect silent corruption.
+	SourceHash string `json:"sourceHash,omitempty"`
+	// Status is one of the status constants. Entries written before the
+	// field existed have an empty status, which means ok.
+	Status    string `json:"status,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+	// Attempts counts how often the current source was processed, including
+	// failed attempts. It starts over once a file was processed successfully.
+	Attempts int `json:"attempts,omitempty"`
+	// Duration is how long the last processing attempt took.
+	Duration time.Duration `json:"duration,omitempty"`
+	// Thumbnail is the path of the thumbnail rendered for the source
+	// (relative to the target) with ThumbnailCommand, see --thumbnails.
+	Thumbnail        string `json:"thumbnail,omitempty"`
+	ThumbnailCommand string `json:"thumbnailCommand,omitempty"`
+	// Cue is the path of the cue sheet written for the source (relative to
+	// the target), see --cue-sheets. NoChapters is set when the source was
+	// found to have no chapters, so it isn't checked again until it changes.
+	Cue        string `json:"cue,omitempty"`
+	NoChapters bool   `json:"noChapters,omitempty"`
+	// Adopted is set when import took over a target that has another name
+	// than a sync would give it (see findTargetByStem). It is kept as long
+	// as the file doesn't need processing.
+	Adopted bool `json:"adopted,omitempty"`
+	// Audio describes the audio of the source, see --audio-info.
+	Audio *AudioInfo `json:"audio,omitempty"`
+	// Tags are the tags of the source --filter uses, "" for those it
+	// doesn't have.
+	Tags map[string]string `json:"tags,omitempty"`
+	// CorrectionSize and CorrectionModTime describe the WavPack correction
+	// file of the source, if it has one.
+	CorrectionSize    int64      `json:"correctionSize,omitempty"`
+	CorrectionModTime *time.Time `json:"correctionModTime,omitempty"`
+}
+
+const (
+	statusOK          = "ok"
+	statusFailed      = "failed"
+	statusPending     = "pending"
+	statusQuarantined = "quarantined"
+	statusSkipped     = "skipped-by-filter"
+)
+
+// isOK reports whether the entry describes a successfully processed file.
+func (e SyncDBEntry) isOK() bool {
+	return e.Status == "" || e.Status == statusOK
+}
+
+// failed reports whether the entry is for a file that failed to process, so
+// its target wasn't written.
+func (e SyncDBEntry) failed() bool {
+	return e.Status == statusFailed || e.Status == statusQuarantined
+}
+
+// hasTarget reports whether the target file of the entry is supposed to
+// exist, i.e. it must not be deleted.
+func (e SyncDBEntry) hasTarget() bool {
+	return e.TargetPath != "" && e.Status != statusSkipped
+}
+
+// normalizeModTime rounds a modification time down to window (the
+// --mtime-window), so the DB doesn't store precision the filesystems
+// involved can't keep.
+func normalizeModTime(t time.Time, window time.Duration) time.Time {
+	if window <= 0 {
+		return t
+	}
+	return t.Truncate(window)
+}
+
+// sameModTime compares a modification time from the DB with one from the
+// filesystem, allowing for the --mtime-window.
+func (s *syncer) sameModTime(stored, actual time.Time) bool {
+	if s.options.mtimeWindow <= 0 {
+		return stored.Equal(actual)
+	}
+	d := actual.Sub(stored)
+	if d < 0 {
+		d = -d
+	}
+	return d <= s.options.mtimeWindow
+}
+
+// Values of --path-match.
+const (
+	pathMatchExact           = "exact"
+	pathMatchNormalized      = "normalized"
+	pathMatchCaseInsensitive = "case-insensitive"
+)
+
+// pathKey returns what a relative path is matched by between the DB and the
+// source. Depending on --path-match, paths that only differ in their
+// separators, Unicode normalization or case are treated as the same file, so
+// moving a library between systems doesn't make everything look new.
+func (s *syncer) pathKey(p string) string {
+	switch s.options.pathMatch {
+	case pathMatchNormalized:
+		return norm.NFC.String(strings.ReplaceAll(p, `\`, "/"))
+	case pathMatchCaseInsensitive:
+		return lookupKey(p)
+	}
+	return p
+}
+
+// lookupKey is the loosest pathKey. The SQLite backend indexes the source
+// paths by it, so a lookup finds the entry whatever --path-match is.
+func lookupKey(p string) string {
+	return strings.ToLower(norm.NFC.String(strings.ReplaceAll(p, `\`, "/")))
+}
+
+type syncDB struct {
+	Entries []SyncDBEntry `json:"entries"`
+
+	// bySource and byTarget index Entries by the pathKey of their source
+	// path and by their target path. They are (re)built when Entries grew
+	// or shrank since they were last built.
+	bySource       map[string]int
+	byTarget       map[string]int
+	sourcesIndexed int
+	targetsIndexed int
+
+	// store is set while the entries of a SQLite DB are still in the file,
+	// see openDBFile. Until load reads them, find looks them up there.
+	store *sqliteStore
+}
+
+func (db *syncDB) indexSources(key func(string) string) {
+	if db.bySource != nil && db.sourcesIndexed == len(db.Entries) {
+		return
+	}
+	db.bySource = make(map[string]int, len(db.Entries))
+	for i, e := range db.Entries {
+		if _, ok := db.bySource[key(e.SourcePath)]; !ok {
+			db.bySource[key(e.SourcePath)] = i
+		}
+	}
+	db.sourcesIndexed = len(db.Entries)
+}
+
+func (db *syncDB) indexTargets() {
+	if db.byTarget != nil && db.targetsIndexed == len(db.Entries) {
+		return
+	}
+	db.byTarget = make(map[string]int, len(db.Entries))
+	for i, e := range db.Entries {
+		if _, ok := db.byTarget[e.TargetPath]; !ok && e.hasTarget() {
+			db.byTarget[e.TargetPath] = i
+		}
+		if _, ok := db.byTarget[e.Thumbnail]; !ok && e.Thumbnail != "" {
+			db.byTarget[e.Thumbnail] = i
+		}
+		if _, ok := db.byTarget[e.Cue]; !ok && e.Cue != "" {
+			db.byTarget[e.Cue] = i
+		}
+	}
+	db.targetsIndexed = len(db.Entries)
+}
+
+// find returns the entry for a source path (relative to the source), or nil.
+// key is the pathKey the source paths are matched by.
+func (db *syncDB) find(key func(string) string, relPath string) *SyncDBEntry {
+	if db.store != nil {
+		return db.store.find(key, relPath)
+	}
+	db.indexSources(key)
+	if i, ok := db.bySource[key(relPath)]; ok {
+		return &db.Entries[i]
+	}
+	return nil
+}
+
+// findTarget returns the entry owning a target path (relative to the
+// target), or nil.
+func (db *syncDB) findTarget(relPath string) *SyncDBEntry {
+	db.indexTargets()
+	if i, ok := db.byTarget[relPath]; ok {
+		return &db.Entries[i]
+	}
+	return nil
+}
+
+// loadDB reads the DB at path into db, if there is one. When there is none
+// but the other backend has a DB next to it, that one is read instead, so
+// switching --db-backend carries the DB over. An encrypted DB that can't be
+// read ends the program, rather than everything looking new.
+func (s *syncer) loadDB(db *syncDB, path string) {
+	err := s.openDB(db, path)
+	if err == nil {
+		err = db.load()
+	}
+	if err != nil {
+		fmt.Printf("Error reading DB %s: %v\n", path, err)
+		exit(1)
+	}
+}
+
+// openDB is loadDB returning the error of an encrypted DB it can't read.
+// Unlike loadDB, it leaves the entries of a SQLite DB in the file (see
+// openDBFile): the caller has to load them before going through them.
+func (s *syncer) openDB(db *syncDB, path string) error {
+	err := s.openDBFile(db, path)
+	if os.IsNotExist(err) {
+		err = s.openDBFile(db, otherBackendPath(path))
+	}
+	if errors.Is(err, errEncrypted) || errors.Is(err, errDecrypt) {
+		return err
+	}
+	return nil
+}
+
+// openExistingDB is openDB for commands that can't do without the DB: a DB
+// that is missing or can't be read is an error as well.
+func (s *syncer) openExistingDB(db *syncDB, path string) error {
+	err := s.readDB(db, path)
+	if os.IsNotExist(err) {
+		if err = s.readDB(db, otherBackendPath(path)); os.IsNotExist(err) {
+			return fmt.Errorf("there is no DB")
+		}
+	}
+	return err
+}
+
+// readDB reads a DB file of either backend, telling them apart by extension.
+func (s *syncer) readDB(db *syncDB, path string) error {
+	if err := s.openDBFile(db, path); err != nil {
+		return err
+	}
+	return db.load()
+}
+
+// openDBFile is readDB without reading the entries of a SQLite DB: they are
+// looked up by source path in the file, through its index, until load reads
+// them all. That keeps the scan of the source, which only looks up the
+// files it finds, from waiting for the whole DB first.
+func (s *syncer) openDBFile(db *syncDB, path string) error {
+	if isSQLiteDB(path) {
+		return db.openSQLite(path)
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		data, err = s.openInternal(data)
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, db)
+}
+
+func (s *syncer) writeDB(db *syncDB, path string) error {
+	// Entries still in a file would be lost.
+	if err := db.load(); err != nil {
+		return err
+	}
+	var err error
+	if isSQLiteDB(path) {
+		err = db.writeSQLite(path)
+	} else {
+		data, _ := json.MarshalIndent(db, "", "  ")
+		err = os.WriteFile(path, s.sealInternal(data), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	return s.perms.apply(path, false)
+}
+
+// saveDB writes db to path. Once that worked, a DB left behind by the
+// other backend is removed, so there is only ever one DB in the target.
+func (s *syncer) saveDB(db *syncDB, path string) {
+	if err := s.writeDB(db, path); err != nil {
+		fmt.Println("Error saving DB:", err)
+		return
+	}
+	os.Remove(otherBackendPath(path))
+}
+
+const snapshotDirName = ".syncdb.snapshots"
+
+// snapshotDir returns the directory the snapshots of the DB at dbPath are
+// kept in: snapshotDirName, or one named after the DB with --db-name.
+func snapshotDir(dbPath string) string {
+	return strings.TrimSuffix(dbPath, filepath.Ext(dbPath)) + filepath.Ext(snapshotDirName)
+}
+
+// snapshotDB copies the current DB file into the snapshot directory before it
+// gets overwritten, keeping only the newest keep snapshots.
+func (s *syncer) snapshotDB(dbPath string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	// Snapshots are always JSON, whatever the backend.
+	var db syncDB
+	err := s.readDB(&db, dbPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	data, _ := json.MarshalIndent(db, "", "  ")
+
+	dir := snapshotDir(dbPath)
+	if err := s.perms.makeDirs(dir); err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format("20060102T150405.000000000Z") + ".json"
+	if err := os.WriteFile(filepath.Join(dir, name), s.sealInternal(data), 0644); err != nil {
+		return err
+	}
+	if err := s.perms.apply(filepath.Join(dir, name), false); err != nil {
+		return err
+	}
+
+	snapshots, err := listSnapshots(dbPath)
+	if err != nil {
+		return err
+	}
+	for len(snapshots) > keep {
+		os.Remove(filepath.Join(dir, snapshots[0]))
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+// listSnapshots returns the snapshot file names, oldest first.
+func listSnapshots(dbPath string) ([]string, error) {
+	entries, err := os.ReadDir(snapshotDir(dbPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// rollbackDB replaces the DB with a snapshot. The current DB is snapshotted
+// first so the rollback itself can be undone. steps counts back from the
+// newest snapshot (1 is the newest), name selects a snapshot directly.
+func (s *syncer) rollbackDB(dbPath string, steps int, name string) (string, error) {
+	snapshots, err := listSnapshots(dbPath)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		if steps < 1 || steps > len(snapshots) {
+			return "", fmt.Errorf("only %d snapshots available", len(snapshots))
+		}
+		name = snapshots[len(snapshots)-steps]
+	}
+
+	data, err := os.ReadFile(filepath.Join(snapshotDir(dbPath), name))
+	if err == nil {
+		data, err = s.openInternal(data)
+	}
+	if err != nil {
+		return "", err
+	}
+	var db syncDB
+	if err := json.Unmarshal(data, &db); err != nil {
+		return "", fmt.Errorf("snapshot %s is not a valid DB: %v", name, err)
+	}
+
+	// Keep one more than we have so the rollback doesn't rotate out the
+	// snapshot we're restoring.
+	if err := s.snapshotDB(dbPath, len(snapshots)+1); err != nil {
+		return "", err
+	}
+	return name, s.writeDB(&db, dbPath)
+}
+
+// remapDB rewrites the source and target paths of the DB entries with
+// mapPathPrefix, for when the library or the target was moved or renamed
+// outside of the program. The DB is snapshotted first.
+func (s *syncer) remapDB(dbPath string, sourceMaps, targetMaps []string) (int, error) {
+	if len(sourceMaps) == 0 && len(targetMaps) == 0 {
+		return 0, fmt.Errorf("nothing to remap, use --map-source and/or --map-target")
+	}
+	var db syncDB
+	if err := s.readDB(&db, dbPath); err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for i := range db.Entries {
+		e := &db.Entries[i]
+		source := mapPathPrefix(e.SourcePath, sourceMaps)
+		target := e.TargetPath
+		if e.hasTarget() {
+			target = mapPathPrefix(e.TargetPath, targetMaps)
+		}
+		if source == e.SourcePath && target == e.TargetPath {
+			continue
+		}
+		fmt.Printf("Remapped: %s -> %s\n", e.SourcePath, source)
+		e.SourcePath, e.TargetPath = source, target
+		changed++
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+	if err := s.snapshotDB(dbPath, s.options.dbSnapshots); err != nil {
+		return 0, err
+	}
+	s.saveDB(&db, dbPath)
+	return changed, nil
+}
+
+// runDBCommand runs one of the "db" subcommands.
+func (s *syncer) runDBCommand(command string, steps int, snapshot string, sourceMaps, targetMaps []string) error {
+	dbPath := s.syncDBPath()
+	switch command {
+	case "db snapshots":
+		snapshots, err := listSnapshots(dbPath)
+		if err != nil {
+			return err
+		}
+		if len(snapshots) == 0 {
+			fmt.Println("No snapshots.")
+		}
+		for i := len(snapshots) - 1; i >= 0; i-- {
+			fmt.Printf("%3d  %s\n", len(snapshots)-i, snapshots[i])
+		}
+	case "db rollback":
+		name, err := s.rollbackDB(dbPath, steps, snapshot)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restored DB snapshot %s. Run a sync to bring the target in line with it.\n", name)
+	case "db remap":
+		changed, err := s.remapDB(dbPath, sourceMaps, targetMaps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Remapped %d entries.\n", changed)
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+	return nil
+}
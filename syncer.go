@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+// syncer holds the options of a run and the state derived from them. The
+// planner and the executor hang off it rather than off package variables,
+// so what the workers of a run share is all in here, next to how it is
+// guarded.
+type syncer struct {
+	options optionsType
+
+	// artistMap holds explicit artist directory renames loaded from
+	// --artist-map, keyed by lower case name.
+	artistMap map[string]string
+	// pathCollator sorts paths for people to read, see --sort-locale.
+	pathCollator *nameCollator
+	// nameReplacement is the --name-replacement scheme in use.
+	nameReplacement func(r rune) string
+	// targetFSPreset is the --target-fs preset, if one was given. It takes
+	// precedence over the probed name limit.
+	targetFSPreset *fsPreset
+	// targetCaps holds the probed capabilities of the target. Until probing
+	// runs it assumes a permissive POSIX filesystem.
+	targetCaps fsCaps
+	// perms is how files and directories created in the target are set up.
+	perms targetPerms
+	// targetCommit is the commit strategy of the target, see setupTempDir.
+	targetCommit commitStrategy
+	// targetKey is set when the target is encrypted (--encrypt-key).
+	targetKey *targetCipher
+	// stagingRoot is a local directory where encrypted jobs are written in
+	// the clear before being encrypted into the target. Only set while jobs
+	// run.
+	stagingRoot string
+	// ratings maps relative source paths (files or directories) to their
+	// entry.
+	ratings map[string]ratingEntry
+	// configuredTargets are the targets of the config file, if it has any.
+	configuredTargets []configTarget
+	// claimedTargets holds the target files of the batches synced so far
+	// (lower case on case-insensitive targets), so collisions between
+	// batches are resolved. Only set while syncing in batches.
+	claimedTargets map[string]bool
+	// trashRun is the directory in the trash the files removed by this run
+	// go to.
+	trashRun string
+
+	// runCtx is cancelled when the run is interrupted. Commands are started
+	// with it, so they are killed and their partial outputs removed.
+	runCtx context.Context
+	// events gets the progress of the jobs: written by --progress-json, or
+	// the callbacks given to sync.
+	events *syncEvents
+
+	// dirConfigs caches the directory configs by source directory, for the
+	// workers that look them up while jobs run.
+	dirConfigsMu sync.Mutex
+	dirConfigs   map[string]*dirConfig
+
+	// otherDBOwners maps the target paths recorded in the other DBs in the
+	// target to the name of the DB. It is read once, when first needed.
+	otherDBsOnce  sync.Once
+	otherDBOwners map[string]string
+}
+
+// newSyncer returns a syncer with the default settings, for main to fill
+// in the options.
+func newSyncer() *syncer {
+	s := &syncer{
+		artistMap:       map[string]string{},
+		pathCollator:    newNameCollator(language.Und, nil),
+		nameReplacement: nameReplacements["remove"],
+		targetCaps:      fsCaps{caseSensitive: true, maxNameLength: 255, nameUnit: nameUnitBytes, symlinks: true, mtimeResolution: time.Nanosecond},
+		perms:           targetPerms{uid: -1, gid: -1},
+		trashRun:        time.Now().UTC().Format(trashStampFormat),
+		runCtx:          context.Background(),
+		dirConfigs:      make(map[string]*dirConfig),
+	}
+	s.targetCommit = renameCommit{&s.perms}
+	return s
+}
+
+// forRun returns a new syncer with the options of s and what was loaded for
+// them (the artist map, ratings, key, ...), but none of the state of a run,
+// for a process that runs several syncs, like the GUI.
+func (s *syncer) forRun() *syncer {
+	r := newSyncer()
+	r.options = s.options
+	r.artistMap, r.pathCollator, r.nameReplacement = s.artistMap, s.pathCollator, s.nameReplacement
+	r.targetFSPreset, r.perms, r.targetKey = s.targetFSPreset, s.perms, s.targetKey
+	r.ratings, r.configuredTargets = s.ratings, s.configuredTargets
+	return r
+}
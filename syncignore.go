@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreFileName is the file with gitignore-style patterns of source files
+// and directories that are never synced. It applies to the directory it is
+// in and everything below.
+const ignoreFileName = ".syncignore"
+
+// ignoreRule is a pattern of a .syncignore file.
+type ignoreRule struct {
+	// base is the directory of the .syncignore file, paths are matched
+	// relative to it.
+	base    string
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// readIgnoreFile returns the rules of the .syncignore file in dir, if there
+// is one. Like in .gitignore, blank lines and lines starting with # are
+// skipped, ! re-includes what an earlier pattern excluded, a trailing slash
+// only matches directories, and a pattern with a slash in front or in the
+// middle is relative to the directory of the file rather than matching a
+// name anywhere below it. Invalid patterns are ignored.
+func readIgnoreFile(dir string) []ignoreRule {
+	data, err := os.ReadFile(filepath.Join(dir, ignoreFileName))
+	if err != nil {
+		return nil
+	}
+	var rules []ignoreRule
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimRight(line, " ")
+		rule := ignoreRule{base: dir}
+		if strings.HasPrefix(line, "!") {
+			rule.negate, line = true, line[1:]
+		}
+		line = strings.TrimPrefix(line, `\`)
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		if rule.pattern, err = compileGlob(line); err == nil && line != "" {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// ignored reports whether path is excluded by rules, the last matching rule
+// winning.
+func ignored(rules []ignoreRule, path string, isDir bool) bool {
+	result := false
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		rel, err := filepath.Rel(rule.base, path)
+		if err != nil {
+			continue
+		}
+		if rule.pattern.MatchString(filepath.ToSlash(rel)) {
+			result = !rule.negate
+		}
+	}
+	return result
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// tagFilterReason is the skip reason of files --filter leaves out.
+const tagFilterReason = "filtered by tags"
+
+// tagFilter is a parsed --filter expression, like
+//
+//	genre != "Audiobook" && (rating >= 3 || album =~ "(?i)live")
+//
+// Fields are tags of the file, compared with == != < <= > >= (as numbers if
+// both sides are numbers, otherwise as text, == and != ignoring case) or
+// matched against a regular expression with =~ and !~. A field on its own
+// is true if the file has the tag. Missing tags are empty.
+type tagFilter struct {
+	expr   tagExpr
+	fields []string
+}
+
+// tagExpr is a node of a --filter expression. get returns the value of a
+// field for the file being matched.
+type tagExpr interface {
+	match(get func(field string) string) bool
+}
+
+type (
+	tagAnd     struct{ left, right tagExpr }
+	tagOr      struct{ left, right tagExpr }
+	tagNot     struct{ expr tagExpr }
+	tagPresent struct{ field string }
+	tagCompare struct {
+		field string
+		op    string
+		value string
+		re    *regexp.Regexp
+	}
+)
+
+func (e tagAnd) match(get func(string) string) bool { return e.left.match(get) && e.right.match(get) }
+func (e tagOr) match(get func(string) string) bool  { return e.left.match(get) || e.right.match(get) }
+func (e tagNot) match(get func(string) string) bool { return !e.expr.match(get) }
+func (e tagPresent) match(get func(string) string) bool {
+	return get(e.field) != ""
+}
+
+func (e tagCompare) match(get func(string) string) bool {
+	value := get(e.field)
+	switch e.op {
+	case "=~":
+		return e.re.MatchString(value)
+	case "!~":
+		return !e.re.MatchString(value)
+	}
+	a, errA := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	b, errB := strconv.ParseFloat(e.value, 64)
+	cmp := 0
+	if errA == nil && errB == nil {
+		cmp = compareFloats(a, b)
+	} else {
+		cmp = strings.Compare(strings.ToLower(value), strings.ToLower(e.value))
+	}
+	switch e.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// parseTagFilter parses a --filter expression.
+func parseTagFilter(s string) (*tagFilter, error) {
+	p := &tagParser{tokens: tokenizeTagFilter(s)}
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok != "" {
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+	return &tagFilter{expr: expr, fields: p.fields}, nil
+}
+
+// tokenizeTagFilter splits a --filter expression into names, quoted
+// strings (quotes included), numbers and operators.
+func tokenizeTagFilter(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(s) && s[j] != s[i] {
+				if s[j] == '\\' && s[i] == '"' {
+					j++
+				}
+				j++
+			}
+			tokens = append(tokens, s[i:min(j+1, len(s))])
+			i = j + 1
+		case strings.ContainsRune("=!<>&|~", c):
+			j := i + 1
+			for j < len(s) && strings.ContainsRune("=&|~", rune(s[j])) && j-i < 2 {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			j := i
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) && !strings.ContainsRune("\"'=!<>&|~()", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+// tagParser parses the tokens of a --filter expression by recursive
+// descent, collecting the fields it uses.
+type tagParser struct {
+	tokens []string
+	pos    int
+	fields []string
+}
+
+func (p *tagParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *tagParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *tagParser) or() (tagExpr, error) {
+	left, err := p.and()
+	for err == nil && p.peek() == "||" {
+		p.next()
+		var right tagExpr
+		if right, err = p.and(); err == nil {
+			left = tagOr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *tagParser) and() (tagExpr, error) {
+	left, err := p.unary()
+	for err == nil && p.peek() == "&&" {
+		p.next()
+		var right tagExpr
+		if right, err = p.unary(); err == nil {
+			left = tagAnd{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *tagParser) unary() (tagExpr, error) {
+	switch tok := p.next(); {
+	case tok == "!":
+		expr, err := p.unary()
+		return tagNot{expr}, err
+	case tok == "(":
+		expr, err := p.or()
+		if err == nil && p.next() != ")" {
+			err = fmt.Errorf("missing )")
+		}
+		return expr, err
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end of the expression")
+	case !isTagFieldName(tok):
+		return nil, fmt.Errorf("expected a tag name, not %q", tok)
+	default:
+		field := strings.ToLower(tok)
+		if !slices.Contains(p.fields, field) {
+			p.fields = append(p.fields, field)
+		}
+		switch op := p.peek(); op {
+		case "==", "!=", "<", "<=", ">", ">=", "=~", "!~":
+			p.next()
+			value, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			cmp := tagCompare{field: field, op: op, value: value}
+			if op == "=~" || op == "!~" {
+				if cmp.re, err = regexp.Compile(value); err != nil {
+					return nil, err
+				}
+			}
+			return cmp, nil
+		}
+		return tagPresent{field}, nil
+	}
+}
+
+// literal parses the value a field is compared with: a quoted string or a
+// number.
+func (p *tagParser) literal() (string, error) {
+	tok := p.next()
+	switch {
+	case tok == "":
+		return "", fmt.Errorf("unexpected end of the expression")
+	case strings.HasPrefix(tok, `"`):
+		return strconv.Unquote(tok)
+	case strings.HasPrefix(tok, "'"):
+		if len(tok) < 2 || !strings.HasSuffix(tok, "'") {
+			return "", fmt.Errorf("unterminated string %s", tok)
+		}
+		return tok[1 : len(tok)-1], nil
+	}
+	if _, err := strconv.ParseFloat(tok, 64); err != nil {
+		return "", fmt.Errorf("expected a quoted string or a number, not %q", tok)
+	}
+	return tok, nil
+}
+
+func isTagFieldName(tok string) bool {
+	for i, c := range tok {
+		if !unicode.IsLetter(c) && c != '_' && (i == 0 || !unicode.IsDigit(c) && c != '-' && c != ':') {
+			return false
+		}
+	}
+	return tok != ""
+}
+
+// probeTags returns the tags of the file at path named in fields, with ""
+// for those it doesn't have, so the result can be recorded and tells what
+// was looked for. Tags of the container and of the audio stream (where Ogg
+// keeps them) are merged, names are lower case.
+func (s *syncer) probeTags(path string, fields []string) (map[string]string, error) {
+	args := slices.Concat([]string{"-v", "error", "-select_streams", "a:0",
+		"-show_entries", "format_tags:stream_tags", "-of", "json"}, inputFormatArgs(path), []string{path})
+	output, err := exec.CommandContext(s.runCtx, ffprobeBinary, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe: %w", err)
+	}
+	var probe struct {
+		Streams []struct {
+			Tags map[string]string `json:"tags"`
+		} `json:"streams"`
+		Format struct {
+			Tags map[string]string `json:"tags"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return nil, fmt.Errorf("ffprobe: %w", err)
+	}
+	all := make(map[string]string)
+	for _, stream := range probe.Streams {
+		for k, v := range stream.Tags {
+			all[strings.ToLower(k)] = v
+		}
+	}
+	for k, v := range probe.Format.Tags {
+		all[strings.ToLower(k)] = v
+	}
+	tags := make(map[string]string, len(fields))
+	for _, field := range fields {
+		tags[field] = all[field]
+		if field == "year" && tags[field] == "" && len(all["date"]) >= 4 {
+			tags[field] = all["date"][:4]
+		}
+	}
+	return tags, nil
+}
+
+// hasTagFields reports whether recorded tags were probed for all fields.
+func hasTagFields(tags map[string]string, fields []string) bool {
+	for _, field := range fields {
+		if _, ok := tags[field]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// applyTagFilter keeps only the audio files whose tags match --filter. The
+// tags are recorded in the DB, so unchanged files aren't probed again. Like
+// with --ratings-file, images and sidecar files follow the music of their
+// directory, and playlists are kept. Files that can't be probed are kept.
+// A rating field without a tag of that name comes from --ratings-file.
+func (s *syncer) applyTagFilter(jobs []syncJob) {
+	filter := s.options.tagFilter
+	if filter == nil {
+		return
+	}
+	selectedDirs := make(map[string]bool)
+	for i := range jobs {
+		job := &jobs[i]
+		if job.skipReason != "" || job.isImage || job.sidecar || job.playlist || !s.isAudioExtension(extOf(job.sourcePath)) {
+			continue
+		}
+		if e := job.existingEntry; e != nil && hasTagFields(e.Tags, filter.fields) && !s.sourceChanged(*job) {
+			job.tags = e.Tags
+		} else {
+			tags, err := s.probeTags(job.sourcePath, filter.fields)
+			if err != nil {
+				s.planLog("Error reading the tags of %s: %v\n", job.relPath, err)
+				selectedDirs[filepath.Dir(job.relPath)] = true
+				continue
+			}
+			job.tags = tags
+		}
+		get := func(field string) string {
+			if field == "rating" && job.tags[field] == "" && s.ratings != nil {
+				if e, ok := s.lookupRating(job.relPath); ok {
+					return strconv.FormatFloat(e.Rating, 'f', -1, 64)
+				}
+			}
+			return job.tags[field]
+		}
+		if filter.expr.match(get) {
+			selectedDirs[filepath.Dir(job.relPath)] = true
+		} else {
+			job.skipReason, job.filtered = tagFilterReason, true
+		}
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		if job.skipReason == "" && (job.isImage || job.sidecar) && !selectedDirs[filepath.Dir(job.relPath)] {
+			job.skipReason, job.filtered = tagFilterReason, true
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// tagArgs returns the ffmpeg options for the tag version of MP3 targets
+// (--id3v2-version, --id3v1). ffmpeg writes ID3v2.4 in UTF-8 by default,
+// which many older car stereos can't read. With ID3v2.3 it writes ISO-8859-1
+// where the text allows it and UTF-16 otherwise.
+func (s *syncer) tagArgs() []string {
+	if !strings.EqualFold(s.options.targetAudioExtension, "mp3") {
+		return nil
+	}
+	var args []string
+	if s.options.id3v2Version != 0 {
+		args = append(args, "-id3v2_version", fmt.Sprint(s.options.id3v2Version))
+	}
+	if s.options.id3v1 {
+		args = append(args, "-write_id3v1", "1")
+	}
+	return args
+}
+
+// withTagArgs inserts tagArgs into an ffmpeg command template, in front of
+// the argument with $OUTPUT. Other commands and templates that set the tag
+// version themselves are left alone. As the template changes, the files are
+// converted again when the tag options change.
+func (s *syncer) withTagArgs(template string) string {
+	extra := s.tagArgs()
+	args := splitCommand(template)
+	if len(extra) == 0 || len(args) == 0 ||
+		strings.TrimSuffix(filepath.Base(args[0]), ".exe") != ffmpegBinary ||
+		strings.Contains(template, "-id3v2_version") || strings.Contains(template, "-write_id3v1") {
+		return template
+	}
+	i := strings.LastIndex(template, "$OUTPUT")
+	if i < 0 {
+		return template
+	}
+	// The start of the argument, which may be quoted.
+	start := strings.LastIndexAny(template[:i], " \t") + 1
+	return template[:start] + strings.Join(extra, " ") + " " + template[start:]
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// targetsKey is the config file key of the targets synced in one run, each a
+// table of the options that differ for it:
+//
+//	source = "/music"
+//
+//	[[targets]]
+//	name = "phone"
+//	target = "/mnt/phone/Music"
+//	preset = "opus-96"
+//
+//	[[targets]]
+//	name = "car"
+//	target = "/media/usb"
+//	preset = "mp3-320"
+//	max-file-size = "4GiB"
+const targetsKey = "targets"
+
+// sharedSourceOptions decide which source files are walked. They can't
+// differ between targets, which share the walk.
+var sharedSourceOptions = map[string]bool{
+	"source":          true,
+	"marked-only":     true,
+	"skip-hidden":     true,
+	"follow-symlinks": true,
+	"files-from":      true,
+	"batch-dirs":      true,
+	"watch":           true,
+	"watch-delay":     true,
+	"watch-poll":      true,
+}
+
+// configTarget is one of the targets of the config file.
+type configTarget struct {
+	name   string
+	values map[string]any
+}
+
+// parseTargets takes the targets out of the values of a config file. A
+// target is called by its name, or its target directory if it has none.
+func parseTargets(values map[string]any) ([]configTarget, error) {
+	raw, ok := values[targetsKey]
+	if !ok {
+		return nil, nil
+	}
+	delete(values, targetsKey)
+	var list []any
+	switch raw := raw.(type) {
+	case []any:
+		list = raw
+	case []map[string]any:
+		// TOML arrays of tables.
+		for _, table := range raw {
+			list = append(list, table)
+		}
+	default:
+		return nil, fmt.Errorf("%s must be a list of tables", targetsKey)
+	}
+	var targets []configTarget
+	seen := make(map[string]bool)
+	for i, item := range list {
+		table, ok := toStringMap(item)
+		if !ok {
+			return nil, fmt.Errorf("%s[%d] must be a table", targetsKey, i+1)
+		}
+		if _, ok := table["target"]; !ok {
+			return nil, fmt.Errorf("%s[%d] has no target", targetsKey, i+1)
+		}
+		name := fmt.Sprint(table["target"])
+		if n, ok := table["name"]; ok {
+			name = fmt.Sprint(n)
+			delete(table, "name")
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s[%d]: there is another target called %q", targetsKey, i+1, name)
+		}
+		seen[name] = true
+		for key := range table {
+			if sharedSourceOptions[key] || commandLineOnlyFlags[key] {
+				return nil, fmt.Errorf("target %q: option %q can't be set per target", name, key)
+			}
+		}
+		targets = append(targets, configTarget{name: name, values: table})
+	}
+	return targets, nil
+}
+
+// toStringMap returns a table of a config file as a map. YAML decodes
+// nested tables as map[string]any like TOML does, this is just in case.
+func toStringMap(v any) (map[string]any, bool) {
+	switch m := v.(type) {
+	case map[string]any:
+		return m, true
+	case map[any]any:
+		out := make(map[string]any, len(m))
+		for k, v := range m {
+			out[fmt.Sprint(k)] = v
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+// selectTarget merges the values of the target called name over the common
+// values of the config file.
+func selectTarget(targets []configTarget, name string, values map[string]any) error {
+	for _, t := range targets {
+		if t.name == name {
+			for key, v := range t.values {
+				values[key] = v
+			}
+			return nil
+		}
+	}
+	names := make([]string, len(targets))
+	for i, t := range targets {
+		names[i] = t.name
+	}
+	return fmt.Errorf("no target called %q, the config has %s", name, strings.Join(names, ", "))
+}
+
+// runTargets runs the command once for every target of the config file, one
+// after the other, each in a process of its own with --only-target: every
+// target keeps its own lock, DB and settings, and one failing doesn't stop
+// the others. For sync the source is walked once, and the list of files
+// handed to every run with --files-from. It returns the exit status of the
+// first target that failed.
+func (s *syncer) runTargets(command string) int {
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	var extra []string
+	if command == "sync" && s.options.filesFrom == "" && s.options.sourceDir != "" {
+		list, err := s.writeSourceList()
+		if err != nil {
+			fmt.Println("Error scanning the source:", err)
+			return 1
+		}
+		defer os.Remove(list)
+		extra = []string{"--files-from", list}
+	}
+
+	status := 0
+	for _, t := range s.configuredTargets {
+		fmt.Printf("=== Target %s ===\n", t.name)
+		args := append(append(os.Args[1:len(os.Args):len(os.Args)], "--only-target", t.name), extra...)
+		cmd := exec.Command(self, args...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		switch {
+		case errors.As(err, &exitErr):
+			fmt.Printf("Target %s failed (exit status %d)\n", t.name, exitErr.ExitCode())
+			if status == 0 {
+				status = exitErr.ExitCode()
+			}
+		case err != nil:
+			fmt.Printf("Error running target %s: %v\n", t.name, err)
+			if status == 0 {
+				status = 1
+			}
+		}
+		if s.interrupted() {
+			break
+		}
+	}
+	return status
+}
+
+// writeSourceList walks the source and writes the paths of its files
+// (relative to the source) to a temporary file, for --files-from.
+func (s *syncer) writeSourceList() (string, error) {
+	var b strings.Builder
+	err := s.walkSourceFiles(s.options.sourceDir, newMarkerState(&s.options), func(sourcePath string) {
+		rel, _ := filepath.Rel(s.options.sourceDir, sourcePath)
+		b.WriteString(filepath.ToSlash(rel) + "\n")
+	})
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp("", "smsync-files-*.txt")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(b.String())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
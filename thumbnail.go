@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Kinds of --thumbnails.
+const (
+	thumbnailSpectrogram = "spectrogram"
+	thumbnailWaveform    = "waveform"
+)
+
+// thumbnailCommand returns the command template rendering a thumbnail of the
+// given kind and size (WxH) as PNG.
+func thumbnailCommand(kind, size string) string {
+	filter := "showspectrumpic=s=" + size + ":legend=0"
+	if kind == thumbnailWaveform {
+		filter = "showwavespic=s=" + size + ":split_channels=0"
+	}
+	return "ffmpeg -nostdin -loglevel error -i $INPUT -lavfi " + filter + " -frames:v 1 $OUTPUT"
+}
+
+// thumbnailRelPath returns where the thumbnail of a target is stored: in the
+// thumbnail directory, mirroring the layout of the target.
+func (s *syncer) thumbnailRelPath(relTargetPath string) string {
+	return filepath.Join(s.options.thumbnailDir, strings.TrimSuffix(relTargetPath, filepath.Ext(relTargetPath))+".png")
+}
+
+// planThumbnails decides which audio files need their thumbnail rendered:
+// those that are converted again, and those whose thumbnail is missing or
+// was rendered with other settings. The latter don't touch the audio.
+func (s *syncer) planThumbnails(jobs []syncJob) {
+	if s.options.thumbnails == "" {
+		return
+	}
+	command := thumbnailCommand(s.options.thumbnails, s.options.thumbnailSize)
+	for i := range jobs {
+		job := &jobs[i]
+		if job.skipReason != "" || job.isImage || job.archive || job.playlist || job.sidecar {
+			continue
+		}
+		job.thumbnail = s.thumbnailRelPath(job.relTargetPath)
+		job.thumbnailCommand = command
+		e := job.existingEntry
+		job.needsThumbnail = job.needsProcessing && !job.metadataOnly ||
+			e == nil || e.Thumbnail != job.thumbnail || e.ThumbnailCommand != command ||
+			!fileExists(filepath.Join(s.options.targetDir, job.thumbnail))
+	}
+}
+
+// renderThumbnail renders the thumbnail of a job with run. A failed
+// thumbnail doesn't fail the job, it is just tried again on the next run.
+func (s *syncer) renderThumbnail(job *syncJob, run commandRunner) error {
+	if !job.needsThumbnail {
+		return nil
+	}
+	thumb := *job
+	thumb.targetFile = filepath.Join(s.options.targetDir, job.thumbnail)
+	if err := s.checkTargetPath(thumb.targetFile); err != nil {
+		fmt.Printf("Error rendering thumbnail of %s: %v\n", job.relPath, err)
+		return err
+	}
+	if err := s.perms.makeDirs(filepath.Dir(thumb.targetFile)); err != nil {
+		fmt.Printf("Error rendering thumbnail of %s: %v\n", job.relPath, err)
+		return err
+	}
+	if err := run(job.thumbnailCommand, thumb); err != nil {
+		return err
+	}
+	job.thumbnailOK = true
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// trashDirName is the directory in the target that --delete-mode trash moves
+// removed files into, one sub-directory per run.
+const trashDirName = ".smstrash"
+
+// Values of --delete-mode.
+const (
+	deleteModeRemove = "remove"
+	deleteModeTrash  = "trash"
+)
+
+// trashStampFormat names the directory of a run in the trash after the time
+// it started, so they sort by age.
+const trashStampFormat = "20060102T150405Z"
+
+// removeTarget deletes a file in the target that no source maps to anymore,
+// or with --delete-mode trash moves it into the trash, keeping its path
+// relative to the target. With --prune-empty-dirs, the directories this
+// leaves empty are removed as well.
+func (s *syncer) removeTarget(path string) error {
+	if err := s.deleteTarget(path); err != nil {
+		return err
+	}
+	if s.options.pruneEmptyDirs {
+		s.pruneEmptyDirs(filepath.Dir(path))
+	}
+	return nil
+}
+
+// deleteTarget deletes or trashes the file at path, see removeTarget.
+func (s *syncer) deleteTarget(path string) error {
+	if s.options.deleteMode != deleteModeTrash {
+		fmt.Printf("Deleting removed file: %s\n", path)
+		return os.Remove(path)
+	}
+	rel, err := filepath.Rel(s.options.targetDir, path)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(path); err != nil {
+		return err
+	}
+	dest := filepath.Join(s.options.targetDir, trashDirName, s.trashRun, rel)
+	fmt.Printf("Moving removed file to trash: %s\n", path)
+	if err := s.perms.makeDirs(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	return os.Rename(path, dest)
+}
+
+// pruneEmptyDirs removes dir if it is empty, then its parent if that is
+// empty now, and so on up to, but not including, the target directory.
+func (s *syncer) pruneEmptyDirs(dir string) {
+	for dir != s.options.targetDir && isWithin(dir, s.options.targetDir) {
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) > 0 {
+			return
+		}
+		fmt.Printf("Removing empty directory: %s\n", dir)
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// emptyTrash removes the runs in the trash that are older than retention.
+// A retention of 0 keeps them forever.
+func (s *syncer) emptyTrash(retention time.Duration) error {
+	if retention <= 0 {
+		return nil
+	}
+	dir := filepath.Join(s.options.targetDir, trashDirName)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-retention)
+	for _, entry := range entries {
+		stamp, err := time.Parse(trashStampFormat, entry.Name())
+		if err != nil || stamp.After(cutoff) {
+			continue
+		}
+		fmt.Printf("Emptying trash of %s\n", stamp.Local().Format(time.DateTime))
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// runWatch runs a full sync and then keeps watching the source for changes.
+// Changes are collected until the source has been quiet for delay, then only
+// the directories they happened in are rescanned and synced. With a poll
+// interval, the source is polled instead of relying on change notifications.
+func (s *syncer) runWatch(delay, poll time.Duration) {
+	s.runSync()
+	if poll > 0 {
+		s.pollSource(poll)
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Println("Error starting watcher:", err)
+		exit(1)
+	}
+	defer watcher.Close()
+	if err := s.addWatches(watcher, s.options.sourceDir); err != nil {
+		fmt.Println("Error watching source:", err)
+		exit(1)
+	}
+	fmt.Printf("Watching %s for changes...\n", s.options.sourceDir)
+
+	pending := make(map[string]bool)
+	var timer <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod || s.isInternalPath(event.Name, s.options.sourceDir) {
+				continue
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := s.addWatches(watcher, event.Name); err != nil {
+						fmt.Println("Error watching new directory:", err)
+					}
+				}
+			}
+			rel, err := filepath.Rel(s.options.sourceDir, event.Name)
+			if err != nil {
+				continue
+			}
+			addPending(pending, filepath.Dir(rel))
+			timer = time.After(delay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			fmt.Println("Error watching source:", err)
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// Events were lost, so rescan everything.
+				addPending(pending, ".")
+				timer = time.After(delay)
+			}
+		case <-s.runCtx.Done():
+			return
+		case <-timer:
+			s.syncPending(pending)
+			pending = make(map[string]bool)
+			timer = nil
+			fmt.Printf("Watching %s for changes...\n", s.options.sourceDir)
+		}
+	}
+}
+
+// maxPendingDirs bounds the changed directories collected while watching.
+// Past it, as when change events were lost, the whole source is rescanned.
+const maxPendingDirs = 1000
+
+// addPending adds a changed directory to those collected while watching,
+// collapsing them into a rescan of the whole source once there are more
+// than maxPendingDirs.
+func addPending(pending map[string]bool, dir string) {
+	if pending["."] {
+		return
+	}
+	if len(pending) >= maxPendingDirs {
+		clear(pending)
+		dir = "."
+	}
+	pending[dir] = true
+}
+
+// syncPending syncs the changed directories collected while watching.
+func (s *syncer) syncPending(pending map[string]bool) {
+	dirs := watchScopes(pending)
+	fmt.Printf("Changes detected in %s\n", strings.Join(dirs, ", "))
+	if err := s.syncDirs(dirs); err != nil {
+		fmt.Println("Error during processing:", err)
+		if errors.Is(err, errInterrupted) {
+			exit(exitStatus(err))
+		}
+	}
+}
+
+// pollSource watches the source by rescanning it every interval, for
+// sources where change notifications don't work, like NFS or SMB mounts
+// changed by other machines. A rescan only reads the directory listings
+// and file metadata, and compares a fingerprint of every directory with the
+// previous one. Changed directories are synced once a rescan finds no
+// further changes, so files still being copied in aren't picked up half way.
+func (s *syncer) pollSource(interval time.Duration) {
+	previous, err := s.fingerprintSource()
+	if err != nil {
+		fmt.Println("Error scanning source:", err)
+		exit(1)
+	}
+	fmt.Printf("Polling %s for changes every %s...\n", s.options.sourceDir, interval)
+
+	pending := make(map[string]bool)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.runCtx.Done():
+			return
+		case <-ticker.C:
+		}
+		current, err := s.fingerprintSource()
+		if err != nil {
+			fmt.Println("Error scanning source:", err)
+			continue
+		}
+		changed := false
+		for dir, fp := range current {
+			if previous[dir] != fp {
+				addPending(pending, dir)
+				changed = true
+			}
+		}
+		for dir := range previous {
+			if _, ok := current[dir]; !ok {
+				addPending(pending, dir)
+				changed = true
+			}
+		}
+		previous = current
+		if changed || len(pending) == 0 {
+			continue
+		}
+		s.syncPending(pending)
+		pending = make(map[string]bool)
+		fmt.Printf("Polling %s for changes every %s...\n", s.options.sourceDir, interval)
+	}
+}
+
+// fingerprintSource returns a fingerprint of the entries (names, sizes,
+// modification times) of every source directory, by its path relative to
+// the source. A new, changed or removed file changes the fingerprint of its
+// directory.
+func (s *syncer) fingerprintSource() (map[string]uint64, error) {
+	fingerprints := make(map[string]uint64)
+	err := filepath.WalkDir(s.options.sourceDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if s.isInternalPath(path, s.options.sourceDir) {
+			return filepath.SkipDir
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		h := fnv.New64a()
+		for _, entry := range entries {
+			fmt.Fprintf(h, "%s\x00%t", entry.Name(), entry.IsDir())
+			if !entry.IsDir() {
+				if info, err := entry.Info(); err == nil {
+					fmt.Fprintf(h, "\x00%d\x00%d", info.Size(), info.ModTime().UnixNano())
+				}
+			}
+			h.Write([]byte{0})
+		}
+		rel, _ := filepath.Rel(s.options.sourceDir, path)
+		fingerprints[rel] = h.Sum64()
+		return nil
+	})
+	return fingerprints, err
+}
+
+// addWatches watches dir and all directories below it. fsnotify doesn't
+// watch recursively on its own.
+func (s *syncer) addWatches(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if s.isInternalPath(path, s.options.sourceDir) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// watchScopes reduces the changed directories to the smallest set covering
+// all of them, dropping those that are below another changed directory.
+func watchScopes(pending map[string]bool) []string {
+	var dirs []string
+	for dir := range pending {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	var scopes []string
+	for _, dir := range dirs {
+		covered := false
+		for _, scope := range scopes {
+			if inScope(dir, scope) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			scopes = append(scopes, dir)
+		}
+	}
+	return scopes
+}
+
+// inScope reports whether the relative path rel is scope or below it.
+func inScope(rel, scope string) bool {
+	return scope == "." || rel == scope || strings.HasPrefix(rel, scope+string(filepath.Separator))
+}
+
+// syncDirs syncs the files in the given source directories (relative to the
+// source) and merges the results into the DB. Entries for files in those
+// directories that disappeared are dropped, and with --delete-removed their
+// targets are deleted.
+func (s *syncer) syncDirs(dirs []string) error {
+	s.pingHealthcheckStart()
+	dbPath := s.syncDBPath()
+	var oldDB syncDB
+	s.loadDB(&oldDB, dbPath)
+
+	s.resetDirConfigs()
+	jobs, err := s.scanDirs(dirs, &oldDB, nil)
+	if err != nil {
+		s.reportRunEnd(&oldDB, nil, nil, err)
+		return err
+	}
+	s.planScannedJobs(jobs, &oldDB)
+	if !s.confirmMassChange(jobs, nil) {
+		s.reportRunEnd(&oldDB, nil, nil, errTooManyChanges)
+		return errTooManyChanges
+	}
+
+	affected := func(e SyncDBEntry) bool {
+		for _, dir := range dirs {
+			if inScope(e.SourcePath, dir) {
+				return true
+			}
+		}
+		return false
+	}
+
+	s.pruneUnselected(jobs)
+	entries, err := s.executeJobs(jobs)
+	var newDB syncDB
+	for _, e := range oldDB.Entries {
+		if !affected(e) {
+			newDB.Entries = append(newDB.Entries, e)
+		}
+	}
+	newDB.Entries = append(newDB.Entries, entries...)
+	if err != nil {
+		s.saveDB(&newDB, dbPath)
+		s.reportRunEnd(&oldDB, &newDB, jobs, err)
+		return err
+	}
+	s.saveDB(&newDB, dbPath)
+
+	if s.options.deleteRemovedFiles {
+		for _, e := range oldDB.Entries {
+			if !affected(e) || !e.hasTarget() {
+				continue
+			}
+			for _, rel := range []string{e.TargetPath, e.Thumbnail, e.Cue} {
+				if rel == "" || newDB.findTarget(rel) != nil || s.globFiltered(rel) {
+					continue
+				}
+				if _, ok := s.ownedByOtherDB(rel); ok {
+					continue
+				}
+				path := filepath.Join(s.options.targetDir, rel)
+				if err := s.checkTargetPath(path); err != nil {
+					fmt.Println("Error:", err)
+					continue
+				}
+				if err := s.removeTarget(path); err != nil && !os.IsNotExist(err) {
+					fmt.Println("Error deleting file:", err)
+				}
+			}
+		}
+	}
+
+	s.finishRun(&oldDB, &newDB, jobs).Print()
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// WavPack files made in hybrid mode hold a lossy stream, and the correction
+// file next to them (track.wvc for track.wv) what it takes to restore the
+// original. ffmpeg only reads the lossy part, so pairs are decoded with
+// wvunpack, which uses the correction file on its own.
+const (
+	correctionExtension = ".wvc"
+	wvunpackBinary      = "wvunpack"
+)
+
+// correctionFile returns the path of the correction file of a WavPack
+// source, or "" if it has none.
+func correctionFile(sourcePath string) string {
+	if !strings.EqualFold(filepath.Ext(sourcePath), ".wv") {
+		return ""
+	}
+	stem := strings.TrimSuffix(sourcePath, filepath.Ext(sourcePath))
+	for _, ext := range []string{correctionExtension, strings.ToUpper(correctionExtension)} {
+		if fileExists(stem + ext) {
+			return stem + ext
+		}
+	}
+	return ""
+}
+
+// findCorrection records the correction file of the job's source, if it has
+// one.
+func (job *syncJob) findCorrection() {
+	if path := correctionFile(job.sourcePath); path != "" {
+		job.correctionInfo, _ = os.Stat(path)
+	}
+}
+
+// isOrphanedCorrection reports whether a correction file has no WavPack file
+// next to it.
+func isOrphanedCorrection(path string) bool {
+	stem := strings.TrimSuffix(path, filepath.Ext(path))
+	return !fileExists(stem+".wv") && !fileExists(stem+".WV")
+}
+
+// correctionChanged reports whether the correction file of a job was added,
+// removed or changed since the entry was recorded. The pair is one source:
+// either changing means converting it again.
+func (s *syncer) correctionChanged(job syncJob, e *SyncDBEntry) bool {
+	if job.correctionInfo == nil || e.CorrectionModTime == nil {
+		return job.correctionInfo != nil || e.CorrectionModTime != nil
+	}
+	return e.CorrectionSize != job.correctionInfo.Size() || !s.sameModTime(*e.CorrectionModTime, job.correctionInfo.ModTime())
+}
+
+// decodingCorrection wraps a command runner for WavPack sources with a
+// correction file: the pair is decoded losslessly into a temporary WAV file,
+// which the command converts instead of the source, and the tags of the
+// source are copied to the result afterwards.
+func (s *syncer) decodingCorrection(run commandRunner) commandRunner {
+	return func(template string, job syncJob) error {
+		wav := s.tempPath(job.targetFile + ".wav")
+		defer os.Remove(wav)
+		cmd := exec.CommandContext(s.runCtx, wvunpackBinary, "-q", "-y", job.sourcePath, wav)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			if s.interrupted() {
+				return errInterrupted
+			}
+			reportCommandFailure(job.relPath, err, string(output))
+			return err
+		}
+
+		original := job.sourcePath
+		job.sourcePath = wav
+		if err := run(template, job); err != nil {
+			return err
+		}
+		job.sourcePath = original
+		return s.refreshMetadata(job)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Worker protocol: the coordinator POSTs the source bytes to /convert with
+// the command template and the input/output extensions in headers. The worker
+// runs the command on a private copy and answers with the encoded output, or
+// with status 500 and the command output if it failed.
+const (
+	workerPath         = "/convert"
+	headerCommand      = "X-Command"
+	headerInputExt     = "X-Input-Ext"
+	headerOutputExt    = "X-Output-Ext"
+	maxWorkerErrOutput = 64 << 10
+	// maxWorkerUpload bounds the source files a worker accepts, far above
+	// any track but below what fills its disk by accident.
+	maxWorkerUpload = 4 << 30
+)
+
+// workerExtPattern restricts the extensions a coordinator may send, since they
+// end up in file names on the worker.
+var workerExtPattern = regexp.MustCompile(`^\.[A-Za-z0-9]{1,10}$`)
+
+// workerURLPattern matches arguments that ffmpeg would open as a URL of
+// some protocol (http:, tcp:, file:, ...) or a Windows drive path.
+var workerURLPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*:`)
+
+// runWorker serves conversion requests from coordinators until it fails.
+// Workers run the commands they are sent, so a token is mandatory, only the
+// programs named in programs are run, and on a network address the token
+// must not cross it in plain text.
+func (s *syncer) runWorker(listen, token string, programs []string, https serverTLS) {
+	if token == "" {
+		fmt.Println("A worker needs a --worker-token, it runs the commands coordinators send it.")
+		exit(1)
+	}
+	if !isLoopbackListen(listen) && !https.enabled() {
+		fmt.Println("A worker on a network address needs HTTPS (--tls-self-signed, or --tls-cert and --tls-key), the token would cross the network in plain text.")
+		exit(1)
+	}
+	https = prepareTLS(https)
+	mux := http.NewServeMux()
+	mux.HandleFunc(workerPath, s.handleConvert(token, programs))
+	fmt.Printf("Worker listening on %s\n", listen)
+	if err := https.listenAndServe(&http.Server{Addr: listen, Handler: mux}); err != nil {
+		fmt.Println("Error running worker:", err)
+		exit(1)
+	}
+}
+
+// checkWorkerCommand makes sure a command template sent to a worker runs one
+// of programs (by name, found in the PATH of the worker) and only touches
+// the files of its request: no argument may name a path or a URL, apart
+// from $INPUT and $OUTPUT. Relative names are resolved in the private
+// directory of the request.
+func checkWorkerCommand(template string, programs []string) error {
+	args := splitCommand(template)
+	if len(args) == 0 || !slices.Contains(programs, args[0]) {
+		return fmt.Errorf("program not allowed on this worker")
+	}
+	for _, arg := range args[1:] {
+		rest := strings.NewReplacer("$INPUT", "", "$OUTPUT", "").Replace(arg)
+		if strings.ContainsAny(rest, `/\`) || rest == ".." || workerURLPattern.MatchString(rest) {
+			return fmt.Errorf("argument %q not allowed on this worker", arg)
+		}
+	}
+	return nil
+}
+
+func (s *syncer) handleConvert(token string, programs []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		auth := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		template := r.Header.Get(headerCommand)
+		inExt, outExt := r.Header.Get(headerInputExt), r.Header.Get(headerOutputExt)
+		if template == "" || strings.ContainsAny(template, "\r\n") ||
+			!workerExtPattern.MatchString(inExt) || !workerExtPattern.MatchString(outExt) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if err := checkWorkerCommand(template, programs); err != nil {
+			fmt.Printf("Refused command from %s: %v\n", r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxWorkerUpload)
+
+		dir, err := os.MkdirTemp("", "smsworker-")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer os.RemoveAll(dir)
+		inputPath, outputPath := filepath.Join(dir, "in"+inExt), filepath.Join(dir, "out"+outExt)
+
+		in, err := os.Create(inputPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, err = io.Copy(in, r.Body)
+		in.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		output, err := s.execTemplateIn(dir, template, inputPath, outputPath)
+		if err != nil {
+			fmt.Printf("Error running command from %s: %v\n", r.RemoteAddr, err)
+			http.Error(w, fmt.Sprintf("%v\n%s", err, output), http.StatusInternalServerError)
+			return
+		}
+		out, err := os.Open(outputPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer out.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.Copy(w, out)
+		fmt.Printf("Converted %s for %s\n", inExt, r.RemoteAddr)
+	}
+}
+
+// jobRunners returns one command runner per processing slot: a single local
+// slot, or one slot per --workers entry. Listing a worker several times gives
+// it several concurrent jobs.
+func (s *syncer) jobRunners() []commandRunner {
+	if len(s.options.workers) == 0 {
+		return []commandRunner{s.runCommand}
+	}
+	client := workerClient(s.options.workerFingerprint)
+	var runners []commandRunner
+	for _, url := range s.options.workers {
+		runners = append(runners, s.remoteRunner(client, url, s.options.workerToken))
+	}
+	return runners
+}
+
+// workerClient returns the HTTP client for talking to workers. With a
+// fingerprint, HTTPS workers must present the certificate that has it
+// (like one made with --tls-self-signed), instead of one a CA signed.
+func workerClient(fingerprint string) *http.Client {
+	if fingerprint == "" {
+		return http.DefaultClient
+	}
+	want := strings.ToUpper(strings.ReplaceAll(fingerprint, ":", ""))
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		// The certificate is checked against the fingerprint below instead.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) > 0 {
+				sum := sha256.Sum256(rawCerts[0])
+				if strings.ToUpper(hex.EncodeToString(sum[:])) == want {
+					return nil
+				}
+			}
+			return fmt.Errorf("the certificate of the worker doesn't have the --worker-fingerprint")
+		},
+	}
+	return &http.Client{Transport: transport}
+}
+
+// remoteRunner returns a command runner that sends the job to a worker and
+// writes the returned output to the target.
+func (s *syncer) remoteRunner(client *http.Client, url, token string) commandRunner {
+	endpoint := strings.TrimSuffix(url, "/") + workerPath
+	return func(template string, job syncJob) error {
+		in, err := os.Open(job.sourcePath)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		req, err := http.NewRequestWithContext(s.runCtx, http.MethodPost, endpoint, in)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(headerCommand, template)
+		req.Header.Set(headerInputExt, filepath.Ext(job.sourcePath))
+		req.Header.Set(headerOutputExt, filepath.Ext(job.targetFile))
+		resp, err := client.Do(req)
+		if err != nil {
+			if s.interrupted() {
+				return errInterrupted
+			}
+			fmt.Printf("Error sending %s to worker %s: %v\n", job.relPath, url, err)
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			output, _ := io.ReadAll(io.LimitReader(resp.Body, maxWorkerErrOutput))
+			err := fmt.Errorf("worker %s: %s", url, resp.Status)
+			reportCommandFailure(job.relPath, err, string(output))
+			return err
+		}
+
+		tmp := s.tempPath(job.targetFile)
+		out, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, resp.Body)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(tmp)
+			if s.interrupted() {
+				return errInterrupted
+			}
+			return fmt.Errorf("receiving output from worker %s: %w", url, err)
+		}
+		return s.renameInto(tmp, job.targetFile)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || netbsd)
+
+package main
+
+import "errors"
+
+// copyXattrs is not supported on this platform.
+func copyXattrs(src, dst string) error {
+	return errors.New("extended attributes are not supported on this platform")
+}
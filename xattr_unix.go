@@ -0,0 +1,58 @@
+//go:build linux || darwin || freebsd || netbsd
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyXattrs copies the extended attributes of src to dst, see --xattrs.
+func copyXattrs(src, dst string) error {
+	size, err := unix.Listxattr(src, nil)
+	if err != nil || size == 0 {
+		return err
+	}
+	list := make([]byte, size)
+	if size, err = unix.Listxattr(src, list); err != nil {
+		return err
+	}
+	var errs []error
+	for _, name := range bytes.Split(list[:size], []byte{0}) {
+		if len(name) == 0 || skipXattr(string(name)) {
+			continue
+		}
+		value, err := getXattr(src, string(name))
+		if err == nil {
+			err = unix.Setxattr(dst, string(name), value, 0)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// getXattr returns the value of the extended attribute name of path.
+func getXattr(path, name string) ([]byte, error) {
+	size, err := unix.Getxattr(path, name, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = unix.Getxattr(path, name, value)
+	return value[:size], err
+}
+
+// skipXattr reports whether the attribute name isn't copied: the quarantine
+// flag macOS puts on downloads, and the Linux namespaces that belong to the
+// system rather than the user (security labels, ACLs).
+func skipXattr(name string) bool {
+	return name == "com.apple.quarantine" ||
+		strings.HasPrefix(name, "security.") ||
+		strings.HasPrefix(name, "system.") ||
+		strings.HasPrefix(name, "trusted.")
+}